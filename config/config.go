@@ -0,0 +1,424 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// configFileKey the environment variable naming the configuration file, when the -config flag is not given.
+const configFileKey = "CONFIG_FILE"
+
+// Config the configuration of the service. Each setting is named by the environment variable it is read from, in its
+// `env` tag. The same name, lower case, sets it in the configuration file, and with dashes, on the command line.
+type Config struct {
+	// BindAddr the address to bind to.
+	BindAddr string `env:"BIND_ADDR"`
+
+	// KafkaBrokers the addresses of the Kafka brokers to send messages to and consume messages from.
+	KafkaBrokers []string `env:"KAFKA_ADDR"`
+
+	// KafkaTLS connect to the Kafka brokers using TLS.
+	KafkaTLS bool `env:"KAFKA_TLS"`
+
+	// KafkaTLSCAFile a PEM file of the certificate authorities trusted to sign the certificates of the Kafka brokers.
+	// Empty to trust the system's certificate authorities.
+	KafkaTLSCAFile string `env:"KAFKA_TLS_CA_FILE"`
+
+	// KafkaTLSCertFile a PEM file of the client certificate presented to the Kafka brokers. Empty for none.
+	KafkaTLSCertFile string `env:"KAFKA_TLS_CERT_FILE"`
+
+	// KafkaTLSKeyFile a PEM file of the private key of KafkaTLSCertFile.
+	KafkaTLSKeyFile string `env:"KAFKA_TLS_KEY_FILE"`
+
+	// KafkaTLSInsecureSkipVerify do not verify the certificates of the Kafka brokers. For local use only.
+	KafkaTLSInsecureSkipVerify bool `env:"KAFKA_TLS_INSECURE_SKIP_VERIFY"`
+
+	// KafkaSASLMechanism the SASL mechanism used to authenticate with the Kafka brokers, "PLAIN", "SCRAM-SHA-256",
+	// "SCRAM-SHA-512", or empty for none.
+	KafkaSASLMechanism string `env:"KAFKA_SASL_MECHANISM"`
+
+	// KafkaSASLUser the user to authenticate as with SASL.
+	KafkaSASLUser string `env:"KAFKA_SASL_USER"`
+
+	// KafkaSASLPassword the password of KafkaSASLUser.
+	KafkaSASLPassword string `env:"KAFKA_SASL_PASSWORD" secret:"true"`
+
+	// AWSRegion the AWS region to use.
+	AWSRegion string `env:"AWS_REGION"`
+
+	// AWSCredentialSource where AWS credentials are read from: "default", "env", "profile" or "assume-role".
+	AWSCredentialSource string `env:"AWS_CREDENTIAL_SOURCE"`
+
+	// AWSProfile the shared config profile to use when AWSCredentialSource is "profile". Empty for the default profile.
+	AWSProfile string `env:"AWS_PROFILE"`
+
+	// AWSRoleARN the role to assume when AWSCredentialSource is "assume-role".
+	AWSRoleARN string `env:"AWS_ROLE_ARN"`
+
+	// AWSRoleSessionName the session name used when assuming AWSRoleARN.
+	AWSRoleSessionName string `env:"AWS_ROLE_SESSION_NAME"`
+
+	// S3Endpoint the S3 endpoint to use instead of AWS, e.g. "http://localhost:9000" for MinIO. Empty for AWS.
+	S3Endpoint string `env:"S3_ENDPOINT"`
+
+	// S3ForcePathStyle address buckets as http://endpoint/bucket rather than http://bucket.endpoint, as MinIO requires.
+	S3ForcePathStyle bool `env:"S3_FORCE_PATH_STYLE"`
+
+	// S3BucketRegions the region of each bucket, configured as "bucket=region,bucket2=region2". The region of any other
+	// bucket is discovered from S3, falling back to AWSRegion.
+	S3BucketRegions map[string]string `env:"S3_BUCKET_REGIONS"`
+
+	// KafkaConsumerGroup the consumer group to consume messages from.
+	KafkaConsumerGroup string `env:"KAFKA_CONSUMER_GROUP"`
+
+	// KafkaConsumerTopic the name of the topic to consume messages from.
+	KafkaConsumerTopic string `env:"KAFKA_CONSUMER_TOPIC"`
+
+	// KafkaTransformTopic the name of the topic to send transform request messages to.
+	KafkaTransformTopic string `env:"KAFKA_TRANSFORM_TOPIC"`
+
+	// OutputS3Bucket the name of the bucket to send filtered csv files to
+	OutputS3Bucket string `env:"OUTPUT_S3_BUCKET"`
+
+	// OutputKeyTemplate the template for the key of filtered files within OutputS3Bucket. The tokens {date},
+	// {requestId}, {filename}, {filterHash} and {dataset} are replaced with values from the request.
+	OutputKeyTemplate string `env:"OUTPUT_KEY_TEMPLATE"`
+
+	// ResultCacheURL the s3 location to cache filtered files in, so that repeated requests can be copied instead of
+	// filtered again. Empty to disable the cache.
+	ResultCacheURL string `env:"RESULT_CACHE_URL"`
+
+	// S3ServerSideEncryption the server side encryption to apply to uploaded files, "AES256" or "aws:kms". Empty for
+	// none.
+	S3ServerSideEncryption string `env:"S3_SERVER_SIDE_ENCRYPTION"`
+
+	// S3SSEKMSKeyID the KMS key to use when S3ServerSideEncryption is "aws:kms" and the bucket has no key of its own.
+	S3SSEKMSKeyID string `env:"S3_SSE_KMS_KEY_ID"`
+
+	// S3SSEKMSKeyIDs the KMS key to use for each output bucket, configured as "bucket=keyId,bucket2=keyId2".
+	S3SSEKMSKeyIDs map[string]string `env:"S3_SSE_KMS_KEY_IDS"`
+
+	// S3StorageClass the storage class of uploaded files. Empty for the bucket default.
+	S3StorageClass string `env:"S3_STORAGE_CLASS"`
+
+	// S3ACL the canned ACL to apply to uploaded files. Empty for the bucket default.
+	S3ACL string `env:"S3_ACL"`
+
+	// S3Tags the tags to apply to uploaded files, configured as "key=value,key2=value2".
+	S3Tags map[string]string `env:"S3_TAGS"`
+
+	// S3AllowedServerSideEncryption the server side encryption values a request may choose.
+	S3AllowedServerSideEncryption []string `env:"S3_ALLOWED_SERVER_SIDE_ENCRYPTION"`
+
+	// S3AllowedStorageClasses the storage classes a request may choose.
+	S3AllowedStorageClasses []string `env:"S3_ALLOWED_STORAGE_CLASSES"`
+
+	// S3AllowedACLs the canned ACLs a request may choose.
+	S3AllowedACLs []string `env:"S3_ALLOWED_ACLS"`
+
+	// S3AllowedTagKeys the tag keys a request may set.
+	S3AllowedTagKeys []string `env:"S3_ALLOWED_TAG_KEYS"`
+
+	// S3MaxAttempts the number of times an S3 operation is attempted before a throttled or transient failure is
+	// returned.
+	S3MaxAttempts int `env:"S3_MAX_ATTEMPTS"`
+
+	// S3RetryBackoff the time to wait before the first retry of an S3 operation. It doubles after each attempt.
+	S3RetryBackoff time.Duration `env:"S3_RETRY_BACKOFF"`
+
+	// S3RetryMaxBackoff the longest time to wait between attempts of an S3 operation.
+	S3RetryMaxBackoff time.Duration `env:"S3_RETRY_MAX_BACKOFF"`
+
+	// FilterParallelism the number of byte ranges of an input file filtered at once. 1 filters the file as a single
+	// stream.
+	FilterParallelism int `env:"FILTER_PARALLELISM"`
+
+	// FilterRangeSize the size in bytes of each byte range when FilterParallelism is greater than 1. Files no larger
+	// than this are filtered as a single stream.
+	FilterRangeSize int64 `env:"FILTER_RANGE_SIZE"`
+
+	// DownloadTimeout the longest time a request may spend checking its input file, and opening each part of it to be
+	// read. 0 for no limit.
+	DownloadTimeout time.Duration `env:"DOWNLOAD_TIMEOUT"`
+
+	// FilterTimeout the longest time a request may spend reading and filtering its input file. 0 for no limit.
+	FilterTimeout time.Duration `env:"FILTER_TIMEOUT"`
+
+	// UploadTimeout the longest time a request may spend uploading its output files and report. 0 for no limit.
+	UploadTimeout time.Duration `env:"UPLOAD_TIMEOUT"`
+
+	// InputMaxSize the size in bytes of the largest input file that will be filtered. 0 for no limit.
+	InputMaxSize int64 `env:"INPUT_MAX_SIZE"`
+
+	// InputContentTypes the content types an input file may have. Files without a content type are always accepted.
+	InputContentTypes []string `env:"INPUT_CONTENT_TYPES"`
+
+	// InputContentEncodings the content encodings an input file may have. Files without a content encoding are always
+	// accepted.
+	InputContentEncodings []string `env:"INPUT_CONTENT_ENCODINGS"`
+
+	// SchemaRegistryDir a directory of message schemas, named <subject>/v<version>.json, to use instead of the schemas
+	// built into the service. Empty to use the built in schemas.
+	SchemaRegistryDir string `env:"SCHEMA_REGISTRY_DIR"`
+
+	// MessageEnvelope send transform requests wrapped in a schema versioned envelope. Incoming messages are accepted
+	// with or without an envelope.
+	MessageEnvelope bool `env:"MESSAGE_ENVELOPE"`
+
+	// OutboxDir the directory transform requests are recorded in until they have been sent, so that they are sent
+	// even if Kafka is unavailable or the service stops. Empty to keep them in memory, for local use only.
+	OutboxDir string `env:"OUTBOX_DIR"`
+
+	// OutboxRetryBackoff the time to wait before retrying a transform request that failed to send. It doubles after
+	// each attempt.
+	OutboxRetryBackoff time.Duration `env:"OUTBOX_RETRY_BACKOFF"`
+
+	// OutboxRetryMaxBackoff the longest time to wait between attempts to send a transform request.
+	OutboxRetryMaxBackoff time.Duration `env:"OUTBOX_RETRY_MAX_BACKOFF"`
+
+	// TracesExporter where trace spans are sent: "otlp" to OTLPEndpoint, "stdout", or "none".
+	TracesExporter string `env:"OTEL_TRACES_EXPORTER"`
+
+	// OTLPEndpoint the OpenTelemetry collector to send trace spans to, using OTLP over http.
+	OTLPEndpoint string `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+
+	// ServiceName the name of the service recorded with trace spans.
+	ServiceName string `env:"OTEL_SERVICE_NAME"`
+}
+
+// Default returns the configuration used when no setting is given.
+func Default() *Config {
+	return &Config{
+		BindAddr:              ":21100",
+		KafkaBrokers:          []string{"localhost:9092"},
+		AWSRegion:             "eu-west-1",
+		AWSCredentialSource:   "default",
+		AWSRoleSessionName:    "dp-dd-csv-filter",
+		S3BucketRegions:       map[string]string{},
+		KafkaConsumerGroup:    "filter-request",
+		KafkaConsumerTopic:    "filter-request",
+		KafkaTransformTopic:   "transform-request",
+		OutputS3Bucket:        "dp-dd-csv-filter-develop/" + os.Getenv("USER") + "/filtered/",
+		OutputKeyTemplate:     "{filename}",
+		S3SSEKMSKeyIDs:        map[string]string{},
+		S3Tags:                map[string]string{},
+		S3MaxAttempts:         4,
+		S3RetryBackoff:        200 * time.Millisecond,
+		S3RetryMaxBackoff:     5 * time.Second,
+		FilterParallelism:     1,
+		FilterRangeSize:       64 * 1024 * 1024,
+		DownloadTimeout:       time.Minute,
+		FilterTimeout:         30 * time.Minute,
+		UploadTimeout:         15 * time.Minute,
+		InputContentTypes:     []string{"text/csv", "application/csv", "text/plain", "application/vnd.ms-excel", "application/octet-stream", "binary/octet-stream"},
+		InputContentEncodings: []string{"identity"},
+		OutboxDir:             "/var/tmp/dp-dd-csv-filter/outbox",
+		OutboxRetryBackoff:    time.Second,
+		OutboxRetryMaxBackoff: time.Minute,
+		TracesExporter:        "none",
+		OTLPEndpoint:          "http://localhost:4318",
+		ServiceName:           "dp-dd-csv-filter",
+	}
+}
+
+// Load reads the configuration and validates it. Each setting is taken from the first of: the command line flags, the
+// environment, the configuration file named by the -config flag or CONFIG_FILE, and the defaults.
+func Load(args []string) (*Config, error) {
+	flagValues, file, err := parseFlags(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(file) == 0 {
+		file = os.Getenv(configFileKey)
+	}
+
+	cfg := Default()
+	if len(file) > 0 {
+		fileValues, err := readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.set(fileValues, "'"+file+"'"); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.set(envValues(), "the environment"); err != nil {
+		return nil, err
+	}
+	if err := cfg.set(flagValues, "the command line"); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	log.Debug("dp-csv-filter Configuration", cfg.logData())
+	return cfg, nil
+}
+
+// setting a field of the Config, with the name of the environment variable it is read from.
+type setting struct {
+	key    string
+	value  reflect.Value
+	secret bool
+}
+
+// settings returns every setting of the configuration, in the order they are declared.
+func (c *Config) settings() []setting {
+	v := reflect.ValueOf(c).Elem()
+	result := make([]setting, v.NumField())
+	for i := range result {
+		field := v.Type().Field(i)
+		result[i] = setting{key: field.Tag.Get("env"), value: v.Field(i), secret: field.Tag.Get("secret") == "true"}
+	}
+	return result
+}
+
+// set sets each setting named in values, keyed by environment variable, from its text.
+func (c *Config) set(values map[string]string, source string) error {
+	for _, s := range c.settings() {
+		text, ok := values[s.key]
+		if !ok {
+			continue
+		}
+		if err := parseValue(s.value, text); err != nil {
+			return fmt.Errorf("Invalid value '%s' for %s from %s: %s.", text, s.key, source, err.Error())
+		}
+	}
+	return nil
+}
+
+// parseValue sets the value from its text.
+func parseValue(value reflect.Value, text string) error {
+	switch p := value.Addr().Interface().(type) {
+	case *string:
+		*p = text
+	case *bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return fmt.Errorf("expected true or false")
+		}
+		*p = b
+	case *int:
+		i, err := strconv.Atoi(text)
+		if err != nil {
+			return fmt.Errorf("expected a whole number")
+		}
+		*p = i
+	case *int64:
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected a whole number")
+		}
+		*p = i
+	case *time.Duration:
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return fmt.Errorf("expected a duration, e.g. \"5s\"")
+		}
+		*p = d
+	case *[]string:
+		*p = parseList(text)
+	case *map[string]string:
+		*p = parseMap(text)
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
+
+// envValues returns the settings given in the environment. Empty variables are ignored.
+func envValues() map[string]string {
+	values := make(map[string]string)
+	for _, s := range Default().settings() {
+		if text := os.Getenv(s.key); len(text) > 0 {
+			values[s.key] = text
+		}
+	}
+	return values
+}
+
+// parseFlags returns the settings given on the command line, and the configuration file given by the -config flag.
+func parseFlags(args []string) (map[string]string, string, error) {
+	values := make(map[string]string)
+	flags := flag.NewFlagSet("dp-dd-csv-filter", flag.ContinueOnError)
+	file := flags.String("config", "", "A TOML file of settings. Defaults to the file named by "+configFileKey+".")
+	for _, s := range Default().settings() {
+		name := strings.ToLower(strings.Replace(s.key, "_", "-", -1))
+		flags.Var(&flagValue{key: s.key, values: values, isBool: s.value.Kind() == reflect.Bool}, name, "Sets "+s.key+".")
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, "", err
+	}
+	return values, *file, nil
+}
+
+// flagValue records the text of a setting given on the command line, keyed by environment variable. Boolean settings
+// may be given without a value, e.g. -kafka-tls.
+type flagValue struct {
+	key    string
+	values map[string]string
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	return ""
+}
+
+func (f *flagValue) Set(text string) error {
+	f.values[f.key] = text
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// logData the settings to log at startup, keyed by environment variable. Secrets are masked.
+func (c *Config) logData() log.Data {
+	data := log.Data{}
+	for _, s := range c.settings() {
+		switch v := s.value.Interface().(type) {
+		case time.Duration:
+			data[s.key] = v.String()
+		case string:
+			if s.secret && len(v) > 0 {
+				v = "****"
+			}
+			data[s.key] = v
+		default:
+			data[s.key] = v
+		}
+	}
+	return data
+}
+
+// parseList parses a comma separated list, ignoring blank entries.
+func parseList(s string) []string {
+	result := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// parseMap parses a comma separated list of key=value pairs, ignoring entries without a key.
+func parseMap(s string) map[string]string {
+	result := make(map[string]string)
+	for _, item := range parseList(s) {
+		pair := strings.SplitN(item, "=", 2)
+		if key := strings.TrimSpace(pair[0]); len(key) > 0 && len(pair) == 2 {
+			result[key] = strings.TrimSpace(pair[1])
+		}
+	}
+	return result
+}
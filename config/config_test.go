@@ -0,0 +1,167 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeFile writes a configuration file to the directory and returns its path.
+func writeFile(dir string, content string) string {
+	path := filepath.Join(dir, "config.toml")
+	ioutil.WriteFile(path, []byte(content), 0600)
+	return path
+}
+
+// setenv sets an environment variable, returning a function that restores its previous value.
+func setenv(key string, value string) func() {
+	previous, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+
+	Convey("Given no settings", t, func() {
+		cfg, err := config.Load([]string{})
+
+		Convey("Then the defaults are used", func() {
+			So(err, ShouldBeNil)
+			So(cfg.BindAddr, ShouldEqual, ":21100")
+			So(cfg.KafkaBrokers, ShouldResemble, []string{"localhost:9092"})
+			So(cfg.S3RetryBackoff, ShouldEqual, 200*time.Millisecond)
+		})
+	})
+
+	Convey("Given a setting in the file, the environment and on the command line", t, func() {
+		dir, _ := ioutil.TempDir("", "config")
+		defer os.RemoveAll(dir)
+		file := writeFile(dir, `
+[kafka]
+addr = ["file-1:9092", "file-2:9092"]
+consumer-group = "file-group"
+consumer_topic = "file-topic"
+
+[filter]
+parallelism = 2
+`)
+		defer setenv("KAFKA_CONSUMER_GROUP", "env-group")()
+		defer setenv("FILTER_PARALLELISM", "3")()
+
+		cfg, err := config.Load([]string{"-config", file, "-filter-parallelism", "4"})
+
+		Convey("Then the command line takes precedence over the environment, which takes precedence over the file", func() {
+			So(err, ShouldBeNil)
+			So(cfg.KafkaBrokers, ShouldResemble, []string{"file-1:9092", "file-2:9092"})
+			So(cfg.KafkaConsumerTopic, ShouldEqual, "file-topic")
+			So(cfg.KafkaConsumerGroup, ShouldEqual, "env-group")
+			So(cfg.FilterParallelism, ShouldEqual, 4)
+		})
+	})
+
+	Convey("Given the configuration file is named by CONFIG_FILE", t, func() {
+		dir, _ := ioutil.TempDir("", "config")
+		defer os.RemoveAll(dir)
+		defer setenv("CONFIG_FILE", writeFile(dir, `bind_addr = ":8080"`))()
+
+		cfg, err := config.Load([]string{})
+
+		Convey("Then it is read", func() {
+			So(err, ShouldBeNil)
+			So(cfg.BindAddr, ShouldEqual, ":8080")
+		})
+	})
+
+	Convey("Given a boolean flag without a value", t, func() {
+		cfg, err := config.Load([]string{"-s3-force-path-style"})
+
+		Convey("Then it is set", func() {
+			So(err, ShouldBeNil)
+			So(cfg.S3ForcePathStyle, ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a value that cannot be parsed", t, func() {
+		defer setenv("S3_RETRY_BACKOFF", "soon")()
+
+		_, err := config.Load([]string{})
+
+		Convey("Then an error naming the setting and its source is returned", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Invalid value 'soon' for S3_RETRY_BACKOFF from the environment: expected a duration, e.g. \"5s\".")
+		})
+	})
+
+	Convey("Given an unknown flag", t, func() {
+		_, err := config.Load([]string{"-kafka-adr", "localhost:9092"})
+
+		Convey("Then an error is returned", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a configuration file that does not exist", t, func() {
+		_, err := config.Load([]string{"-config", "/does/not/exist.toml"})
+
+		Convey("Then an error is returned", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestValidate(t *testing.T) {
+
+	Convey("Given the default configuration", t, func() {
+		cfg := config.Default()
+
+		Convey("Then it is valid", func() {
+			So(cfg.Validate(), ShouldBeNil)
+		})
+	})
+
+	Convey("Given a configuration with several problems", t, func() {
+		cfg := config.Default()
+		cfg.KafkaBrokers = []string{}
+		cfg.KafkaTLSCertFile = "cert.pem"
+		cfg.AWSCredentialSource = "assume-role"
+		cfg.FilterParallelism = 0
+		cfg.FilterTimeout = -time.Minute
+
+		err := cfg.Validate()
+
+		Convey("Then every problem is reported", func() {
+			So(err, ShouldHaveSameTypeAs, config.ValidationError{})
+			So(err.(config.ValidationError), ShouldResemble, config.ValidationError{
+				"KAFKA_ADDR must name at least one broker",
+				"KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE must be set together",
+				"KAFKA_TLS_CERT_FILE 'cert.pem' does not exist",
+				"AWS_ROLE_ARN must be set to assume a role",
+				"FILTER_PARALLELISM must be at least 1",
+				"FILTER_TIMEOUT must not be negative",
+			})
+			So(err.Error(), ShouldStartWith, "Invalid configuration: KAFKA_ADDR must name at least one broker; ")
+		})
+	})
+
+	Convey("Given an invalid configuration is loaded", t, func() {
+		defer setenv("OTEL_TRACES_EXPORTER", "jaeger")()
+
+		_, err := config.Load([]string{})
+
+		Convey("Then it is rejected", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Invalid configuration: OTEL_TRACES_EXPORTER must be \"otlp\", \"stdout\" or \"none\".")
+		})
+	})
+}
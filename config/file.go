@@ -0,0 +1,269 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// readFile reads the settings of a configuration file, keyed by environment variable. The file is TOML, in which each
+// setting is named by its environment variable in lower case. A table names a prefix shared by the settings in it, so
+//
+//	[kafka]
+//	addr = ["b-1:9094", "b-2:9094"]
+//	tls = true
+//
+// sets KAFKA_ADDR and KAFKA_TLS. Values are strings, numbers, booleans, arrays of them, or inline tables of strings
+// for the settings that map keys to values. Arrays may span lines. Array items and inline table entries must not
+// contain commas, as they are read as comma separated lists. Only this subset of TOML is supported, as no TOML library
+// is available to the service.
+func readFile(path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)
+	for _, s := range Default().settings() {
+		known[s.key] = true
+	}
+
+	values := make(map[string]string)
+	table := ""
+	p := &fileParser{text: string(b), line: 1}
+	for more := true; more; more = p.nextLine() {
+		line := p.line
+		fail := func(err error) (map[string]string, error) {
+			return nil, fmt.Errorf("Invalid configuration file '%s', line %d: %s.", path, line, err.Error())
+		}
+
+		p.skipSpace()
+		if p.done() {
+			continue
+		}
+
+		if p.consume('[') {
+			p.skipSpace()
+			name := p.key()
+			p.skipSpace()
+			if len(name) == 0 || !p.consume(']') || !p.end() {
+				return fail(errors.New("expected [table]"))
+			}
+			table = name + "_"
+			continue
+		}
+
+		name := p.key()
+		p.skipSpace()
+		if len(name) == 0 || !p.consume('=') {
+			return fail(errors.New("expected key = value"))
+		}
+		p.skipSpace()
+		value, err := p.value()
+		if err != nil {
+			return fail(err)
+		}
+		if !p.end() {
+			return fail(errors.New("unexpected text after the value"))
+		}
+
+		key := strings.ToUpper(table + name)
+		if !known[key] {
+			return fail(fmt.Errorf("unknown setting '%s'", strings.ToLower(key)))
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// fileParser reads a configuration file, a setting at a time.
+type fileParser struct {
+	text string
+	pos  int
+	line int
+}
+
+func (p *fileParser) peek() byte {
+	if p.pos < len(p.text) {
+		return p.text[p.pos]
+	}
+	return 0
+}
+
+func (p *fileParser) consume(c byte) bool {
+	if p.peek() == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *fileParser) skipSpace() {
+	for p.peek() == ' ' || p.peek() == '\t' || p.peek() == '\r' {
+		p.pos++
+	}
+}
+
+// done returns whether the rest of the line is empty or a comment.
+func (p *fileParser) done() bool {
+	return p.pos >= len(p.text) || p.peek() == '#' || p.peek() == '\n'
+}
+
+// end skips trailing space and returns whether nothing but a comment follows.
+func (p *fileParser) end() bool {
+	p.skipSpace()
+	return p.done()
+}
+
+// nextLine skips the rest of the line, returning false if it is the last line of the file.
+func (p *fileParser) nextLine() bool {
+	for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+		p.pos++
+	}
+	if p.pos >= len(p.text) {
+		return false
+	}
+	p.pos++
+	p.line++
+	return true
+}
+
+// skipBlank skips space, line breaks and comments, as arrays may span lines.
+func (p *fileParser) skipBlank() {
+	for p.skipSpace(); p.peek() == '#' || p.peek() == '\n'; p.skipSpace() {
+		if !p.nextLine() {
+			return
+		}
+	}
+}
+
+// key reads the bare or dotted key of a setting, returning it with dots and dashes replaced by underscores.
+func (p *fileParser) key() string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(p.bareKey())
+}
+
+func (p *fileParser) bareKey() string {
+	start := p.pos
+	for c := p.peek(); c == '_' || c == '-' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'; c = p.peek() {
+		p.pos++
+	}
+	return p.text[start:p.pos]
+}
+
+// value reads a value, returning it as it would be given in the environment: arrays as comma separated lists and
+// inline tables as comma separated key=value pairs. Strings and inline tables must end on the line they start on.
+func (p *fileParser) value() (string, error) {
+	switch p.peek() {
+	case '"':
+		end := closingQuote(p.text, p.pos)
+		if end < 0 {
+			return "", errors.New("unterminated string")
+		}
+		quoted := p.text[p.pos : end+1]
+		p.pos = end + 1
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return "", errors.New("invalid escape in string")
+		}
+		return value, nil
+
+	case '\'':
+		end := strings.IndexAny(p.text[p.pos+1:], "'\n")
+		if end < 0 || p.text[p.pos+1+end] != '\'' {
+			return "", errors.New("unterminated string")
+		}
+		value := p.text[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		return value, nil
+
+	case '[':
+		p.pos++
+		items := []string{}
+		for {
+			p.skipBlank()
+			if p.consume(']') {
+				return strings.Join(items, ","), nil
+			}
+			if p.pos >= len(p.text) {
+				return "", errors.New("unterminated array")
+			}
+			item, err := p.value()
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(item, ",") {
+				return "", fmt.Errorf("array item '%s' must not contain a comma", item)
+			}
+			items = append(items, item)
+			p.skipBlank()
+			if p.pos >= len(p.text) {
+				return "", errors.New("unterminated array")
+			}
+			if !p.consume(',') && p.peek() != ']' {
+				return "", errors.New("expected , or ] in array")
+			}
+		}
+
+	case '{':
+		p.pos++
+		pairs := []string{}
+		for {
+			p.skipSpace()
+			if p.consume('}') {
+				return strings.Join(pairs, ","), nil
+			}
+			// The keys of an inline table are bucket names and the like, so are kept as they are.
+			key := p.bareKey()
+			if c := p.peek(); len(key) == 0 && (c == '"' || c == '\'') {
+				var err error
+				if key, err = p.value(); err != nil {
+					return "", err
+				}
+			}
+			p.skipSpace()
+			if len(key) == 0 || !p.consume('=') {
+				return "", errors.New("expected key = value in inline table")
+			}
+			p.skipSpace()
+			value, err := p.value()
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(key, ",") || strings.Contains(value, ",") {
+				return "", fmt.Errorf("inline table entry '%s' must not contain a comma", key)
+			}
+			pairs = append(pairs, key+"="+value)
+			p.skipSpace()
+			if !p.consume(',') && p.peek() != '}' {
+				return "", errors.New("expected , or } in inline table")
+			}
+		}
+	}
+
+	start := p.pos
+	for c := p.peek(); c != 0 && c != ' ' && c != '\t' && c != '\r' && c != '\n' && c != ',' && c != ']' && c != '}' && c != '#'; c = p.peek() {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", errors.New("expected a value")
+	}
+	return p.text[start:p.pos], nil
+}
+
+// closingQuote returns the index of the quote ending the basic string that starts at start, skipping escaped
+// characters, or -1 if the string is not terminated on its line.
+func closingQuote(text string, start int) int {
+	for i := start + 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		case '\n':
+			return -1
+		}
+	}
+	return -1
+}
@@ -0,0 +1,125 @@
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfigFile(t *testing.T) {
+
+	Convey("Given a configuration file using tables, arrays, inline tables and comments", t, func() {
+		dir, _ := ioutil.TempDir("", "config")
+		defer os.RemoveAll(dir)
+		file := writeFile(dir, `# Settings for the test environment.
+bind_addr = ":9000"  # the port
+
+[kafka]
+tls = true
+sasl.mechanism = 'PLAIN'
+sasl.user = "filter"
+sasl.password = "p=ss # not a \"comment\""
+
+[s3]
+bucket_regions = { dp-dd-csv-filter-develop = "eu-west-2", "my.bucket" = "us-east-1" }
+max_attempts = 6
+retry_backoff = "1s"
+
+[input]
+content_types = ["text/csv", "text/plain"]
+max_size = 1048576
+`)
+
+		cfg, err := config.Load([]string{"-config", file})
+
+		Convey("Then each setting is read", func() {
+			So(err, ShouldBeNil)
+			So(cfg.BindAddr, ShouldEqual, ":9000")
+			So(cfg.KafkaTLS, ShouldBeTrue)
+			So(cfg.KafkaSASLMechanism, ShouldEqual, "PLAIN")
+			So(cfg.KafkaSASLUser, ShouldEqual, "filter")
+			So(cfg.KafkaSASLPassword, ShouldEqual, `p=ss # not a "comment"`)
+			So(cfg.S3BucketRegions, ShouldResemble, map[string]string{"dp-dd-csv-filter-develop": "eu-west-2", "my.bucket": "us-east-1"})
+			So(cfg.S3MaxAttempts, ShouldEqual, 6)
+			So(cfg.S3RetryBackoff.String(), ShouldEqual, "1s")
+			So(cfg.InputContentTypes, ShouldResemble, []string{"text/csv", "text/plain"})
+			So(cfg.InputMaxSize, ShouldEqual, 1048576)
+		})
+	})
+
+	Convey("Given a configuration file with an unknown setting", t, func() {
+		dir, _ := ioutil.TempDir("", "config")
+		defer os.RemoveAll(dir)
+		file := writeFile(dir, "[kafka]\n\naddress = \"localhost:9092\"\n")
+
+		_, err := config.Load([]string{"-config", file})
+
+		Convey("Then an error naming the line is returned", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Invalid configuration file '"+file+"', line 3: unknown setting 'kafka_address'.")
+		})
+	})
+
+	Convey("Given a configuration file with a syntax error", t, func() {
+		dir, _ := ioutil.TempDir("", "config")
+		defer os.RemoveAll(dir)
+		file := writeFile(dir, "kafka_addr = [\"localhost:9092\" \"localhost:9093\"]\n")
+
+		_, err := config.Load([]string{"-config", file})
+
+		Convey("Then an error naming the line is returned", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Invalid configuration file '"+file+"', line 1: expected , or ] in array.")
+		})
+	})
+
+	Convey("Given a configuration file with an array that is not terminated", t, func() {
+		dir, _ := ioutil.TempDir("", "config")
+		defer os.RemoveAll(dir)
+		file := writeFile(dir, "bind_addr = \":9000\"\nkafka_addr = [\"localhost:9092\"\n")
+
+		_, err := config.Load([]string{"-config", file})
+
+		Convey("Then an error naming the line the setting starts on is returned", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Invalid configuration file '"+file+"', line 2: unterminated array.")
+		})
+	})
+
+	Convey("Given a configuration file with an array spanning lines", t, func() {
+		dir, _ := ioutil.TempDir("", "config")
+		defer os.RemoveAll(dir)
+		file := writeFile(dir, `[kafka]
+addr = [
+	"b-1:9094", # the first broker
+
+	"b-2:9094",
+]
+tls = true
+`)
+
+		cfg, err := config.Load([]string{"-config", file})
+
+		Convey("Then every item is read, and the settings that follow it", func() {
+			So(err, ShouldBeNil)
+			So(cfg.KafkaBrokers, ShouldResemble, []string{"b-1:9094", "b-2:9094"})
+			So(cfg.KafkaTLS, ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a configuration file with an array item containing a comma", t, func() {
+		dir, _ := ioutil.TempDir("", "config")
+		defer os.RemoveAll(dir)
+		file := writeFile(dir, "[input]\ncontent_types = [\"text/csv\", \"text/plain,charset=utf-8\"]\n")
+
+		_, err := config.Load([]string{"-config", file})
+
+		Convey("Then it is rejected rather than read as two items", func() {
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Invalid configuration file '"+file+"', line 2: array item 'text/plain,charset=utf-8' must not contain a comma.")
+		})
+	})
+}
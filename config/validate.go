@@ -0,0 +1,82 @@
+package config
+
+import (
+	"os"
+	"strings"
+)
+
+// ValidationError the problems found with a configuration.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "Invalid configuration: " + strings.Join(e, "; ") + "."
+}
+
+// Validate checks the configuration is complete and consistent, so that the service fails at startup rather than
+// when the first request is handled. Every problem found is returned in a ValidationError.
+func (c *Config) Validate() error {
+	var problems ValidationError
+	check := func(ok bool, problem string) {
+		if !ok {
+			problems = append(problems, problem)
+		}
+	}
+	oneOf := func(value string, allowed ...string) bool {
+		for _, a := range allowed {
+			if value == a {
+				return true
+			}
+		}
+		return false
+	}
+	fileExists := func(key string, path string) {
+		if len(path) > 0 {
+			_, err := os.Stat(path)
+			check(err == nil, key+" '"+path+"' does not exist")
+		}
+	}
+
+	check(len(c.BindAddr) > 0, "BIND_ADDR must be set")
+	check(len(c.KafkaBrokers) > 0, "KAFKA_ADDR must name at least one broker")
+	check(len(c.KafkaConsumerGroup) > 0, "KAFKA_CONSUMER_GROUP must be set")
+	check(len(c.KafkaConsumerTopic) > 0, "KAFKA_CONSUMER_TOPIC must be set")
+	check(len(c.KafkaTransformTopic) > 0, "KAFKA_TRANSFORM_TOPIC must be set")
+	check((len(c.KafkaTLSCertFile) > 0) == (len(c.KafkaTLSKeyFile) > 0), "KAFKA_TLS_CERT_FILE and KAFKA_TLS_KEY_FILE must be set together")
+	fileExists("KAFKA_TLS_CA_FILE", c.KafkaTLSCAFile)
+	fileExists("KAFKA_TLS_CERT_FILE", c.KafkaTLSCertFile)
+	fileExists("KAFKA_TLS_KEY_FILE", c.KafkaTLSKeyFile)
+	check(oneOf(strings.ToUpper(c.KafkaSASLMechanism), "", "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"), "KAFKA_SASL_MECHANISM must be \"PLAIN\", \"SCRAM-SHA-256\", \"SCRAM-SHA-512\" or empty")
+	if len(c.KafkaSASLMechanism) > 0 {
+		check(len(c.KafkaSASLUser) > 0 && len(c.KafkaSASLPassword) > 0, "KAFKA_SASL_USER and KAFKA_SASL_PASSWORD must be set to use SASL")
+	}
+
+	check(oneOf(c.AWSCredentialSource, "", "default", "env", "profile", "assume-role"), "AWS_CREDENTIAL_SOURCE must be \"default\", \"env\", \"profile\" or \"assume-role\"")
+	if c.AWSCredentialSource == "assume-role" {
+		check(len(c.AWSRoleARN) > 0, "AWS_ROLE_ARN must be set to assume a role")
+	}
+	check(len(c.OutputS3Bucket) > 0, "OUTPUT_S3_BUCKET must be set")
+	check(len(c.OutputKeyTemplate) > 0, "OUTPUT_KEY_TEMPLATE must be set")
+	check(oneOf(c.S3ServerSideEncryption, "", "AES256", "aws:kms"), "S3_SERVER_SIDE_ENCRYPTION must be \"AES256\", \"aws:kms\" or empty")
+	check(c.S3MaxAttempts >= 1, "S3_MAX_ATTEMPTS must be at least 1")
+	check(c.S3RetryBackoff >= 0, "S3_RETRY_BACKOFF must not be negative")
+	check(c.S3RetryMaxBackoff >= c.S3RetryBackoff, "S3_RETRY_MAX_BACKOFF must not be less than S3_RETRY_BACKOFF")
+
+	check(c.FilterParallelism >= 1, "FILTER_PARALLELISM must be at least 1")
+	check(c.FilterRangeSize >= 1, "FILTER_RANGE_SIZE must be at least 1")
+	check(c.DownloadTimeout >= 0, "DOWNLOAD_TIMEOUT must not be negative")
+	check(c.FilterTimeout >= 0, "FILTER_TIMEOUT must not be negative")
+	check(c.UploadTimeout >= 0, "UPLOAD_TIMEOUT must not be negative")
+	check(c.InputMaxSize >= 0, "INPUT_MAX_SIZE must not be negative")
+	if len(c.SchemaRegistryDir) > 0 {
+		info, err := os.Stat(c.SchemaRegistryDir)
+		check(err == nil && info.IsDir(), "SCHEMA_REGISTRY_DIR '"+c.SchemaRegistryDir+"' is not a directory")
+	}
+	check(c.OutboxRetryBackoff > 0, "OUTBOX_RETRY_BACKOFF must be greater than 0")
+	check(c.OutboxRetryMaxBackoff >= c.OutboxRetryBackoff, "OUTBOX_RETRY_MAX_BACKOFF must not be less than OUTBOX_RETRY_BACKOFF")
+	check(oneOf(c.TracesExporter, "", "none", "stdout", "otlp"), "OTEL_TRACES_EXPORTER must be \"otlp\", \"stdout\" or \"none\"")
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	DUPLICATES_KEEP_FIRST = "first"
+	DUPLICATES_KEEP_LAST  = "last"
+	DUPLICATES_FAIL       = "fail"
+
+	tupleSeparator = "\x1f"
+)
+
+// ConflictingRowsError returned when duplicate dimension tuples have different values and the job is set to fail.
+type ConflictingRowsError struct {
+	Dimensions string
+}
+
+func (e *ConflictingRowsError) Error() string {
+	return fmt.Sprintf("Conflicting values found for duplicate dimensions: %s", e.Dimensions)
+}
+
+// deduper drops rows whose dimension tuple has already been seen. Exact duplicates are always dropped; rows with
+// conflicting values are resolved according to the policy. A row is an exact duplicate if the same row has been seen
+// before for its tuple, and conflicts otherwise. Keeping the last row requires every matching row to be read first, so
+// rows are spooled to a temporary file and replayed once the input is exhausted. Tuples are held by their digest, so
+// the memory used per tuple does not grow with the number or length of its dimensions.
+type deduper struct {
+	policy  string
+	report  *Report
+	seen    map[tupleDigest]*tupleRows
+	tempDir string
+
+	spool      *os.File
+	spoolCSV   *csv.Writer
+	spoolCount int
+	lastIndex  map[tupleDigest]int
+}
+
+// tupleDigest the first 128 bits of the SHA-256 of a tuple key.
+type tupleDigest [16]byte
+
+// tupleRows the hashes of the distinct rows seen for a tuple, and the hash of the row seen most recently.
+type tupleRows struct {
+	hashes []uint64
+	latest uint64
+}
+
+func (t *tupleRows) contains(hash uint64) bool {
+	for _, h := range t.hashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+func newDeduper(policy string, report *Report, tempDir string) *deduper {
+	return &deduper{policy: policy, report: report, seen: make(map[tupleDigest]*tupleRows), tempDir: tempDir}
+}
+
+// add returns true if the row should be passed on now. With DUPLICATES_KEEP_LAST rows are held back until replay.
+func (d *deduper) add(row []string) (bool, error) {
+	key, hash := tupleKey(row), rowHash(row)
+	digest := digestOf(key)
+
+	rows, seen := d.seen[digest]
+	if !seen {
+		rows = &tupleRows{}
+		d.seen[digest] = rows
+	}
+	switch {
+	case rows.contains(hash):
+		d.report.DuplicateRows++
+	case seen:
+		d.report.ConflictingRows++
+		if d.policy == DUPLICATES_FAIL {
+			return false, &ConflictingRowsError{Dimensions: strings.Replace(key, tupleSeparator, ",", -1)}
+		}
+		rows.hashes = append(rows.hashes, hash)
+	default:
+		rows.hashes = append(rows.hashes, hash)
+	}
+	latest := rows.latest
+	rows.latest = hash
+
+	if d.policy != DUPLICATES_KEEP_LAST {
+		return !seen, nil
+	}
+	// A duplicate of an earlier row is held again, so it is kept if it is the last row of its tuple.
+	if seen && latest == hash {
+		return false, nil
+	}
+	return false, d.hold(digest, row)
+}
+
+func (d *deduper) hold(digest tupleDigest, row []string) error {
+	if d.spool == nil {
+		spool, err := ioutil.TempFile(d.tempDir, "csv_filter_dedupe_")
+		if err != nil {
+			return err
+		}
+		d.spool, d.spoolCSV, d.lastIndex = spool, csv.NewWriter(spool), make(map[tupleDigest]int)
+	}
+	if err := d.spoolCSV.Write(row); err != nil {
+		return err
+	}
+	d.lastIndex[digest] = d.spoolCount
+	d.spoolCount++
+	return nil
+}
+
+// replay calls emit with the last row held for each dimension tuple, in the order they were last seen.
+func (d *deduper) replay(emit func(row []string) (bool, error)) error {
+	if d.spool == nil {
+		return nil
+	}
+
+	d.spoolCSV.Flush()
+	if err := d.spoolCSV.Error(); err != nil {
+		return err
+	}
+	if _, err := d.spool.Seek(0, 0); err != nil {
+		return err
+	}
+
+	csvReader := csv.NewReader(d.spool)
+	csvReader.FieldsPerRecord = -1
+	for i := 0; ; i++ {
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.lastIndex[digestOf(tupleKey(row))] != i {
+			continue
+		}
+		if more, err := emit(row); err != nil || !more {
+			return err
+		}
+	}
+}
+
+func (d *deduper) cleanup() {
+	if d.spool != nil {
+		d.spool.Close()
+		os.Remove(d.spool.Name())
+		d.spool = nil
+	}
+}
+
+// tupleKey identifies a row by its dimension columns.
+func tupleKey(row []string) string {
+	return strings.Join(row[DIMENSION_START_INDEX:], tupleSeparator)
+}
+
+func digestOf(key string) tupleDigest {
+	var digest tupleDigest
+	sum := sha256.Sum256([]byte(key))
+	copy(digest[:], sum[:])
+	return digest
+}
+
+func rowHash(row []string) uint64 {
+	h := fnv.New64a()
+	for _, field := range row {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
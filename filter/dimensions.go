@@ -0,0 +1,39 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// NormaliseDimensions returns the dimensions as a canonical string, with dimension names and values sorted and
+// duplicate values removed, so that equivalent filters produce the same result.
+func NormaliseDimensions(dimensions map[string][]string) string {
+	names := make([]string, 0, len(dimensions))
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		values := make([]string, 0, len(dimensions[name]))
+		seen := make(map[string]bool)
+		for _, value := range dimensions[name] {
+			if !seen[value] {
+				seen[value] = true
+				values = append(values, value)
+			}
+		}
+		sort.Strings(values)
+		parts = append(parts, name+"="+strings.Join(values, tupleSeparator))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// DimensionsHash returns a short hash identifying the normalised dimensions.
+func DimensionsHash(dimensions map[string][]string) string {
+	sum := sha256.Sum256([]byte(NormaliseDimensions(dimensions)))
+	return hex.EncodeToString(sum[:])[:16]
+}
@@ -0,0 +1,29 @@
+package filter_test
+
+import (
+	"testing"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/filter"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDimensionsHash(t *testing.T) {
+
+	Convey("Given equivalent dimensions in a different order", t, func() {
+		first := map[string][]string{"NACE": {"CI_0008197", "CI_0000072"}, "Prodcom Elements": {"CI_0021513"}}
+		second := map[string][]string{"Prodcom Elements": {"CI_0021513"}, "NACE": {"CI_0000072", "CI_0008197", "CI_0000072"}}
+
+		Convey("Then the hashes should be equal", func() {
+			So(filter.DimensionsHash(first), ShouldEqual, filter.DimensionsHash(second))
+		})
+	})
+
+	Convey("Given different dimensions", t, func() {
+		first := map[string][]string{"NACE": {"CI_0000072"}}
+		second := map[string][]string{"NACE": {"CI_0008197"}}
+
+		Convey("Then the hashes should differ", func() {
+			So(filter.DimensionsHash(first), ShouldNotEqual, filter.DimensionsHash(second))
+		})
+	})
+}
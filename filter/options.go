@@ -0,0 +1,106 @@
+package filter
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+var invalidLimitErr = errors.New("Limit must not be negative.")
+var invalidOffsetErr = errors.New("Offset must not be negative.")
+var invalidSampleRateErr = errors.New("Sample rate must be greater than 0 and no more than 1.")
+var invalidSortKeyErr = errors.New("Sort keys must name a dimension.")
+var invalidDuplicatesErr = errors.New("Duplicates must be one of 'first', 'last' or 'fail'.")
+
+// Options controls which of the matching rows are written to the output.
+type Options struct {
+	// Limit the maximum number of matching rows to write. 0 means no limit.
+	Limit int
+	// Offset the number of matching rows to skip before writing.
+	Offset int
+	// Sample if set, only a sample of the matching rows is considered.
+	Sample *Sample
+	// Sort if set, the output rows are ordered by these dimensions. Limit and Offset then apply to the sorted rows.
+	// Filtering fails if a sort dimension is not in the input file.
+	Sort []SortKey
+	// TempDir the directory for temporary files used when sorting. Defaults to os.TempDir().
+	TempDir string
+	// SortChunkRows the number of rows sorted in memory before they are written to a temporary file.
+	SortChunkRows int
+	// Duplicates if set, rows with a duplicate dimension tuple are dropped. Conflicting values are resolved by keeping
+	// the first (DUPLICATES_KEEP_FIRST) or last (DUPLICATES_KEEP_LAST) row, or fail the job (DUPLICATES_FAIL).
+	Duplicates string
+}
+
+// Sample describes a random sample of matching rows. Providing a Seed makes the sample deterministic.
+type Sample struct {
+	Rate float64 `json:"rate"`
+	Seed *int64  `json:"seed,omitempty"`
+}
+
+// Validate checks the options are usable.
+func (o Options) Validate() error {
+	if o.Limit < 0 {
+		return invalidLimitErr
+	}
+	if o.Offset < 0 {
+		return invalidOffsetErr
+	}
+	if o.Sample != nil && (o.Sample.Rate <= 0 || o.Sample.Rate > 1) {
+		return invalidSampleRateErr
+	}
+	for _, key := range o.Sort {
+		if len(key.Dimension) == 0 {
+			return invalidSortKeyErr
+		}
+	}
+	switch o.Duplicates {
+	case "", DUPLICATES_KEEP_FIRST, DUPLICATES_KEEP_LAST, DUPLICATES_FAIL:
+	default:
+		return invalidDuplicatesErr
+	}
+	return nil
+}
+
+// selector applies the sample, offset and limit options to the stream of matching rows.
+type selector struct {
+	options  Options
+	random   *rand.Rand
+	skipped  int
+	selected int
+}
+
+func newSelector(options Options) *selector {
+	s := &selector{options: options}
+	if options.Sample != nil {
+		seed := time.Now().UnixNano()
+		if options.Sample.Seed != nil {
+			seed = *options.Sample.Seed
+		}
+		s.random = rand.New(rand.NewSource(seed))
+	}
+	return s
+}
+
+// sampled returns true if the next matching row is part of the sample.
+func (s *selector) sampled() bool {
+	return s.random == nil || s.random.Float64() < s.options.Sample.Rate
+}
+
+// paged returns true if the next sampled row falls within the offset and limit.
+func (s *selector) paged() bool {
+	if s.done() {
+		return false
+	}
+	if s.skipped < s.options.Offset {
+		s.skipped++
+		return false
+	}
+	s.selected++
+	return true
+}
+
+// done returns true once the limit has been satisfied and no more rows need to be read.
+func (s *selector) done() bool {
+	return s.options.Limit > 0 && s.selected >= s.options.Limit
+}
@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+)
+
+// pipeline filters rows into a single output, applying the dimensions and options of that output.
+type pipeline struct {
+	requestId          string
+	dimensions         map[string][]string
+	report             *Report
+	selector           *selector
+	sorter             *externalSorter
+	deduper            *deduper
+	csvWriter          *csv.Writer
+	dimensionLocations map[string]int
+	more               bool
+}
+
+func newPipeline(requestId string, w io.Writer, dimensions map[string][]string, options Options) *pipeline {
+	p := &pipeline{
+		requestId:  requestId,
+		dimensions: dimensions,
+		report:     NewReport(),
+		selector:   newSelector(options),
+		csvWriter:  csv.NewWriter(w),
+		more:       true,
+	}
+	if len(options.Sort) > 0 {
+		p.sorter = newExternalSorter(options.Sort, tempDir(options), options.SortChunkRows)
+	}
+	if len(options.Duplicates) > 0 {
+		p.deduper = newDeduper(options.Duplicates, p.report, tempDir(options))
+	}
+	return p
+}
+
+func (p *pipeline) header(row []string) {
+	writeLine(p.requestId, p.csvWriter, row)
+}
+
+// offer passes a well formed data row through the pipeline. Once offer has returned false the pipeline needs no more rows.
+func (p *pipeline) offer(row []string) (bool, error) {
+	if p.dimensionLocations == nil {
+		p.dimensionLocations = getDimensionLocations(row)
+	}
+	return p.matched(row, rejectedDimensions(row, p.dimensions, p.dimensionLocations))
+}
+
+// matched counts each dimension the row was rejected by, passing the row on only if it matched every dimension.
+func (p *pipeline) matched(row []string, rejected []string) (bool, error) {
+	for _, dim := range rejected {
+		p.report.rejected(dim)
+	}
+	if len(rejected) > 0 {
+		return true, nil
+	}
+
+	more, err := p.deduped(row)
+	p.more = more
+	return more, err
+}
+
+// finish writes any rows held back for deduplication or sorting and flushes the output. Sorting stops if ctx is done.
+func (p *pipeline) finish(ctx context.Context) error {
+	defer p.csvWriter.Flush()
+
+	if p.deduper != nil {
+		if err := p.deduper.replay(p.sorted); err != nil {
+			return err
+		}
+	}
+	if p.sorter != nil {
+		if err := p.sorter.merge(ctx, p.output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pipeline) cleanup() {
+	if p.sorter != nil {
+		p.sorter.cleanup()
+	}
+	if p.deduper != nil {
+		p.deduper.cleanup()
+	}
+}
+
+// Each stage passes a row on to the next, returning false once no more rows are needed.
+
+func (p *pipeline) deduped(row []string) (bool, error) {
+	if p.deduper != nil {
+		if pass, err := p.deduper.add(row); err != nil || !pass {
+			return true, err
+		}
+	}
+	return p.sorted(row)
+}
+
+func (p *pipeline) sorted(row []string) (bool, error) {
+	if !p.selector.sampled() {
+		return true, nil
+	}
+	if p.sorter != nil {
+		return true, p.sorter.add(row)
+	}
+	return p.output(row)
+}
+
+func (p *pipeline) output(row []string) (bool, error) {
+	if p.selector.paged() {
+		writeLine(p.requestId, p.csvWriter, row)
+		p.report.kept(row)
+	}
+	return !p.selector.done(), nil
+}
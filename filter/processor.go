@@ -1,22 +1,30 @@
 package filter
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
 	"io"
+	"os"
 	"strings"
 
+	"github.com/ONSdigital/dp-dd-csv-filter/tracing"
 	"github.com/ONSdigital/go-ns/log"
 	"time"
 )
 
 const (
 	DIMENSION_START_INDEX = 3
+	// LAYOUT_VERSION the layout of the csv files read and written: observation, data marking and observation type
+	// columns followed by hierarchy, name and value columns for each dimension.
+	LAYOUT_VERSION = "v3"
 )
 
-// CSVProcessor defines the CSVProcessor interface.
+// CSVProcessor defines the CSVProcessor interface. Processing stops with the context's error once the context is done.
 type CSVProcessor interface {
-	Process(requestId string, r io.Reader, w io.Writer, dimensions map[string][]string)
+	Process(ctx context.Context, requestId string, r io.Reader, w io.Writer, dimensions map[string][]string, options Options) (*Report, error)
+	ProcessBatch(ctx context.Context, requestId string, r io.Reader, outputs []Output) ([]*Report, error)
+	ProcessRanges(ctx context.Context, requestId string, input RangedInput, w io.Writer, dimensions map[string][]string, options Options) (*Report, error)
 }
 
 // Processor implementation of the CSVProcessor interface.
@@ -29,7 +37,7 @@ func NewCSVProcessor() *Processor {
 
 func getDimensionLocations(row []string) map[string]int {
 	result := make(map[string]int)
-	for i := DIMENSION_START_INDEX; i < len(row); i = i + 3 {
+	for i := DIMENSION_START_INDEX; i+2 < len(row); i = i + 3 {
 		dim := strings.TrimSpace(row[i+1])
 		result[dim] = i + 2 // value is next field after dim name
 	}
@@ -37,22 +45,70 @@ func getDimensionLocations(row []string) map[string]int {
 	return result
 }
 
-func (p *Processor) Process(requestId string, r io.Reader, w io.Writer, dimensions map[string][]string) {
-	lineCounter := 0
-	linesWritten := 0
+// Output a destination for filtered rows, with the dimensions and options used to select them.
+type Output struct {
+	Writer     io.Writer
+	Dimensions map[string][]string
+	Options    Options
+}
+
+// Process writes the header and every selected row matching the dimensions to w. Reading stops as soon as the
+// limit in options is satisfied, unless the output is sorted or the last of each duplicate is kept, in which case all
+// matching rows are read first.
+func (p *Processor) Process(ctx context.Context, requestId string, r io.Reader, w io.Writer, dimensions map[string][]string, options Options) (*Report, error) {
+	reports, err := p.ProcessBatch(ctx, requestId, r, []Output{{Writer: w, Dimensions: dimensions, Options: options}})
+	return reports[0], err
+}
+
+// ProcessBatch filters the input into every output in a single pass, returning a report for each output in the same
+// order. Reading stops once no output needs any more rows.
+func (p *Processor) ProcessBatch(ctx context.Context, requestId string, r io.Reader, outputs []Output) ([]*Report, error) {
+	span := tracing.Start(requestId, "Process", tracing.KIND_INTERNAL)
+	span.SetAttribute("outputs", len(outputs))
+	counter := &countingReader{Reader: r}
+
+	reports, err := p.processBatch(ctx, requestId, counter, outputs)
+	span.SetAttribute(tracing.BYTES, counter.bytes)
+	endSpan(span, reports, err)
+	return reports, err
+}
+
+func (p *Processor) processBatch(ctx context.Context, requestId string, r io.Reader, outputs []Output) ([]*Report, error) {
 	startTime := time.Now()
 	defer func() {
 		endTime := time.Now()
-		log.DebugC(requestId, fmt.Sprintf("Process, duration_ns: %d", endTime.Sub(startTime).Nanoseconds()), log.Data{})
+		log.DebugC(requestId, fmt.Sprintf("Process, duration_ns: %d", endTime.Sub(startTime).Nanoseconds()), log.Data{"outputs": len(outputs)})
 	}()
 
-	csvReader, csvWriter := csv.NewReader(r), csv.NewWriter(w)
-	defer csvWriter.Flush()
+	pipelines := make([]*pipeline, len(outputs))
+	reports := make([]*Report, len(outputs))
+	for i, output := range outputs {
+		pipelines[i] = newPipeline(requestId, output.Writer, output.Dimensions, output.Options)
+		reports[i] = pipelines[i].report
+		defer pipelines[i].cleanup()
+	}
 
-	dimensionLocations := make(map[string]int)
+	csvReader := csv.NewReader(r)
+	csvReader.FieldsPerRecord = -1
+
+	header, err := csvReader.Read()
+	if err != nil {
+		if err == io.EOF {
+			log.DebugC(requestId, "The input is empty, there is no header to process", nil)
+			return reports, finish(ctx, pipelines)
+		}
+		log.ErrorC(requestId, err, log.Data{"message": "Failed to read the header of the input"})
+		return reports, err
+	}
+	for _, pipeline := range pipelines {
+		pipeline.header(header)
+	}
 
 csvLoop:
-	for {
+	for n, more := 0, true; more; n++ {
+		if n%cancelCheckRows == 0 && ctx.Err() != nil {
+			return reports, ctx.Err()
+		}
 		row, err := csvReader.Read()
 		if err != nil {
 			if err == io.EOF {
@@ -60,25 +116,80 @@ csvLoop:
 				break csvLoop
 			} else {
 				fmt.Println("Error occurred and cannot process anymore entry", err.Error())
-				panic(err)
+				return reports, err
 			}
 		}
 
-		if lineCounter == 0 || len(dimensions) < 1 {
-			writeLine(requestId, csvWriter, row)
-			linesWritten++
-		} else {
-			if lineCounter == 1 {
-				dimensionLocations = getDimensionLocations(row)
+		malformed := len(row) != len(header) || len(row) < DIMENSION_START_INDEX
+		more = false
+		for _, pipeline := range pipelines {
+			if !pipeline.more {
+				continue
 			}
-			if allDimensionsMatch(row, dimensions, dimensionLocations) {
-				writeLine(requestId, csvWriter, row)
-				linesWritten++
+			pipeline.report.RowsScanned++
+			if malformed {
+				pipeline.report.MalformedRows++
+				more = true
+				continue
 			}
+			pipelineMore, err := pipeline.offer(row)
+			if err != nil {
+				return reports, err
+			}
+			more = more || pipelineMore
 		}
-		lineCounter++
 	}
-	log.DebugC(requestId, fmt.Sprintf("Finished processing csv file, filter result: %d of %d rows", linesWritten, lineCounter), nil)
+
+	if err := finish(ctx, pipelines); err != nil {
+		return reports, err
+	}
+	for i, report := range reports {
+		log.DebugC(requestId, fmt.Sprintf("Finished processing csv file, filter result: %d of %d rows", report.RowsKept, report.RowsScanned), log.Data{"output": i, "report": report})
+	}
+	return reports, nil
+}
+
+// endSpan records the rows scanned and kept by every output on the span, and ends it.
+func endSpan(span *tracing.Span, reports []*Report, err error) {
+	scanned, kept := 0, 0
+	for _, report := range reports {
+		if report != nil {
+			scanned += report.RowsScanned
+			kept += report.RowsKept
+		}
+	}
+	span.SetAttribute(tracing.ROWS_SCANNED, scanned)
+	span.SetAttribute(tracing.ROWS_KEPT, kept)
+	span.SetError(err)
+	span.End()
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	bytes int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func finish(ctx context.Context, pipelines []*pipeline) error {
+	for _, pipeline := range pipelines {
+		if err := pipeline.finish(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tempDir(options Options) string {
+	if len(options.TempDir) > 0 {
+		return options.TempDir
+	}
+	return os.TempDir()
 }
 
 func writeLine(requestId string, csvWriter *csv.Writer, row []string) {
@@ -88,17 +199,18 @@ func writeLine(requestId string, csvWriter *csv.Writer, row []string) {
 	}
 }
 
-func allDimensionsMatch(row []string, dimensions map[string][]string, dimensionLocations map[string]int) bool {
+// rejectedDimensions checks every requested dimension, returning each one the row does not match so that every
+// mismatch can be counted in the report.
+func rejectedDimensions(row []string, dimensions map[string][]string, dimensionLocations map[string]int) []string {
+	var rejected []string
 	for targetDim, targetValues := range dimensions {
 
-		dimLocation := dimensionLocations[targetDim]
-		actualValue := row[dimLocation]
-
-		if !singleDimensionMatches(actualValue, targetValues) {
-			return false
+		dimLocation, ok := dimensionLocations[targetDim]
+		if !ok || !singleDimensionMatches(row[dimLocation], targetValues) {
+			rejected = append(rejected, targetDim)
 		}
 	}
-	return true
+	return rejected
 }
 
 func singleDimensionMatches(actualValue string, targetValues []string) bool {
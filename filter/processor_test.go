@@ -2,8 +2,14 @@ package filter_test
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/ONSdigital/dp-dd-csv-filter/filter"
@@ -23,21 +29,242 @@ func TestProcessor(t *testing.T) {
 
 		Convey("When the processor is called with no dimensions to filter \n", func() {
 			dimensions := map[string][]string{}
-			Processor.Process("requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), dimensions)
+			Processor.Process(context.Background(), "requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), dimensions, filter.Options{})
 			So(countLinesInFile(outputFile.Name()) == 277, ShouldBeTrue)
 		})
 
 		Convey("When the processor is called with a single dimension to filter \n", func() {
 			dimensions := map[string][]string{"NACE": {"CI_0000072"}} // 08 - Other mining and quarrying
-			Processor.Process("requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), dimensions)
+			Processor.Process(context.Background(), "requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), dimensions, filter.Options{})
 			So(countLinesInFile(outputFile.Name()) == 10, ShouldBeTrue)
 
 		})
+		Convey("When the processor is called with a single dimension to filter, the report should describe the result \n", func() {
+			dimensions := map[string][]string{"NACE": {"CI_0000072"}} // 08 - Other mining and quarrying
+			report, _ := Processor.Process(context.Background(), "requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), dimensions, filter.Options{})
+			So(report.RowsScanned, ShouldEqual, 276)
+			So(report.RowsKept, ShouldEqual, 9)
+			So(report.RowsRejected["NACE"], ShouldEqual, 267)
+			So(report.MalformedRows, ShouldEqual, 0)
+			So(report.DistinctValues["NACE"], ShouldEqual, 1)
+			So(report.DistinctValues["Prodcom Elements"], ShouldEqual, 9)
+		})
+		Convey("When the processor is called with a limit and offset \n", func() {
+			dimensions := map[string][]string{"NACE": {"CI_0000072"}} // 08 - Other mining and quarrying
+			report, _ := Processor.Process(context.Background(), "requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), dimensions, filter.Options{Limit: 3, Offset: 2})
+			So(report.RowsKept, ShouldEqual, 3)
+			So(report.RowsScanned, ShouldEqual, 5)
+		})
+		Convey("When the processor is called with a seeded sample, the output should be repeatable \n", func() {
+			seed := int64(42)
+			options := filter.Options{Sample: &filter.Sample{Rate: 0.5, Seed: &seed}}
+			first, _ := Processor.Process(context.Background(), "requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), map[string][]string{}, options)
+			inputFile.Seek(0, 0)
+			second, _ := Processor.Process(context.Background(), "requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), map[string][]string{}, options)
+			So(first.RowsKept, ShouldBeGreaterThan, 0)
+			So(first.RowsKept, ShouldBeLessThan, 276)
+			So(second.RowsKept, ShouldEqual, first.RowsKept)
+		})
+		Convey("When the processor is called with a sort that spills to temporary files, the output should be ordered \n", func() {
+			var output bytes.Buffer
+			options := filter.Options{
+				Sort:          []filter.SortKey{{Dimension: "Prodcom Elements", Descending: true}, {Dimension: "NACE"}},
+				TempDir:       "../build",
+				SortChunkRows: 10,
+			}
+			report, _ := Processor.Process(context.Background(), "requestId", bufio.NewReader(inputFile), &output, map[string][]string{}, options)
+			So(report.RowsKept, ShouldEqual, 276)
+
+			rows, err := csv.NewReader(&output).ReadAll()
+			So(err, ShouldBeNil)
+			So(len(rows), ShouldEqual, 277)
+			for i := 2; i < len(rows); i++ {
+				previous, current := rows[i-1], rows[i]
+				So(previous[14] >= current[14], ShouldBeTrue)
+				if previous[14] == current[14] {
+					So(previous[11] <= current[11], ShouldBeTrue)
+				}
+			}
+		})
+		Convey("When the processor is called with a sort that spills more files than are merged at once, the output should be ordered \n", func() {
+			var output bytes.Buffer
+			sortDir, _ := ioutil.TempDir("", "sort")
+			defer os.RemoveAll(sortDir)
+			options := filter.Options{Sort: []filter.SortKey{{Dimension: "NACE"}}, TempDir: sortDir, SortChunkRows: 1}
+			report, err := Processor.Process(context.Background(), "requestId", bufio.NewReader(inputFile), &output, map[string][]string{}, options)
+			So(err, ShouldBeNil)
+			So(report.RowsKept, ShouldEqual, 276)
+
+			rows, err := csv.NewReader(&output).ReadAll()
+			So(err, ShouldBeNil)
+			So(len(rows), ShouldEqual, 277)
+			for i := 2; i < len(rows); i++ {
+				So(rows[i-1][11] <= rows[i][11], ShouldBeTrue)
+			}
+			left, _ := ioutil.ReadDir(sortDir)
+			So(len(left), ShouldEqual, 0)
+		})
+		Convey("When the processor is cancelled once the input has been read, the sort is stopped \n", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			options := filter.Options{Sort: []filter.SortKey{{Dimension: "NACE"}}, TempDir: "../build", SortChunkRows: 10}
+			_, err := Processor.Process(ctx, "requestId", &cancelAtEOF{reader: inputFile, cancel: cancel}, &bytes.Buffer{}, map[string][]string{}, options)
+			So(err == context.Canceled, ShouldBeTrue)
+		})
+		Convey("When the processor is called with a sort by a dimension that is not in the input, it fails \n", func() {
+			options := filter.Options{Sort: []filter.SortKey{{Dimension: "Region"}}, TempDir: "../build"}
+			_, err := Processor.Process(context.Background(), "requestId", bufio.NewReader(inputFile), &bytes.Buffer{}, map[string][]string{}, options)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Cannot sort by dimension 'Region' as it is not in the input file.")
+		})
+		Convey("When the processor is called to drop duplicates \n", func() {
+			input := strings.Join([]string{
+				"Observation,Data_Marking,Observation_Type_Value,Dimension_Hierarchy_1,Dimension_Name_1,Dimension_Value_1",
+				"1,,,time,Year,2014",
+				"1,,,time,Year,2014",
+				"2,,,time,Year,2015",
+				"3,,,time,Year,2015",
+				"4,,,time,Year,2016",
+			}, "\n")
+
+			Convey("Then exact duplicates are dropped and the first conflicting row is kept", func() {
+				var output bytes.Buffer
+				report, err := Processor.Process(context.Background(), "requestId", strings.NewReader(input), &output, map[string][]string{}, filter.Options{Duplicates: filter.DUPLICATES_KEEP_FIRST})
+				So(err, ShouldBeNil)
+				So(report.DuplicateRows, ShouldEqual, 1)
+				So(report.ConflictingRows, ShouldEqual, 1)
+				So(output.String(), ShouldContainSubstring, "2,,,time,Year,2015")
+				So(output.String(), ShouldNotContainSubstring, "3,,,time,Year,2015")
+				So(report.RowsKept, ShouldEqual, 3)
+			})
+			Convey("Then the last conflicting row is kept", func() {
+				var output bytes.Buffer
+				report, err := Processor.Process(context.Background(), "requestId", strings.NewReader(input), &output, map[string][]string{}, filter.Options{Duplicates: filter.DUPLICATES_KEEP_LAST, TempDir: "../build"})
+				So(err, ShouldBeNil)
+				So(output.String(), ShouldNotContainSubstring, "2,,,time,Year,2015")
+				So(output.String(), ShouldContainSubstring, "3,,,time,Year,2015")
+				So(report.RowsKept, ShouldEqual, 3)
+			})
+			Convey("Then the job fails on conflicting rows", func() {
+				_, err := Processor.Process(context.Background(), "requestId", strings.NewReader(input), &bytes.Buffer{}, map[string][]string{}, filter.Options{Duplicates: filter.DUPLICATES_FAIL})
+				So(err, ShouldHaveSameTypeAs, &filter.ConflictingRowsError{})
+			})
+		})
+		Convey("When the processor is called to drop duplicates of a conflicting row \n", func() {
+			input := strings.Join([]string{
+				"Observation,Data_Marking,Observation_Type_Value,Dimension_Hierarchy_1,Dimension_Name_1,Dimension_Value_1",
+				"1,,,time,Year,2014",
+				"2,,,time,Year,2014",
+				"2,,,time,Year,2014",
+				"1,,,time,Year,2014",
+			}, "\n")
+
+			Convey("Then a repeated conflicting row is counted as a duplicate and the first row is kept", func() {
+				var output bytes.Buffer
+				report, err := Processor.Process(context.Background(), "requestId", strings.NewReader(input), &output, map[string][]string{}, filter.Options{Duplicates: filter.DUPLICATES_KEEP_FIRST})
+				So(err, ShouldBeNil)
+				So(report.DuplicateRows, ShouldEqual, 2)
+				So(report.ConflictingRows, ShouldEqual, 1)
+				So(output.String(), ShouldContainSubstring, "1,,,time,Year,2014")
+				So(output.String(), ShouldNotContainSubstring, "2,,,time,Year,2014")
+			})
+			Convey("Then a repeated earlier row is kept when it is the last row", func() {
+				var output bytes.Buffer
+				report, err := Processor.Process(context.Background(), "requestId", strings.NewReader(input), &output, map[string][]string{}, filter.Options{Duplicates: filter.DUPLICATES_KEEP_LAST, TempDir: "../build"})
+				So(err, ShouldBeNil)
+				So(report.DuplicateRows, ShouldEqual, 2)
+				So(report.ConflictingRows, ShouldEqual, 1)
+				So(output.String(), ShouldContainSubstring, "1,,,time,Year,2014")
+				So(output.String(), ShouldNotContainSubstring, "2,,,time,Year,2014")
+				So(report.RowsKept, ShouldEqual, 1)
+			})
+		})
+		Convey("When the processor is called with a batch of outputs, each output is filtered in the same pass \n", func() {
+			var first, second bytes.Buffer
+			outputs := []filter.Output{
+				{Writer: &first, Dimensions: map[string][]string{"NACE": {"CI_0000072"}}},
+				{Writer: &second, Dimensions: map[string][]string{"Prodcom Elements": {"CI_0021513"}}, Options: filter.Options{Limit: 1}},
+			}
+			reports, err := Processor.ProcessBatch(context.Background(), "requestId", bufio.NewReader(inputFile), outputs)
+			So(err, ShouldBeNil)
+			So(len(reports), ShouldEqual, 2)
+			So(reports[0].RowsKept, ShouldEqual, 9)
+			So(reports[0].RowsScanned, ShouldEqual, 276)
+			So(reports[1].RowsKept, ShouldEqual, 1)
+			So(strings.Count(first.String(), "\n"), ShouldEqual, 10)
+			So(strings.Count(second.String(), "\n"), ShouldEqual, 2)
+		})
+		Convey("When the processor is called with byte ranges of the input, the result is the same as a single stream \n", func() {
+			content, _ := ioutil.ReadAll(inputFile)
+			input := filter.RangedInput{
+				Size:        int64(len(content)),
+				RangeSize:   1000,
+				Parallelism: 3,
+				Open: func(start int64, end int64) (io.ReadCloser, error) {
+					return ioutil.NopCloser(bytes.NewReader(content[start:end])), nil
+				},
+			}
+			dimensions := map[string][]string{"NACE": {"CI_0000072"}}
+
+			var streamed, ranged bytes.Buffer
+			streamReport, _ := Processor.Process(context.Background(), "requestId", bytes.NewReader(content), &streamed, dimensions, filter.Options{Offset: 2})
+			rangeReport, err := Processor.ProcessRanges(context.Background(), "requestId", input, &ranged, dimensions, filter.Options{Offset: 2})
+			So(err, ShouldBeNil)
+			So(ranged.String(), ShouldEqual, streamed.String())
+			So(rangeReport, ShouldResemble, streamReport)
+			So(rangeReport.RowsKept, ShouldEqual, 7)
+		})
+		Convey("When the processor is called with byte ranges of an input with quoted line breaks, the result is the same as a single stream \n", func() {
+			lines := []string{"\"Observation\nValue\",Data_Marking,Observation_Type_Value,Dimension_Hierarchy_1,Dimension_Name_1,Dimension_Value_1"}
+			for i := 0; i < 200; i++ {
+				marking := ""
+				if i%3 == 0 {
+					marking = "\"Provisional,\nsee \"\"notes\"\"\""
+				}
+				lines = append(lines, fmt.Sprintf("%d,%s,,time,Year,%d", i, marking, 2000+i%20))
+			}
+			content := []byte(strings.Join(lines, "\n") + "\n")
+			input := filter.RangedInput{
+				Size:        int64(len(content)),
+				RangeSize:   50,
+				Parallelism: 3,
+				Open: func(start int64, end int64) (io.ReadCloser, error) {
+					return ioutil.NopCloser(bytes.NewReader(content[start:end])), nil
+				},
+			}
+			dimensions := map[string][]string{"Year": {"2003", "2017"}}
+
+			var streamed, ranged bytes.Buffer
+			streamReport, _ := Processor.Process(context.Background(), "requestId", bytes.NewReader(content), &streamed, dimensions, filter.Options{})
+			rangeReport, err := Processor.ProcessRanges(context.Background(), "requestId", input, &ranged, dimensions, filter.Options{})
+			So(err, ShouldBeNil)
+			So(ranged.String(), ShouldEqual, streamed.String())
+			So(rangeReport, ShouldResemble, streamReport)
+			So(rangeReport.RowsKept, ShouldEqual, 20)
+			So(rangeReport.MalformedRows, ShouldEqual, 0)
+		})
+		Convey("When the processor is called with a context that is done, processing stops with the context's error \n", func() {
+			content, _ := ioutil.ReadAll(inputFile)
+			input := filter.RangedInput{
+				Size:      int64(len(content)),
+				RangeSize: 1000,
+				Open: func(start int64, end int64) (io.ReadCloser, error) {
+					return ioutil.NopCloser(bytes.NewReader(content[start:end])), nil
+				},
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			_, err := Processor.Process(ctx, "requestId", bytes.NewReader(content), &bytes.Buffer{}, map[string][]string{}, filter.Options{})
+			So(err == context.Canceled, ShouldBeTrue)
+			_, err = Processor.ProcessRanges(ctx, "requestId", input, &bytes.Buffer{}, map[string][]string{}, filter.Options{})
+			So(err == context.Canceled, ShouldBeTrue)
+		})
 		Convey("When the processor is called with 2 dimensions to filter \n", func() {
 			dimensions := map[string][]string{
 				"NACE":             {"CI_0000072"}, // 08 - Other mining and quarrying
 				"Prodcom Elements": {"CI_0021513"}} // Work done
-			Processor.Process("requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), dimensions)
+			Processor.Process(context.Background(), "requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), dimensions, filter.Options{})
 			So(countLinesInFile(outputFile.Name()) == 2, ShouldBeTrue)
 
 		})
@@ -45,7 +272,7 @@ func TestProcessor(t *testing.T) {
 			dimensions := map[string][]string{
 				"NACE":             {"CI_0000072", "CI_0008197"}, // "08 - Other mining and quarrying", "1012 - Processing and preserving of poultry meat"
 				"Prodcom Elements": {"CI_0021513", "CI_0021514"}} // "Work done", "Waste Products"
-			Processor.Process("requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), dimensions)
+			Processor.Process(context.Background(), "requestId", bufio.NewReader(inputFile), bufio.NewWriter(outputFile), dimensions, filter.Options{})
 			So(countLinesInFile(outputFile.Name()) == 5, ShouldBeTrue)
 
 		})
@@ -92,3 +319,17 @@ func createFileInBuildDir(fileName string, errorMsg string) *os.File {
 
 	return file
 }
+
+// cancelAtEOF a reader that cancels its context once the end of the input is reached.
+type cancelAtEOF struct {
+	reader io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancelAtEOF) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err == io.EOF {
+		r.cancel()
+	}
+	return n, err
+}
@@ -0,0 +1,349 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/tracing"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// DEFAULT_RANGE_SIZE the size in bytes of each range an input is split into when RangedInput.RangeSize is not set.
+const DEFAULT_RANGE_SIZE = 64 * 1024 * 1024
+
+// boundaryProbeSize the number of bytes read at a time when looking for the start of the next record.
+const boundaryProbeSize = 64 * 1024
+
+// cancelCheckRows the number of rows read before checking whether processing should stop.
+const cancelCheckRows = 1000
+
+// RangeOpener opens the bytes of the input from start up to, but not including, end.
+type RangeOpener func(start int64, end int64) (io.ReadCloser, error)
+
+// RangedInput an input that can be read in byte ranges, such as an S3 object.
+type RangedInput struct {
+	Size        int64
+	Open        RangeOpener
+	RangeSize   int64
+	Parallelism int
+}
+
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// rangeRow the result of matching one row of a range. Only matched rows are kept.
+type rangeRow struct {
+	row       []string
+	malformed bool
+	rejected  []string
+}
+
+type rangeResult struct {
+	rows []rangeRow
+	err  error
+	// unaligned whether the range ended within a quoted field, so the record it ends with runs on into the next range.
+	unaligned bool
+}
+
+// ProcessRanges filters the input as Process does, but splits it into byte ranges aligned to record boundaries and
+// matches the rows of several ranges concurrently. Matched rows are passed on in source order, so the output and
+// report are the same as Process. Ranges are split at line breaks, so if a range ends within a quoted field, the rest of
+// the input from the start of that range is filtered as a single stream instead.
+func (p *Processor) ProcessRanges(ctx context.Context, requestId string, input RangedInput, w io.Writer, dimensions map[string][]string, options Options) (*Report, error) {
+	span := tracing.Start(requestId, "ProcessRanges", tracing.KIND_INTERNAL)
+	span.SetAttribute(tracing.BYTES, input.Size)
+	span.SetAttribute("parallelism", input.Parallelism)
+
+	report, err := p.processRanges(ctx, requestId, input, w, dimensions, options)
+	endSpan(span, []*Report{report}, err)
+	return report, err
+}
+
+func (p *Processor) processRanges(ctx context.Context, requestId string, input RangedInput, w io.Writer, dimensions map[string][]string, options Options) (*Report, error) {
+	startTime := time.Now()
+	defer func() {
+		endTime := time.Now()
+		log.DebugC(requestId, fmt.Sprintf("ProcessRanges, duration_ns: %d", endTime.Sub(startTime).Nanoseconds()), log.Data{"size": input.Size, "parallelism": input.Parallelism})
+	}()
+
+	pipeline := newPipeline(requestId, w, dimensions, options)
+	defer pipeline.cleanup()
+
+	headerEnd, err := recordEnd(input.Open, 0, input.Size)
+	if err != nil {
+		return pipeline.report, err
+	}
+	if headerEnd == 0 {
+		return pipeline.report, pipeline.finish(ctx)
+	}
+	header, err := readHeader(input.Open, headerEnd)
+	if err != nil {
+		return pipeline.report, err
+	}
+	pipeline.header(header)
+
+	ranges, err := splitRanges(input, headerEnd)
+	if err != nil {
+		return pipeline.report, err
+	}
+	log.DebugC(requestId, "Filtering input in byte ranges", log.Data{"ranges": len(ranges), "size": input.Size})
+
+	results := make([]chan rangeResult, len(ranges))
+	for i := range results {
+		results[i] = make(chan rangeResult, 1)
+	}
+	parallelism := input.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	// A range holds a slot from when it starts until its rows are consumed, bounding the rows held in memory.
+	slots := make(chan struct{}, parallelism)
+	matchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		for i, r := range ranges {
+			select {
+			case slots <- struct{}{}:
+			case <-matchCtx.Done():
+				return
+			}
+			go func(i int, r byteRange) {
+				results[i] <- matchRange(matchCtx, input.Open, r, len(header), dimensions)
+			}(i, r)
+		}
+	}()
+
+	for i, r := range ranges {
+		var result rangeResult
+		select {
+		case result = <-results[i]:
+		case <-ctx.Done():
+			return pipeline.report, ctx.Err()
+		}
+		<-slots
+		if result.unaligned {
+			// The ranges after this one do not start at records, the rows before it were read correctly.
+			cancel()
+			log.DebugC(requestId, "A record of the input contains a quoted line break, filtering the rest of the input as a single stream", log.Data{"start": r.start})
+			if err := matchRest(ctx, input, r.start, len(header), dimensions, pipeline); err != nil {
+				return pipeline.report, err
+			}
+			break
+		}
+		if result.err != nil {
+			return pipeline.report, result.err
+		}
+		more, err := pipeline.consume(result.rows)
+		if err != nil {
+			return pipeline.report, err
+		}
+		if !more {
+			break
+		}
+	}
+
+	if err := pipeline.finish(ctx); err != nil {
+		return pipeline.report, err
+	}
+	log.DebugC(requestId, fmt.Sprintf("Finished processing csv file, filter result: %d of %d rows", pipeline.report.RowsKept, pipeline.report.RowsScanned), log.Data{"report": pipeline.report})
+	return pipeline.report, nil
+}
+
+// consume passes the rows of a range through the pipeline as offer would have, returning false once no more rows are needed.
+func (p *pipeline) consume(rows []rangeRow) (bool, error) {
+	for _, r := range rows {
+		p.report.RowsScanned++
+		if r.malformed {
+			p.report.MalformedRows++
+			continue
+		}
+		more, err := p.matched(r.row, r.rejected)
+		if err != nil || !more {
+			return more, err
+		}
+	}
+	return true, nil
+}
+
+// matchRange reads every row of the range, keeping those that match the dimensions. It stops early if ctx is done.
+func matchRange(ctx context.Context, open RangeOpener, r byteRange, headerLength int, dimensions map[string][]string) rangeResult {
+	reader, err := open(r.start, r.end)
+	if err != nil {
+		return rangeResult{err: err}
+	}
+	defer reader.Close()
+
+	var result rangeResult
+	quotes := &quoteCounter{reader: reader}
+	err = matchRows(ctx, quotes, headerLength, dimensions, func(row rangeRow) (bool, error) {
+		result.rows = append(result.rows, row)
+		return true, nil
+	})
+	if err != nil && err != ctx.Err() {
+		err = fmt.Errorf("Error reading bytes %d-%d of the input: %s", r.start, r.end, err.Error())
+	}
+	result.err = err
+	result.unaligned = quotes.count%2 == 1
+	return result
+}
+
+// matchRest reads the input from start, which must be the start of a record, to its end as a single stream, passing
+// each row through the pipeline.
+func matchRest(ctx context.Context, input RangedInput, start int64, headerLength int, dimensions map[string][]string, p *pipeline) error {
+	reader, err := input.Open(start, input.Size)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	return matchRows(ctx, reader, headerLength, dimensions, func(row rangeRow) (bool, error) {
+		return p.consume([]rangeRow{row})
+	})
+}
+
+// matchRows reads the rows of reader, passing emit the result of matching each against the dimensions, until emit
+// returns false. It stops early if ctx is done.
+func matchRows(ctx context.Context, reader io.Reader, headerLength int, dimensions map[string][]string, emit func(row rangeRow) (bool, error)) error {
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+
+	var dimensionLocations map[string]int
+	for n := 0; ; n++ {
+		if n%cancelCheckRows == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		row, err := csvReader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var result rangeRow
+		if len(row) != headerLength || len(row) < DIMENSION_START_INDEX {
+			result = rangeRow{malformed: true}
+		} else {
+			if dimensionLocations == nil {
+				dimensionLocations = getDimensionLocations(row)
+			}
+			if rejected := rejectedDimensions(row, dimensions, dimensionLocations); len(rejected) > 0 {
+				result = rangeRow{rejected: rejected}
+			} else {
+				result = rangeRow{row: row}
+			}
+		}
+		if more, err := emit(result); err != nil || !more {
+			return err
+		}
+	}
+}
+
+// quoteCounter counts the quotes read through it. Quotes within a quoted field are escaped by doubling them, so an
+// odd count read from the start of a record means reading stopped within a quoted field.
+type quoteCounter struct {
+	reader io.Reader
+	count  int
+}
+
+func (q *quoteCounter) Read(p []byte) (int, error) {
+	n, err := q.reader.Read(p)
+	q.count += bytes.Count(p[:n], []byte{'"'})
+	return n, err
+}
+
+// splitRanges splits the data rows after the header into ranges of roughly RangeSize bytes, each starting at a record.
+func splitRanges(input RangedInput, headerEnd int64) ([]byteRange, error) {
+	rangeSize := input.RangeSize
+	if rangeSize < 1 {
+		rangeSize = DEFAULT_RANGE_SIZE
+	}
+
+	var ranges []byteRange
+	for start := headerEnd; start < input.Size; {
+		end, err := recordStart(input.Open, start+rangeSize, input.Size)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, byteRange{start: start, end: end})
+		start = end
+	}
+	return ranges, nil
+}
+
+// recordStart returns the offset of the first line starting at or after pos, or size if there is none. A line starts
+// at the beginning of the input or after a line break. It is the start of a record unless the line break is within a
+// quoted field, which matchRange detects.
+func recordStart(open RangeOpener, pos int64, size int64) (int64, error) {
+	if pos <= 0 {
+		return 0, nil
+	}
+	for probe := pos - 1; probe < size; probe += boundaryProbeSize {
+		end := probe + boundaryProbeSize
+		if end > size {
+			end = size
+		}
+		reader, err := open(probe, end)
+		if err != nil {
+			return 0, err
+		}
+		b, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return 0, err
+		}
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			return probe + int64(i) + 1, nil
+		}
+	}
+	return size, nil
+}
+
+// recordEnd returns the offset just after the line break that ends the record starting at start, or size if there is
+// none. Line breaks within quoted fields do not end the record.
+func recordEnd(open RangeOpener, start int64, size int64) (int64, error) {
+	quoted := false
+	for probe := start; probe < size; probe += boundaryProbeSize {
+		end := probe + boundaryProbeSize
+		if end > size {
+			end = size
+		}
+		reader, err := open(probe, end)
+		if err != nil {
+			return 0, err
+		}
+		b, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return 0, err
+		}
+		for i, c := range b {
+			switch {
+			case c == '"':
+				quoted = !quoted
+			case c == '\n' && !quoted:
+				return probe + int64(i) + 1, nil
+			}
+		}
+	}
+	return size, nil
+}
+
+func readHeader(open RangeOpener, headerEnd int64) ([]string, error) {
+	reader, err := open(0, headerEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return csv.NewReader(reader).Read()
+}
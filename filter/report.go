@@ -0,0 +1,63 @@
+package filter
+
+import "strings"
+
+const (
+	OBSERVATION_INDEX  = 0
+	DATA_MARKING_INDEX = 1
+)
+
+// Report holds row statistics and data-quality information gathered while filtering a csv file.
+type Report struct {
+	RowsScanned       int            `json:"rowsScanned"`
+	RowsKept          int            `json:"rowsKept"`
+	RowsRejected      map[string]int `json:"rowsRejected"`
+	MalformedRows     int            `json:"malformedRows"`
+	DuplicateRows     int            `json:"duplicateRows"`
+	ConflictingRows   int            `json:"conflictingRows"`
+	BlankObservations int            `json:"blankObservations"`
+	DataMarkings      map[string]int `json:"dataMarkings"`
+	DistinctValues    map[string]int `json:"distinctValues"`
+
+	distinct map[string]map[string]struct{}
+}
+
+// NewReport create a new, empty Report.
+func NewReport() *Report {
+	return &Report{
+		RowsRejected:   make(map[string]int),
+		DataMarkings:   make(map[string]int),
+		DistinctValues: make(map[string]int),
+		distinct:       make(map[string]map[string]struct{}),
+	}
+}
+
+// rejected records that a row was rejected because it did not match the given dimension.
+func (r *Report) rejected(dimension string) {
+	r.RowsRejected[dimension]++
+}
+
+// kept records the statistics for a data row written to the output.
+func (r *Report) kept(row []string) {
+	r.RowsKept++
+
+	if len(strings.TrimSpace(row[OBSERVATION_INDEX])) == 0 {
+		r.BlankObservations++
+	}
+	if marking := strings.TrimSpace(row[DATA_MARKING_INDEX]); len(marking) > 0 {
+		r.DataMarkings[marking]++
+	}
+
+	for i := DIMENSION_START_INDEX; i+2 < len(row); i = i + 3 {
+		dim := strings.TrimSpace(row[i+1])
+		values, ok := r.distinct[dim]
+		if !ok {
+			values = make(map[string]struct{})
+			r.distinct[dim] = values
+		}
+		if _, seen := values[row[i+2]]; !seen {
+			values[row[i+2]] = struct{}{}
+			r.DistinctValues[dim]++
+		}
+	}
+}
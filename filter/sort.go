@@ -0,0 +1,279 @@
+package filter
+
+import (
+	"container/heap"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+const defaultSortChunkRows = 100000
+
+// maxMergeFiles the most sorted chunk files merged at once. More files are merged in several passes, so the number of
+// files open at once is bounded however large the input is.
+const maxMergeFiles = 64
+
+// SortKey a dimension to order the filtered output by.
+type SortKey struct {
+	Dimension  string `json:"dimension"`
+	Descending bool   `json:"descending,omitempty"`
+}
+
+// externalSorter sorts rows that may not fit in memory by writing sorted chunks to temporary files and merging them.
+type externalSorter struct {
+	keys      []SortKey
+	locations []int
+	tempDir   string
+	chunkRows int
+	chunk     [][]string
+	files     []string
+}
+
+func newExternalSorter(keys []SortKey, tempDir string, chunkRows int) *externalSorter {
+	if chunkRows < 1 {
+		chunkRows = defaultSortChunkRows
+	}
+	return &externalSorter{keys: keys, tempDir: tempDir, chunkRows: chunkRows}
+}
+
+// add buffers a row, spilling the buffer to a temporary file once it is full. The location of each sort dimension
+// is taken from the first row added, as the dimensions of the input are named in its rows rather than its header. An
+// error is returned if a sort dimension is not one of them.
+func (s *externalSorter) add(row []string) error {
+	if s.locations == nil {
+		dimensionLocations := getDimensionLocations(row)
+		locations := make([]int, len(s.keys))
+		for i, key := range s.keys {
+			location, ok := dimensionLocations[key.Dimension]
+			if !ok {
+				return fmt.Errorf("Cannot sort by dimension '%s' as it is not in the input file.", key.Dimension)
+			}
+			locations[i] = location
+		}
+		s.locations = locations
+	}
+	s.chunk = append(s.chunk, row)
+	if len(s.chunk) >= s.chunkRows {
+		return s.spill()
+	}
+	return nil
+}
+
+// merge calls emit with each row in sorted order until there are no rows left or emit returns false. It stops with
+// the error of ctx once ctx is done. Temporary files are removed before merge returns.
+func (s *externalSorter) merge(ctx context.Context, emit func(row []string) (bool, error)) error {
+	defer s.cleanup()
+
+	if len(s.files) == 0 {
+		sort.Stable(rows{s.chunk, s.less})
+		for n, row := range s.chunk {
+			if n%cancelCheckRows == 0 && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if more, err := emit(row); err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(s.chunk) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+	for len(s.files) > maxMergeFiles {
+		if err := s.mergePass(ctx); err != nil {
+			return err
+		}
+	}
+	return s.mergeFiles(ctx, s.files, emit)
+}
+
+// mergePass merges each run of up to maxMergeFiles chunk files into a single file. Runs are merged in order, so the
+// merge stays stable.
+func (s *externalSorter) mergePass(ctx context.Context) error {
+	var merged []string
+	for start := 0; start < len(s.files); start += maxMergeFiles {
+		end := start + maxMergeFiles
+		if end > len(s.files) {
+			end = len(s.files)
+		}
+
+		file, err := ioutil.TempFile(s.tempDir, "csv_filter_sort_")
+		if err != nil {
+			s.files = append(merged, s.files[start:]...)
+			return err
+		}
+		merged = append(merged, file.Name())
+
+		csvWriter := csv.NewWriter(file)
+		err = s.mergeFiles(ctx, s.files[start:end], func(row []string) (bool, error) {
+			return true, csvWriter.Write(row)
+		})
+		csvWriter.Flush()
+		if err == nil {
+			err = csvWriter.Error()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		for _, name := range s.files[start:end] {
+			os.Remove(name)
+		}
+		if err != nil {
+			s.files = append(merged, s.files[end:]...)
+			return err
+		}
+	}
+	s.files = merged
+	return nil
+}
+
+// mergeFiles calls emit with each row of the sorted chunk files in sorted order, until there are no rows left or emit
+// returns false.
+func (s *externalSorter) mergeFiles(ctx context.Context, names []string, emit func(row []string) (bool, error)) error {
+	h := &mergeHeap{less: s.less}
+	for i, name := range names {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		source := &mergeSource{index: i, reader: csv.NewReader(file)}
+		source.reader.FieldsPerRecord = -1
+		if ok, err := source.next(); err != nil {
+			return err
+		} else if ok {
+			h.sources = append(h.sources, source)
+		}
+	}
+	heap.Init(h)
+
+	for n := 0; h.Len() > 0; n++ {
+		if n%cancelCheckRows == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		source := h.sources[0]
+		if more, err := emit(source.row); err != nil || !more {
+			return err
+		}
+		ok, err := source.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+func (s *externalSorter) spill() error {
+	sort.Stable(rows{s.chunk, s.less})
+
+	file, err := ioutil.TempFile(s.tempDir, "csv_filter_sort_")
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, file.Name())
+
+	csvWriter := csv.NewWriter(file)
+	csvWriter.WriteAll(s.chunk)
+	if err := csvWriter.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	s.chunk = nil
+	return file.Close()
+}
+
+func (s *externalSorter) cleanup() {
+	for _, name := range s.files {
+		os.Remove(name)
+	}
+	s.files = nil
+	s.chunk = nil
+}
+
+func (s *externalSorter) less(a, b []string) bool {
+	for i, key := range s.keys {
+		av, bv := valueAt(a, s.locations[i]), valueAt(b, s.locations[i])
+		if av == bv {
+			continue
+		}
+		if key.Descending {
+			return av > bv
+		}
+		return av < bv
+	}
+	return false
+}
+
+func valueAt(row []string, location int) string {
+	if location >= len(row) {
+		return ""
+	}
+	return row[location]
+}
+
+// rows implements sort.Interface for a chunk of csv rows.
+type rows struct {
+	rows [][]string
+	less func(a, b []string) bool
+}
+
+func (r rows) Len() int           { return len(r.rows) }
+func (r rows) Swap(i, j int)      { r.rows[i], r.rows[j] = r.rows[j], r.rows[i] }
+func (r rows) Less(i, j int) bool { return r.less(r.rows[i], r.rows[j]) }
+
+// mergeSource the current row of a sorted chunk file.
+type mergeSource struct {
+	index  int
+	reader *csv.Reader
+	row    []string
+}
+
+func (m *mergeSource) next() (bool, error) {
+	row, err := m.reader.Read()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	m.row = row
+	return true, nil
+}
+
+// mergeHeap orders chunk sources by their current row, falling back to chunk order so the merge is stable.
+type mergeHeap struct {
+	sources []*mergeSource
+	less    func(a, b []string) bool
+}
+
+func (h *mergeHeap) Len() int      { return len(h.sources) }
+func (h *mergeHeap) Swap(i, j int) { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.sources[i], h.sources[j]
+	if h.less(a.row, b.row) {
+		return true
+	}
+	if h.less(b.row, a.row) {
+		return false
+	}
+	return a.index < b.index
+}
+func (h *mergeHeap) Push(x interface{}) { h.sources = append(h.sources, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	last := h.sources[len(h.sources)-1]
+	h.sources = h.sources[:len(h.sources)-1]
+	return last
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/filter"
+	"github.com/ONSdigital/dp-dd-csv-filter/message/event"
+	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// cachedFileFormat the format of filtered files, part of the cache key so other formats are cached separately.
+const cachedFileFormat = event.FORMAT_CSV
+
+// getCacheS3Url returns the location of the cached result for the request. The result is not cacheable if caching
+// is disabled, the input version cannot be determined or the output is a random sample.
+func (s *FilterService) getCacheS3Url(requestID string, inputUrl ons_aws.S3URL, info *ons_aws.FileInfo, dimensions map[string][]string, options filter.Options) (ons_aws.S3URL, bool) {
+	if len(s.resultCacheUrl) == 0 || (options.Sample != nil && options.Sample.Seed == nil) {
+		return ons_aws.NilS3URL, false
+	}
+
+	if len(info.ETag) == 0 {
+		log.DebugC(requestID, "Unable to determine input version, result will not be cached", log.Data{"inputUrl": inputUrl.String()})
+		return ons_aws.NilS3URL, false
+	}
+
+	cacheUrlString := s.resultCacheUrl
+	if !strings.HasPrefix(cacheUrlString, "s3://") {
+		cacheUrlString = "s3://" + cacheUrlString
+	}
+	if !strings.HasSuffix(cacheUrlString, "/") {
+		cacheUrlString = cacheUrlString + "/"
+	}
+	cacheUrl, err := ons_aws.NewS3URL(cacheUrlString + cacheKey(info, inputUrl, dimensions, options) + csvFileExt)
+	if err != nil {
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to get result cache s3 url"})
+		return ons_aws.NilS3URL, false
+	}
+	return cacheUrl, true
+}
+
+// cacheKey identifies a filtered result by the version of the input, the normalised filter and the output format.
+func cacheKey(info *ons_aws.FileInfo, inputUrl ons_aws.S3URL, dimensions map[string][]string, options filter.Options) string {
+	selection, _ := json.Marshal(map[string]interface{}{
+		"limit":      options.Limit,
+		"offset":     options.Offset,
+		"sample":     options.Sample,
+		"sort":       options.Sort,
+		"duplicates": options.Duplicates,
+	})
+
+	sum := sha256.New()
+	fmt.Fprintf(sum, "input=%s\netag=%s\nversion=%s\nformat=%s\nselection=%s\ndimensions=%s",
+		inputUrl.String(), info.ETag, info.VersionID, cachedFileFormat, selection, filter.NormaliseDimensions(dimensions))
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// copyFromCache copies a cached result and its report to the filter url, returning the report and checksum if the
+// result was cached. Results cached without a checksum are treated as a miss, so they are filtered and cached again.
+func (s *FilterService) copyFromCache(ctx context.Context, requestID string, cacheUrl ons_aws.S3URL, filterUrl ons_aws.S3URL, upload *ons_aws.UploadOptions) (*filter.Report, *event.Checksum, bool) {
+	checksum, ok := s.getCachedChecksum(ctx, requestID, cacheUrl)
+	if !ok {
+		log.DebugC(requestID, "Result cache miss", log.Data{"cacheUrl": cacheUrl.String()})
+		return nil, nil, false
+	}
+
+	// The copy replaces the metadata of the cached file, so its checksum and row count are copied explicitly.
+	metadata := map[string]string{
+		ons_aws.ChecksumMetadataKey: checksum.SHA256,
+		rowCountMetadataKey:         strconv.Itoa(checksum.RowCount),
+	}
+	if err := s.awsService.CopyFile(ctx, requestID, cacheUrl, filterUrl, withMetadata(upload, metadata)); err != nil {
+		log.DebugC(requestID, "Result cache miss", log.Data{"cacheUrl": cacheUrl.String()})
+		return nil, nil, false
+	}
+	log.DebugC(requestID, "Result cache hit", log.Data{"cacheUrl": cacheUrl.String(), "filterUrl": filterUrl.String()})
+
+	cacheReportUrl, err := getReportS3Url(cacheUrl)
+	if err != nil {
+		return nil, checksum, true
+	}
+	reportUrl, err := getReportS3Url(filterUrl)
+	if err != nil {
+		return nil, checksum, true
+	}
+	if err := s.awsService.CopyFile(ctx, requestID, cacheReportUrl, reportUrl, upload); err != nil {
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to copy cached filter report", "cacheReportUrl": cacheReportUrl.String()})
+		return nil, checksum, true
+	}
+
+	// GetCSV returns the body of any file, so is also used to read the cached report.
+	reader, err := s.awsService.GetCSV(ctx, requestID, cacheReportUrl)
+	if err != nil {
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to read cached filter report", "cacheReportUrl": cacheReportUrl.String()})
+		return nil, checksum, true
+	}
+	defer reader.Close()
+
+	var report filter.Report
+	if err := json.NewDecoder(reader).Decode(&report); err != nil {
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to decode cached filter report", "cacheReportUrl": cacheReportUrl.String()})
+		return nil, checksum, true
+	}
+	return &report, checksum, true
+}
+
+// getCachedChecksum reads the checksum, size and row count of a cached result from its metadata.
+func (s *FilterService) getCachedChecksum(ctx context.Context, requestID string, cacheUrl ons_aws.S3URL) (*event.Checksum, bool) {
+	info, err := s.awsService.HeadFile(ctx, requestID, cacheUrl)
+	if err != nil {
+		return nil, false
+	}
+	sha256Sum := ons_aws.MetadataValue(info.Metadata, ons_aws.ChecksumMetadataKey)
+	rowCount, err := strconv.Atoi(ons_aws.MetadataValue(info.Metadata, rowCountMetadataKey))
+	if len(sha256Sum) == 0 || err != nil {
+		log.DebugC(requestID, "Cached result has no checksum", log.Data{"cacheUrl": cacheUrl.String()})
+		return nil, false
+	}
+	return &event.Checksum{SHA256: sha256Sum, Size: info.Size, RowCount: rowCount}, true
+}
+
+// saveToCache copies a filtered result and its report into the cache so that later identical requests can reuse it.
+func (s *FilterService) saveToCache(ctx context.Context, requestID string, filterUrl ons_aws.S3URL, cacheUrl ons_aws.S3URL) {
+	if err := s.awsService.CopyFile(ctx, requestID, filterUrl, cacheUrl, nil); err != nil {
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to save result to cache", "cacheUrl": cacheUrl.String()})
+		return
+	}
+
+	reportUrl, err := getReportS3Url(filterUrl)
+	if err != nil {
+		return
+	}
+	cacheReportUrl, err := getReportS3Url(cacheUrl)
+	if err != nil {
+		return
+	}
+	if err := s.awsService.CopyFile(ctx, requestID, reportUrl, cacheReportUrl, nil); err != nil {
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to save filter report to cache", "cacheReportUrl": cacheReportUrl.String()})
+	}
+}
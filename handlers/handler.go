@@ -2,12 +2,15 @@ package handlers
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"time"
@@ -15,15 +18,21 @@ import (
 	"fmt"
 	"strings"
 
-	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
 	"github.com/ONSdigital/dp-dd-csv-filter/config"
 	"github.com/ONSdigital/dp-dd-csv-filter/filter"
 	"github.com/ONSdigital/dp-dd-csv-filter/message/event"
+	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
+	"github.com/ONSdigital/dp-dd-csv-filter/outbox"
+	"github.com/ONSdigital/dp-dd-csv-filter/tracing"
 	"github.com/ONSdigital/go-ns/log"
-	"github.com/Shopify/sarama"
 )
 
 const csvFileExt = ".csv"
+const reportFileSuffix = ".report.json"
+
+// rowCountMetadataKey the metadata of a filtered file holding the number of data rows it contains.
+const rowCountMetadataKey = "row-count"
+const tempDir = "/var/tmp"
 
 type requestBodyReader func(r io.Reader) ([]byte, error)
 
@@ -32,14 +41,15 @@ type FilterResponse struct {
 	Message string `json:"message,omitempty"`
 }
 
-// FilterFunc defines a function (implemented by HandleRequest) that performs the filtering requested in a FilterRequest
-type FilterFunc func(event.FilterRequest) FilterResponse
+// FilterFunc defines a function (implemented by FilterService.HandleRequest) that performs the filtering requested in a FilterRequest
+type FilterFunc func(context.Context, event.FilterRequest) FilterResponse
+
+// BatchFilterFunc defines a function (implemented by FilterService.HandleBatchRequest) that performs the filtering requested in a BatchFilterRequest
+type BatchFilterFunc func(context.Context, event.BatchFilterRequest) FilterResponse
 
 var unsupportedFileTypeErr = errors.New("Unspported file type.")
 var awsClientErr = errors.New("Error while attempting get to get from from AWS s3 bucket.")
-var awsService = ons_aws.NewService()
-var csvProcessor filter.CSVProcessor = filter.NewCSVProcessor()
-var readFilterRequestBody requestBodyReader = ioutil.ReadAll
+var duplicateFilterUrlErr = errors.New("Two or more outputs would be written to the same filter s3 url.")
 
 // Responses
 var filterRespReadReqBodyErr = FilterResponse{"Error when attempting to read request body."}
@@ -47,29 +57,135 @@ var filterRespUnmarshalBody = FilterResponse{"Error when attempting to unmarshal
 var filterRespUnsupportedFileType = FilterResponse{"Unspported file type. Please specify a filePath for a .csv file."}
 var filterResponseSuccess = FilterResponse{"Your request is being processed."}
 
-var producer sarama.SyncProducer
-var outputS3Bucket = config.OutputS3Bucket
-var transformTopic = config.KafkaTransformTopic
+// FilterService filters csv files in S3 and requests the filtered files are transformed. It holds its dependencies
+// and configuration, so several differently configured services may be used at once.
+type FilterService struct {
+	awsService            ons_aws.AWSService
+	csvProcessor          filter.CSVProcessor
+	outbox                *outbox.Outbox
+	schemaRegistry        event.SchemaRegistry
+	readRequestBody       requestBodyReader
+	outputS3Bucket        string
+	outputKeyTemplate     string
+	transformTopic        string
+	filterParallelism     int
+	filterRangeSize       int64
+	downloadTimeout       time.Duration
+	filterTimeout         time.Duration
+	uploadTimeout         time.Duration
+	messageEnvelope       bool
+	resultCacheUrl        string
+	inputMaxSize          int64
+	inputContentTypes     []string
+	inputContentEncodings []string
+}
+
+// NewFilterService create a FilterService reading and writing files with the AWS service, filtering them with the
+// processor and sending transform requests through the outbox.
+func NewFilterService(cfg *config.Config, awsService ons_aws.AWSService, csvProcessor filter.CSVProcessor, transformOutbox *outbox.Outbox) *FilterService {
+	return &FilterService{
+		awsService:            awsService,
+		csvProcessor:          csvProcessor,
+		outbox:                transformOutbox,
+		schemaRegistry:        event.NewSchemaRegistry(cfg.SchemaRegistryDir),
+		readRequestBody:       ioutil.ReadAll,
+		outputS3Bucket:        cfg.OutputS3Bucket,
+		outputKeyTemplate:     cfg.OutputKeyTemplate,
+		transformTopic:        cfg.KafkaTransformTopic,
+		filterParallelism:     cfg.FilterParallelism,
+		filterRangeSize:       cfg.FilterRangeSize,
+		downloadTimeout:       cfg.DownloadTimeout,
+		filterTimeout:         cfg.FilterTimeout,
+		uploadTimeout:         cfg.UploadTimeout,
+		messageEnvelope:       cfg.MessageEnvelope,
+		resultCacheUrl:        cfg.ResultCacheURL,
+		inputMaxSize:          cfg.InputMaxSize,
+		inputContentTypes:     cfg.InputContentTypes,
+		inputContentEncodings: cfg.InputContentEncodings,
+	}
+}
 
 // Handle CSV filter handler. Get the requested file from AWS S3, filter it to a temporary file, upload the temporary file to the filter bucket, send a message to request the file is transformed..
-func Handle(w http.ResponseWriter, req *http.Request) {
-	bytes, err := readFilterRequestBody(req.Body)
+// The request is cancelled once its context is done, which Requests arranges for when the client disconnects.
+func (s *FilterService) Handle(w http.ResponseWriter, req *http.Request) {
+	var filterRequest event.FilterRequest
+	if !s.readRequest(w, req, &filterRequest) {
+		return
+	}
+	filterRequest.RequestID, filterRequest.Trace = correlate(w, req, filterRequest.RequestID, filterRequest.Trace)
+
+	span := startHTTPSpan(req, filterRequest.RequestID, filterRequest.Trace)
+	defer span.End()
+	writeFilterResponse(w, endHTTPSpan(span, s.HandleRequest(req.Context(), filterRequest)))
+}
+
+// HandleBatch CSV batch filter handler. As Handle, but filters the requested file into many outputs in a single pass.
+func (s *FilterService) HandleBatch(w http.ResponseWriter, req *http.Request) {
+	var batchRequest event.BatchFilterRequest
+	if !s.readRequest(w, req, &batchRequest) {
+		return
+	}
+	batchRequest.RequestID, batchRequest.Trace = correlate(w, req, batchRequest.RequestID, batchRequest.Trace)
+
+	span := startHTTPSpan(req, batchRequest.RequestID, batchRequest.Trace)
+	defer span.End()
+	writeFilterResponse(w, endHTTPSpan(span, s.HandleBatchRequest(req.Context(), batchRequest)))
+}
+
+func (s *FilterService) readRequest(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	bytes, err := s.readRequestBody(req.Body)
 	defer req.Body.Close()
 
 	if err != nil {
 		log.ErrorR(req, err, nil)
 		WriteResponse(w, filterRespReadReqBodyErr, http.StatusBadRequest)
-		return
+		return false
 	}
 
-	var filterRequest event.FilterRequest
-	if err := json.Unmarshal(bytes, &filterRequest); err != nil {
+	if err := json.Unmarshal(bytes, v); err != nil {
 		log.ErrorR(req, err, nil)
 		WriteResponse(w, filterRespUnmarshalBody, http.StatusBadRequest)
-		return
+		return false
+	}
+	return true
+}
+
+// correlate returns the request ID and trace context of an HTTP request, taken from the body or else the headers, and
+// writes them to the headers of the response.
+func correlate(w http.ResponseWriter, req *http.Request, requestID string, trace *event.TraceContext) (string, *event.TraceContext) {
+	if len(requestID) == 0 {
+		requestID = req.Header.Get(event.REQUEST_ID_HEADER)
+	}
+	if trace == nil {
+		trace = event.ParseTraceContext(req.Header.Get(event.TRACEPARENT_HEADER), req.Header.Get(event.TRACESTATE_HEADER))
+	}
+	requestID, trace = event.Correlate(requestID, trace)
+
+	w.Header().Set(event.REQUEST_ID_HEADER, requestID)
+	w.Header().Set(event.TRACEPARENT_HEADER, trace.TraceParent)
+	if len(trace.TraceState) > 0 {
+		w.Header().Set(event.TRACESTATE_HEADER, trace.TraceState)
+	}
+	return requestID, trace
+}
+
+// startHTTPSpan starts the span of an HTTP request, within which the request is handled.
+func startHTTPSpan(req *http.Request, requestID string, trace *event.TraceContext) *tracing.Span {
+	span := tracing.StartRequest(requestID, req.Method+" "+req.URL.Path, tracing.KIND_SERVER, trace.TraceParent)
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.target", req.URL.Path)
+	return span
+}
+
+// endHTTPSpan records the outcome of an HTTP request on its span, returning the response.
+func endHTTPSpan(span *tracing.Span, response FilterResponse) FilterResponse {
+	if response != filterResponseSuccess {
+		span.SetError(errors.New(response.Message))
 	}
+	return response
+}
 
-	response := HandleRequest(filterRequest)
+func writeFilterResponse(w http.ResponseWriter, response FilterResponse) {
 	status := http.StatusBadRequest
 	if response == filterResponseSuccess {
 		status = http.StatusOK
@@ -77,13 +193,20 @@ func Handle(w http.ResponseWriter, req *http.Request) {
 	WriteResponse(w, response, status)
 }
 
-// Performs the filtering as specified in the FilterRequest, returning a FilterResponse
-func HandleRequest(filterRequest event.FilterRequest) (resp FilterResponse) {
+// Performs the filtering as specified in the FilterRequest, returning a FilterResponse. Downloading, filtering and
+// uploading each stop once their configured timeout has passed, and all of them stop if ctx is cancelled.
+func (s *FilterService) HandleRequest(ctx context.Context, filterRequest event.FilterRequest) (resp FilterResponse) {
 
+	filterRequest.RequestID, filterRequest.Trace = event.Correlate(filterRequest.RequestID, filterRequest.Trace)
+	span := tracing.StartRequest(filterRequest.RequestID, "HandleRequest", tracing.KIND_INTERNAL, filterRequest.Trace.TraceParent)
+	span.SetAttribute(tracing.S3_BUCKET, filterRequest.InputURL.GetBucketName())
+	span.SetAttribute(tracing.S3_KEY, filterRequest.InputURL.GetFilePath())
 	startTime := time.Now()
 	defer func() {
+		endHTTPSpan(span, resp)
+		span.End()
 		endTime := time.Now()
-		log.DebugC(filterRequest.RequestID, fmt.Sprintf("Processed FilterRequest, duration_ns: %d", endTime.Sub(startTime).Nanoseconds()), log.Data{"start": startTime, "end": endTime})
+		log.DebugC(filterRequest.RequestID, fmt.Sprintf("Processed FilterRequest, duration_ns: %d", endTime.Sub(startTime).Nanoseconds()), log.Data{"start": startTime, "end": endTime, "traceId": filterRequest.Trace.TraceID()})
 	}()
 
 	if fileType := filepath.Ext(filterRequest.InputURL.GetFilePath()); fileType != csvFileExt {
@@ -91,19 +214,64 @@ func HandleRequest(filterRequest event.FilterRequest) (resp FilterResponse) {
 		return filterRespUnsupportedFileType
 	}
 
-	awsReadCloser, err := awsService.GetCSV(filterRequest.RequestID, filterRequest.InputURL)
-	defer awsReadCloser.Close()
+	filterOptions := filterRequest.FilterOptions()
+	filterOptions.TempDir = tempDir
+	if err := filterOptions.Validate(); err != nil {
+		log.ErrorC(filterRequest.RequestID, err, log.Data{"limit": filterRequest.Limit, "offset": filterRequest.Offset, "sample": filterRequest.Sample})
+		return FilterResponse{err.Error()}
+	}
+
+	if err := s.awsService.ValidateUploadOptions(filterRequest.Upload); err != nil {
+		log.ErrorC(filterRequest.RequestID, err, log.Data{"upload": filterRequest.Upload})
+		return FilterResponse{err.Error()}
+	}
+
+	filterUrl, err := s.getFilterS3Url(filterRequest.RequestID, filterRequest.InputURL, filterRequest.OutputURL, filterRequest.Dimensions)
 	if err != nil {
-		log.ErrorC(filterRequest.RequestID, awsClientErr, log.Data{"details": err.Error()})
+		log.ErrorC(filterRequest.RequestID, err, log.Data{"message": "Failed to get tmp output file for s3 uploading!"})
+		return FilterResponse{"Unable to obtain filter s3 url to send filtered file to: " + err.Error()}
+	}
+
+	inputUrl, err := filterRequest.Input()
+	if err != nil {
+		log.ErrorC(filterRequest.RequestID, err, log.Data{"inputUrl": filterRequest.InputURL.String(), "versionId": filterRequest.VersionID})
 		return FilterResponse{err.Error()}
 	}
+	checking := startPhase(ctx, "Download", s.downloadTimeout)
+	inputUrl, inputInfo, err := s.preflight(checking, filterRequest.RequestID, inputUrl)
+	if err != nil {
+		err = checking.stopped(err)
+		checking.cancel()
+		return FilterResponse{err.Error()}
+	}
+	checking.cancel()
+	source := &event.SourceFile{URL: filterRequest.InputURL, VersionID: inputInfo.VersionID, ETag: inputInfo.ETag}
+	upload := withSourceMetadata(filterRequest.Upload, source)
+	transform := event.NewTransformRequest(filterUrl, filterRequest.OutputURL, filterRequest.RequestID)
+	transform.Source = source
+	transform.Filter = event.NewFilter(filterRequest.Dimensions, filterOptions)
+	transform.Trace = filterRequest.Trace
+
+	cacheUrl, cacheable := s.getCacheS3Url(filterRequest.RequestID, inputUrl, inputInfo, filterRequest.Dimensions, filterOptions)
+	if cacheable {
+		uploading := startPhase(ctx, "Upload", s.uploadTimeout)
+		report, checksum, hit := s.copyFromCache(uploading, filterRequest.RequestID, cacheUrl, filterUrl, upload)
+		uploading.cancel()
+		if hit {
+			transform.Report, transform.Checksum = report, checksum
+			if err := s.sendTransformMessage(transform); err != nil {
+				return FilterResponse{err.Error()}
+			}
+			return filterResponseSuccess
+		}
+	}
 
-	outputFileLocation := "/var/tmp/csv_filter_" + strconv.Itoa(time.Now().Nanosecond()) + ".csv"
-	outputFile, err := os.Create(outputFileLocation)
+	outputFile, err := ioutil.TempFile(tempDir, "csv_filter_")
 	if err != nil {
-		log.ErrorC(filterRequest.RequestID, err, log.Data{"message": "Error creating temp output file in location " + outputFileLocation})
-		panic(err)
+		log.ErrorC(filterRequest.RequestID, err, log.Data{"message": "Error creating temp output file in location " + tempDir})
+		return FilterResponse{err.Error()}
 	}
+	outputFileLocation := outputFile.Name()
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -113,88 +281,376 @@ func HandleRequest(filterRequest event.FilterRequest) (resp FilterResponse) {
 		}
 	}()
 
-	csvProcessor.Process(filterRequest.RequestID, awsReadCloser, bufio.NewWriter(outputFile), filterRequest.Dimensions)
-
-	filterUrl, err := getFilterS3Url(filterRequest.OutputURL)
+	filtering := startPhase(ctx, "Filter", s.filterTimeout)
+	defer filtering.cancel()
+	outputWriter := bufio.NewWriter(outputFile)
+	report, err := s.filterInput(filtering, filterRequest.RequestID, inputUrl, inputInfo, outputWriter, filterRequest.Dimensions, filterOptions)
+	outputWriter.Flush()
+	outputFile.Close()
 	if err != nil {
-		log.ErrorC(filterRequest.RequestID, err, log.Data{"message": "Failed to get tmp output file for s3 uploading!"})
-		return FilterResponse{"Unable to obtain filter s3 url to send filtered file to: " + err.Error()}
+		err = filtering.stopped(err)
+		log.ErrorC(filterRequest.RequestID, err, log.Data{"message": "Failed to filter csv file", "report": report})
+		os.Remove(outputFileLocation)
+		return FilterResponse{err.Error()}
 	}
 
-	tmpFile, err := os.Open(outputFileLocation)
+	uploading := startPhase(ctx, "Upload", s.uploadTimeout)
+	defer uploading.cancel()
+	checksum, err := s.publish(uploading, filterRequest.RequestID, filterUrl, outputFileLocation, report, upload)
 	if err != nil {
-		log.ErrorC(filterRequest.RequestID, err, log.Data{"message": "Failed to get tmp output file for s3 uploading!"})
+		return FilterResponse{uploading.stopped(err).Error()}
 	}
 
-	awsService.SaveFile(filterRequest.RequestID, bufio.NewReader(tmpFile), filterUrl)
-
-	os.Remove(outputFileLocation)
+	transform.Report, transform.Checksum = report, checksum
+	if err := s.sendTransformMessage(transform); err != nil {
+		return FilterResponse{err.Error()}
+	}
 
-	sendTransformMessage(filterRequest, filterUrl)
+	if cacheable {
+		s.saveToCache(uploading, filterRequest.RequestID, filterUrl, cacheUrl)
+	}
 
 	return filterResponseSuccess
 }
 
-func getFilterS3Url(outputUrl ons_aws.S3URL) (ons_aws.S3URL, error) {
-	path := outputUrl.GetFilePath()
-	tokens := strings.Split(path, "/")
-	filename := tokens[len(tokens)-1]
-	filterUrlString := outputS3Bucket
-	if !strings.HasPrefix(filterUrlString, "s3://") {
-		filterUrlString = "s3://" + filterUrlString
+// withSourceMetadata returns a copy of the upload options that records the version of the source file in the
+// metadata of the uploaded file.
+func withSourceMetadata(upload *ons_aws.UploadOptions, source *event.SourceFile) *ons_aws.UploadOptions {
+	options := ons_aws.UploadOptions{}
+	if upload != nil {
+		options = *upload
 	}
-	if !strings.HasSuffix(filterUrlString, "/") {
-		filterUrlString = filterUrlString + "/"
+	options.Metadata = map[string]string{"source-url": source.URL.String()}
+	if len(source.VersionID) > 0 {
+		options.Metadata["source-version-id"] = source.VersionID
+	}
+	if len(source.ETag) > 0 {
+		options.Metadata["source-etag"] = source.ETag
+	}
+	return &options
+}
+
+// withMetadata returns a copy of the upload options with the metadata added.
+func withMetadata(upload *ons_aws.UploadOptions, metadata map[string]string) *ons_aws.UploadOptions {
+	options := ons_aws.UploadOptions{}
+	if upload != nil {
+		options = *upload
+	}
+	options.Metadata = make(map[string]string)
+	if upload != nil {
+		for key, value := range upload.Metadata {
+			options.Metadata[key] = value
+		}
+	}
+	for key, value := range metadata {
+		options.Metadata[key] = value
+	}
+	return &options
+}
+
+// filterInput filters the input file into w. When parallelism is configured, files larger than the range size are
+// split into byte ranges that are filtered concurrently. Progress through the file is logged as it is read. Each part
+// of the input is opened within the download timeout, then read and filtered within ctx.
+func (s *FilterService) filterInput(ctx context.Context, requestID string, inputUrl ons_aws.S3URL, info *ons_aws.FileInfo, w io.Writer, dimensions map[string][]string, options filter.Options) (*filter.Report, error) {
+	progress := newProgress(requestID, info.Size)
+	if s.filterParallelism > 1 && info.Size > s.filterRangeSize {
+		input := filter.RangedInput{
+			Size:        info.Size,
+			RangeSize:   s.filterRangeSize,
+			Parallelism: s.filterParallelism,
+			Open: func(start int64, end int64) (io.ReadCloser, error) {
+				reader, err := s.openInput(ctx, func(ctx context.Context) (io.ReadCloser, error) {
+					return s.awsService.GetRange(ctx, requestID, inputUrl, start, end)
+				})
+				if err != nil {
+					return nil, err
+				}
+				return progress.reader(reader), nil
+			},
+		}
+		return s.csvProcessor.ProcessRanges(ctx, requestID, input, w, dimensions, options)
+	}
+
+	awsReadCloser, err := s.openInput(ctx, func(ctx context.Context) (io.ReadCloser, error) {
+		return s.awsService.GetCSV(ctx, requestID, inputUrl)
+	})
+	if err != nil {
+		log.ErrorC(requestID, awsClientErr, log.Data{"details": err.Error()})
+		return nil, err
+	}
+	// Close the input as soon as the processor is finished with it, so a satisfied limit stops the download.
+	defer awsReadCloser.Close()
+
+	return s.csvProcessor.Process(ctx, requestID, progress.reader(awsReadCloser), w, dimensions, options)
+}
+
+// HandleBatchRequest performs the filtering for every output of the BatchFilterRequest in a single pass over the
+// input file, returning a FilterResponse. A transform request is sent for each output. Timeouts and cancellation
+// apply as for HandleRequest.
+func (s *FilterService) HandleBatchRequest(ctx context.Context, batchRequest event.BatchFilterRequest) (resp FilterResponse) {
+
+	batchRequest.RequestID, batchRequest.Trace = event.Correlate(batchRequest.RequestID, batchRequest.Trace)
+	span := tracing.StartRequest(batchRequest.RequestID, "HandleBatchRequest", tracing.KIND_INTERNAL, batchRequest.Trace.TraceParent)
+	span.SetAttribute(tracing.S3_BUCKET, batchRequest.InputURL.GetBucketName())
+	span.SetAttribute(tracing.S3_KEY, batchRequest.InputURL.GetFilePath())
+	span.SetAttribute("outputs", len(batchRequest.Outputs))
+	startTime := time.Now()
+	defer func() {
+		endHTTPSpan(span, resp)
+		span.End()
+		endTime := time.Now()
+		log.DebugC(batchRequest.RequestID, fmt.Sprintf("Processed BatchFilterRequest, duration_ns: %d", endTime.Sub(startTime).Nanoseconds()), log.Data{"start": startTime, "end": endTime, "outputs": len(batchRequest.Outputs), "traceId": batchRequest.Trace.TraceID()})
+	}()
+
+	if fileType := filepath.Ext(batchRequest.InputURL.GetFilePath()); fileType != csvFileExt {
+		log.ErrorC(batchRequest.RequestID, unsupportedFileTypeErr, log.Data{"expected": csvFileExt, "actual": fileType})
+		return filterRespUnsupportedFileType
+	}
+
+	if err := batchRequest.Validate(); err != nil {
+		log.ErrorC(batchRequest.RequestID, err, nil)
+		return FilterResponse{err.Error()}
+	}
+
+	if err := s.awsService.ValidateUploadOptions(batchRequest.Upload); err != nil {
+		log.ErrorC(batchRequest.RequestID, err, log.Data{"upload": batchRequest.Upload})
+		return FilterResponse{err.Error()}
+	}
+
+	filterUrls := make([]ons_aws.S3URL, len(batchRequest.Outputs))
+	seen := make(map[string]bool)
+	for i, output := range batchRequest.Outputs {
+		filterUrl, err := s.getFilterS3Url(batchRequest.RequestID, batchRequest.InputURL, output.OutputURL, output.Dimensions)
+		if err != nil {
+			log.ErrorC(batchRequest.RequestID, err, log.Data{"message": "Failed to get filter s3 url", "outputUrl": output.OutputURL.String()})
+			return FilterResponse{"Unable to obtain filter s3 url to send filtered file to: " + err.Error()}
+		}
+		if seen[filterUrl.String()] {
+			log.ErrorC(batchRequest.RequestID, duplicateFilterUrlErr, log.Data{"filterUrl": filterUrl.String()})
+			return FilterResponse{duplicateFilterUrlErr.Error()}
+		}
+		seen[filterUrl.String()] = true
+		filterUrls[i] = filterUrl
+	}
+
+	inputUrl, err := batchRequest.Input()
+	if err != nil {
+		log.ErrorC(batchRequest.RequestID, err, log.Data{"inputUrl": batchRequest.InputURL.String(), "versionId": batchRequest.VersionID})
+		return FilterResponse{err.Error()}
+	}
+	checking := startPhase(ctx, "Download", s.downloadTimeout)
+	inputUrl, inputInfo, err := s.preflight(checking, batchRequest.RequestID, inputUrl)
+	if err != nil {
+		err = checking.stopped(err)
+		checking.cancel()
+		return FilterResponse{err.Error()}
+	}
+	checking.cancel()
+	source := &event.SourceFile{URL: batchRequest.InputURL, VersionID: inputInfo.VersionID, ETag: inputInfo.ETag}
+	upload := withSourceMetadata(batchRequest.Upload, source)
+
+	// The input is read as it is filtered, so is opened within the filter phase.
+	filtering := startPhase(ctx, "Filter", s.filterTimeout)
+	defer filtering.cancel()
+	awsReadCloser, err := s.openInput(filtering, func(ctx context.Context) (io.ReadCloser, error) {
+		return s.awsService.GetCSV(ctx, batchRequest.RequestID, inputUrl)
+	})
+	if err != nil {
+		log.ErrorC(batchRequest.RequestID, awsClientErr, log.Data{"details": err.Error()})
+		return FilterResponse{filtering.stopped(err).Error()}
+	}
+	defer awsReadCloser.Close()
+
+	outputFiles := make([]*os.File, len(batchRequest.Outputs))
+	outputWriters := make([]*bufio.Writer, len(batchRequest.Outputs))
+	outputs := make([]filter.Output, len(batchRequest.Outputs))
+	defer func() {
+		for _, outputFile := range outputFiles {
+			if outputFile != nil {
+				outputFile.Close()
+				os.Remove(outputFile.Name())
+			}
+		}
+	}()
+	for i, output := range batchRequest.Outputs {
+		outputFile, err := ioutil.TempFile(tempDir, "csv_filter_")
+		if err != nil {
+			log.ErrorC(batchRequest.RequestID, err, log.Data{"message": "Error creating temp output file in location " + tempDir})
+			return FilterResponse{err.Error()}
+		}
+		outputFiles[i] = outputFile
+		outputWriters[i] = bufio.NewWriter(outputFile)
+		outputs[i] = filter.Output{Writer: outputWriters[i], Dimensions: output.Dimensions, Options: filter.Options{TempDir: tempDir}}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			message := fmt.Sprintf("%s", r)
+			log.ErrorC(batchRequest.RequestID, errors.New(message), log.Data{"message": "Failed to filter csv file into batch outputs"})
+			resp = FilterResponse{message}
+		}
+	}()
+
+	reports, err := s.csvProcessor.ProcessBatch(filtering, batchRequest.RequestID, newProgress(batchRequest.RequestID, inputInfo.Size).reader(awsReadCloser), outputs)
+	awsReadCloser.Close()
+	for i := range outputFiles {
+		outputWriters[i].Flush()
+		outputFiles[i].Close()
+	}
+	if err != nil {
+		err = filtering.stopped(err)
+		log.ErrorC(batchRequest.RequestID, err, log.Data{"message": "Failed to filter csv file into batch outputs"})
+		return FilterResponse{err.Error()}
 	}
-	return ons_aws.NewS3URL(filterUrlString + filename)
+
+	// Every output is uploaded before any transform is requested, so a failed upload aborts the whole batch.
+	uploading := startPhase(ctx, "Upload", s.uploadTimeout)
+	defer uploading.cancel()
+	checksums := make([]*event.Checksum, len(batchRequest.Outputs))
+	for i := range batchRequest.Outputs {
+		checksums[i], err = s.publish(uploading, batchRequest.RequestID, filterUrls[i], outputFiles[i].Name(), reports[i], upload)
+		if err != nil {
+			return FilterResponse{uploading.stopped(err).Error()}
+		}
+	}
+
+	for i, output := range batchRequest.Outputs {
+		transform := event.NewTransformRequest(filterUrls[i], output.OutputURL, batchRequest.RequestID)
+		transform.Report = reports[i]
+		transform.Source = source
+		transform.Checksum = checksums[i]
+		transform.Filter = event.NewFilter(output.Dimensions, outputs[i].Options)
+		transform.Trace = batchRequest.Trace
+		if err := s.sendTransformMessage(transform); err != nil {
+			return FilterResponse{err.Error()}
+		}
+	}
+
+	return filterResponseSuccess
 }
 
-func sendTransformMessage(filterRequest event.FilterRequest, filterUrl ons_aws.S3URL) {
-	message := event.NewTransformRequest(filterUrl, filterRequest.OutputURL, filterRequest.RequestID)
+// publish uploads a filtered file and its report to the filter bucket, returning the verified checksum of the file.
+// The temporary file is removed whether or not the upload succeeds. An error is returned if the filtered file could
+// not be uploaded, in which case no transform should be requested.
+func (s *FilterService) publish(ctx context.Context, requestID string, filterUrl ons_aws.S3URL, fileLocation string, report *filter.Report, upload *ons_aws.UploadOptions) (*event.Checksum, error) {
+	defer os.Remove(fileLocation)
 
-	messageJSON, err := json.Marshal(message)
+	tmpFile, err := os.Open(fileLocation)
 	if err != nil {
-		log.ErrorC(filterRequest.RequestID, err, log.Data{
-			"details": "Could not create the json representation of message",
-			"message": messageJSON,
-		})
-		panic(err)
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to get tmp output file for s3 uploading!"})
+		return nil, err
 	}
+	defer tmpFile.Close()
 
-	producerMsg := &sarama.ProducerMessage{
-		Topic: transformTopic,
-		Value: sarama.ByteEncoder(messageJSON),
+	rowCount := 0
+	if report != nil {
+		rowCount = report.RowsKept
 	}
 
-	log.DebugC(filterRequest.RequestID,"Sending transformRequest message", log.Data{"message-content": string(messageJSON)})
-	_, _, err = producer.SendMessage(producerMsg)
+	// The file is passed unbuffered so that a failed upload can be retried from the start.
+	result, err := s.awsService.SaveFile(ctx, requestID, tmpFile, filterUrl, withMetadata(upload, map[string]string{rowCountMetadataKey: strconv.Itoa(rowCount)}))
 	if err != nil {
-		log.ErrorC(filterRequest.RequestID, err, log.Data{
-			"details": "Failed to add messages to Kafka",
-		})
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to upload filtered file", "filterUrl": filterUrl.String()})
+		return nil, err
 	}
+
+	s.saveReport(ctx, requestID, report, filterUrl, upload)
+	return &event.Checksum{SHA256: result.SHA256, Size: result.Size, RowCount: rowCount}, nil
 }
 
-func setReader(reader requestBodyReader) {
-	readFilterRequestBody = reader
+// getFilterS3Url returns the location in the output bucket for the intermediate filtered file, built from the
+// output key template.
+func (s *FilterService) getFilterS3Url(requestID string, inputUrl ons_aws.S3URL, outputUrl ons_aws.S3URL, dimensions map[string][]string) (ons_aws.S3URL, error) {
+	filterUrlString := s.outputS3Bucket
+	if !strings.HasPrefix(filterUrlString, "s3://") {
+		filterUrlString = "s3://" + filterUrlString
+	}
+	if !strings.HasSuffix(filterUrlString, "/") {
+		filterUrlString = filterUrlString + "/"
+	}
+	return ons_aws.NewS3URL(filterUrlString + expandKeyTemplate(s.outputKeyTemplate, requestID, inputUrl, outputUrl, dimensions))
 }
 
-func setCSVProcessor(p filter.CSVProcessor) {
-	csvProcessor = p
+func expandKeyTemplate(template string, requestID string, inputUrl ons_aws.S3URL, outputUrl ons_aws.S3URL, dimensions map[string][]string) string {
+	dataset := ""
+	if inputUrl.URL != nil {
+		dataset = path.Base(inputUrl.GetFilePath())
+		dataset = strings.TrimSuffix(dataset, path.Ext(dataset))
+	}
+
+	key := strings.NewReplacer(
+		"{date}", time.Now().UTC().Format("2006-01-02"),
+		"{requestId}", requestID,
+		"{filename}", path.Base(outputUrl.GetFilePath()),
+		"{filterHash}", filter.DimensionsHash(dimensions),
+		"{dataset}", dataset,
+	).Replace(template)
+
+	// Tokens with no value would otherwise leave empty path segments in the key.
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
 }
 
-func setAWSClient(c ons_aws.AWSService) {
-	awsService = c
+// getReportS3Url returns the location of the side-car report written next to the filtered file.
+func getReportS3Url(filterUrl ons_aws.S3URL) (ons_aws.S3URL, error) {
+	return ons_aws.NewS3URL(filterUrl.String() + reportFileSuffix)
 }
 
-func SetProducer(p sarama.SyncProducer) {
-	producer = p
+func (s *FilterService) saveReport(ctx context.Context, requestID string, report *filter.Report, filterUrl ons_aws.S3URL, upload *ons_aws.UploadOptions) {
+	if report == nil {
+		return
+	}
+
+	reportUrl, err := getReportS3Url(filterUrl)
+	if err != nil {
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to get s3 url for filter report"})
+		return
+	}
+
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		log.ErrorC(requestID, err, log.Data{"message": "Could not create the json representation of the filter report"})
+		return
+	}
+
+	if _, err := s.awsService.SaveFile(ctx, requestID, bytes.NewReader(reportJSON), reportUrl, upload); err != nil {
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to upload filter report", "reportUrl": reportUrl.String()})
+	}
 }
 
-func setOutputS3Bucket(o string) {
-	outputS3Bucket = o
+// sendTransformMessage records the transform request in the outbox, which sends it. The request ID and trace context
+// are carried in the message, as the version of Kafka in use does not support record headers. The span of the send
+// is the parent of the transform. An error is returned if the request could not be recorded, in which case it will
+// not be sent.
+func (s *FilterService) sendTransformMessage(message event.TransformRequest) error {
+	requestID := message.RequestID
+	span := tracing.Start(requestID, s.transformTopic+" publish", tracing.KIND_PRODUCER)
+	span.SetAttribute("messaging.destination", s.transformTopic)
+	span.SetAttribute(tracing.S3_BUCKET, message.InputURL.GetBucketName())
+	span.SetAttribute(tracing.S3_KEY, message.InputURL.GetFilePath())
+	defer span.End()
+	message.Trace = message.Trace.WithParent(span)
+
+	messageJSON, err := s.encodeTransformMessage(message)
+	if err != nil {
+		span.SetError(err)
+		log.ErrorC(requestID, err, log.Data{"details": "Could not create the json representation of message"})
+		return err
+	}
+
+	log.DebugC(requestID, "Sending transformRequest message", log.Data{"message-content": string(messageJSON), "traceparent": message.Trace.TraceParent})
+	span.SetAttribute(tracing.BYTES, len(messageJSON))
+	if err := s.outbox.Send(requestID, s.transformTopic, messageJSON); err != nil {
+		span.SetError(err)
+		log.ErrorC(requestID, err, log.Data{"details": "Failed to record transformRequest message in the outbox"})
+		return err
+	}
+	return nil
 }
 
-func setTransformTopic(t string) {
-	transformTopic = t
+// encodeTransformMessage writes the message as json, in a schema versioned envelope if configured.
+func (s *FilterService) encodeTransformMessage(message event.TransformRequest) ([]byte, error) {
+	if s.messageEnvelope {
+		return event.Encode(s.schemaRegistry, event.TRANSFORM_REQUEST_SUBJECT, message.Version, message)
+	}
+	return json.Marshal(message)
 }
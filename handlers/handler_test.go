@@ -2,17 +2,26 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
-	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
+	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	"github.com/ONSdigital/dp-dd-csv-filter/filter"
 	"github.com/ONSdigital/dp-dd-csv-filter/message/event"
+	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
+	"github.com/ONSdigital/dp-dd-csv-filter/outbox"
+	"github.com/ONSdigital/dp-dd-csv-filter/tracing"
 	"github.com/Shopify/sarama"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -25,32 +34,123 @@ const PANIC_MESSAGE = "Panic!!!"
 type MockAWSCli struct {
 	requestedFiles map[string]int
 	savedFiles     map[string]int
+	copiedFiles    map[string]int
+	metadata       map[string]map[string]string
 	fileBytes      []byte
 	err            error
+	uploadErr      error
+	saveErr        error
+	headErr        error
+	versionID      string
+	contentType    string
+	blockOpen      bool
 }
 
 func newMockAwsClient() *MockAWSCli {
-	mock := &MockAWSCli{requestedFiles: make(map[string]int), savedFiles: make(map[string]int)}
-	setAWSClient(mock)
-	return mock
+	return &MockAWSCli{requestedFiles: make(map[string]int), savedFiles: make(map[string]int), copiedFiles: make(map[string]int), metadata: make(map[string]map[string]string)}
+}
+
+// GetCSV mock implementation. If blockOpen is set it does not return until the context is done, and the file cannot
+// be read once the context is done, as the service does.
+func (mock *MockAWSCli) GetCSV(ctx context.Context, requestId string, fileURI ons_aws.S3URL) (io.ReadCloser, error) {
+	mutex.Lock()
+	mock.requestedFiles[fileURI.String()]++
+	blockOpen := mock.blockOpen
+	mutex.Unlock()
+	if blockOpen {
+		<-ctx.Done()
+		return nil, &ons_aws.Error{Kind: ons_aws.ErrCanceled, Operation: "GetCSV", Attempts: 1, Err: ctx.Err()}
+	}
+	return ioutil.NopCloser(&contextReader{ctx: ctx, r: bytes.NewReader(mock.fileBytes)}), mock.err
+}
+
+// contextReader a reader that fails once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
 }
 
-func (mock *MockAWSCli) GetCSV(requestId string, fileURI ons_aws.S3URL) (io.ReadCloser, error) {
+func (mock *MockAWSCli) GetRange(ctx context.Context, requestId string, fileURI ons_aws.S3URL, start int64, end int64) (io.ReadCloser, error) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
 	mock.requestedFiles[fileURI.String()]++
-	return ioutil.NopCloser(bytes.NewReader(mock.fileBytes)), mock.err
+	return ioutil.NopCloser(bytes.NewReader(mock.fileBytes[start:end])), mock.err
 }
 
-func (mock *MockAWSCli) SaveFile(requestId string, reader io.Reader, filePath ons_aws.S3URL) error {
+// SaveFile mock implementation, which records the metadata of the file with its SHA-256, as the service does.
+func (mock *MockAWSCli) SaveFile(ctx context.Context, requestId string, reader io.Reader, filePath ons_aws.S3URL, overrides *ons_aws.UploadOptions) (*ons_aws.UploadResult, error) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
+	if mock.saveErr != nil {
+		return nil, mock.saveErr
+	}
+	content, _ := ioutil.ReadAll(reader)
+	sum := sha256.Sum256(content)
+	metadata := map[string]string{ons_aws.ChecksumMetadataKey: hex.EncodeToString(sum[:])}
+	if overrides != nil {
+		for key, value := range overrides.Metadata {
+			metadata[key] = value
+		}
+	}
+	mock.metadata[filePath.String()] = metadata
 	mock.savedFiles[filePath.String()]++
+	return &ons_aws.UploadResult{SHA256: metadata[ons_aws.ChecksumMetadataKey], Size: int64(len(content))}, nil
+}
+
+func (mock *MockAWSCli) ValidateUploadOptions(overrides *ons_aws.UploadOptions) error {
+	return mock.uploadErr
+}
+
+// HeadFile mock implementation, which fails if the context is done, as the service does.
+func (mock *MockAWSCli) HeadFile(ctx context.Context, requestId string, fileURI ons_aws.S3URL) (*ons_aws.FileInfo, error) {
+	if ctx.Err() != nil {
+		return nil, &ons_aws.Error{Kind: ons_aws.ErrCanceled, Operation: "HeadFile", Attempts: 1, Err: ctx.Err()}
+	}
+	if mock.headErr != nil {
+		return nil, mock.headErr
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return &ons_aws.FileInfo{ETag: "etag", VersionID: mock.versionID, Size: int64(len(mock.fileBytes)), ContentType: mock.contentType, Metadata: mock.metadata[fileURI.String()]}, nil
+}
+
+// CopyFile mock implementation, which succeeds if the source has previously been saved or copied to.
+func (mock *MockAWSCli) CopyFile(ctx context.Context, requestId string, source ons_aws.S3URL, destination ons_aws.S3URL, overrides *ons_aws.UploadOptions) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if mock.savedFiles[source.String()] == 0 && mock.copiedFiles[source.String()] == 0 {
+		return errors.New("NoSuchKey")
+	}
+	mock.copiedFiles[destination.String()]++
+	if overrides != nil && len(overrides.Metadata) > 0 {
+		mock.metadata[destination.String()] = overrides.Metadata
+	} else {
+		mock.metadata[destination.String()] = mock.metadata[source.String()]
+	}
 	return nil
 }
 
+func (mock *MockAWSCli) countOfCopiesWithPrefix(prefix string) int {
+	var count = 0
+	for uri, val := range mock.copiedFiles {
+		if strings.HasPrefix(uri, prefix) {
+			count += val
+		}
+	}
+	return count
+}
+
 func (mock *MockAWSCli) getTotalInvocations() int {
 	var count = 0
 	for _, val := range mock.requestedFiles {
@@ -69,24 +169,66 @@ func (mock *MockAWSCli) countOfSaveInvocations(uri string) int {
 
 // MockCSVProcessor
 type MockCSVProcessor struct {
-	invocations int
-	shouldPanic bool
+	invocations      int
+	batchInvocations int
+	batchOutputs     int
+	rangeInvocations int
+	shouldPanic      bool
+	block            bool
+	readDelay        time.Duration
+	err              error
 }
 
 func newMockCSVProcessor() *MockCSVProcessor {
-	mock := &MockCSVProcessor{invocations: 0}
-	setCSVProcessor(mock)
-	return mock
+	return &MockCSVProcessor{invocations: 0}
 }
 
-// Process mock implementation of the Process function.
-func (p *MockCSVProcessor) Process(requestId string, r io.Reader, w io.Writer, d map[string][]string) {
+// Process mock implementation of the Process function. If block is set it does not return until the context is done.
+// If readDelay is set the input is read after the delay.
+func (p *MockCSVProcessor) Process(ctx context.Context, requestId string, r io.Reader, w io.Writer, d map[string][]string, o filter.Options) (*filter.Report, error) {
 	mutex.Lock()
-	defer mutex.Unlock()
 	p.invocations++
+	block := p.block
+	readDelay := p.readDelay
+	mutex.Unlock()
+	if block {
+		<-ctx.Done()
+		return filter.NewReport(), ctx.Err()
+	}
+	if readDelay > 0 {
+		time.Sleep(readDelay)
+		if _, err := ioutil.ReadAll(r); err != nil {
+			return filter.NewReport(), err
+		}
+	}
 	if p.shouldPanic {
 		panic(PANIC_MESSAGE)
 	}
+	report := filter.NewReport()
+	report.RowsScanned = 10
+	report.RowsKept = 2
+	return report, p.err
+}
+
+// ProcessBatch mock implementation of the ProcessBatch function.
+func (p *MockCSVProcessor) ProcessBatch(ctx context.Context, requestId string, r io.Reader, outputs []filter.Output) ([]*filter.Report, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	p.batchInvocations++
+	p.batchOutputs += len(outputs)
+	reports := make([]*filter.Report, len(outputs))
+	for i := range outputs {
+		reports[i] = filter.NewReport()
+	}
+	return reports, p.err
+}
+
+// ProcessRanges mock implementation of the ProcessRanges function.
+func (p *MockCSVProcessor) ProcessRanges(ctx context.Context, requestId string, input filter.RangedInput, w io.Writer, d map[string][]string, o filter.Options) (*filter.Report, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	p.rangeInvocations++
+	return filter.NewReport(), p.err
 }
 
 // MockProducer
@@ -125,7 +267,7 @@ func TestHandler(t *testing.T) {
 
 	Convey("Should invoke AWSClient once with the filter file path.", t, func() {
 		recorder := httptest.NewRecorder()
-		mockAWSCli, mockCSVProcessor, mockProducer := setMocks(ioutil.ReadAll)
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
 
 		inputFile := "s3://input-bucket/test.csv"
 		outputFile := "s3://transform-bucket/test.out"
@@ -133,7 +275,7 @@ func TestHandler(t *testing.T) {
 		dimensions := map[string][]string{"dim": {"foo"}}
 		filterRequest := createFilterRequest(inputFile, outputFile, dimensions)
 
-		Handle(recorder, createRequest(filterRequest))
+		service.Handle(recorder, createRequest(filterRequest))
 
 		splitterResponse, status := extractResponseBody(recorder)
 
@@ -150,11 +292,28 @@ func TestHandler(t *testing.T) {
 		So(mockProducer.messageTopics[0], ShouldEqual, topicName)
 	})
 
+	Convey("Should save a filter report next to the filtered file and include it in the transform message.", t, func() {
+		recorder := httptest.NewRecorder()
+		service, mockAWSCli, _, mockProducer := setMocks()
+
+		inputFile := "s3://input-bucket/test.csv"
+		outputFile := "s3://transform-bucket/test.out"
+		reportFile := "s3://filter-bucket/test.out.report.json"
+		filterRequest := createFilterRequest(inputFile, outputFile, map[string][]string{"dim": {"foo"}})
+
+		service.Handle(recorder, createRequest(filterRequest))
+
+		So(1, ShouldEqual, mockAWSCli.countOfSaveInvocations(reportFile))
+		So(1, ShouldEqual, len(mockProducer.sentMessages))
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, `"rowsScanned":10`)
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, `"rowsKept":2`)
+	})
+
 	Convey("Should return appropriate error if cannot unmarshall the request body into a FilterRequest.", t, func() {
 		recorder := httptest.NewRecorder()
-		mockAWSCli, mockCSVProcessor, mockProducer := setMocks(ioutil.ReadAll)
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
 
-		Handle(recorder, createRequest("This is not a FilterRequest"))
+		service.Handle(recorder, createRequest("This is not a FilterRequest"))
 
 		splitterResponse, status := extractResponseBody(recorder)
 
@@ -170,10 +329,10 @@ func TestHandler(t *testing.T) {
 		uri := "s3://bucket/target.csv"
 		awsErrMsg := "THIS IS AN AWS ERROR"
 
-		mockAWSCli, mockCSVProcessor, mockProducer := setMocks(ioutil.ReadAll)
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
 		mockAWSCli.err = errors.New(awsErrMsg)
 
-		Handle(recorder, createRequest(createFilterRequest(uri, uri, nil)))
+		service.Handle(recorder, createRequest(createFilterRequest(uri, uri, nil)))
 		splitterResponse, status := extractResponseBody(recorder)
 
 		So(1, ShouldEqual, mockAWSCli.getTotalInvocations())
@@ -190,9 +349,9 @@ func TestHandler(t *testing.T) {
 		outputUri := "s3://output-bucket/target.csv"
 		filterUri := "s3://filter-bucket/target.csv"
 
-		mockAWSCli, mockCSVProcessor, mockProducer := setMocks(ioutil.ReadAll)
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
 
-		Handle(recorder, createRequest(createFilterRequest(inputUri, outputUri, nil)))
+		service.Handle(recorder, createRequest(createFilterRequest(inputUri, outputUri, nil)))
 		splitterResponse, statusCode := extractResponseBody(recorder)
 
 		So(1, ShouldEqual, mockAWSCli.getTotalInvocations())
@@ -215,10 +374,10 @@ func TestHandler(t *testing.T) {
 		outputUri := "s3://output-bucket/target.csv"
 		filterUri := "s3://filter-bucket/target.csv"
 
-		setOutputS3Bucket("filter-bucket/")
-		mockAWSCli, mockCSVProcessor, mockProducer := setMocks(ioutil.ReadAll)
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+		service.outputS3Bucket = "filter-bucket/"
 
-		Handle(recorder, createRequest(createFilterRequest(inputUri, outputUri, nil)))
+		service.Handle(recorder, createRequest(createFilterRequest(inputUri, outputUri, nil)))
 		splitterResponse, statusCode := extractResponseBody(recorder)
 
 		So(1, ShouldEqual, mockAWSCli.getTotalInvocations())
@@ -239,9 +398,9 @@ func TestHandler(t *testing.T) {
 		recorder := httptest.NewRecorder()
 		uri := "s3://bucket/unsupported.txt"
 
-		mockAWSCli, mockCSVProcessor, mockProducer := setMocks(ioutil.ReadAll)
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
 
-		Handle(recorder, createRequest(createFilterRequest(uri, uri, nil)))
+		service.Handle(recorder, createRequest(createFilterRequest(uri, uri, nil)))
 
 		splitterResponse, status := extractResponseBody(recorder)
 		So(0, ShouldEqual, mockAWSCli.getTotalInvocations())
@@ -251,9 +410,356 @@ func TestHandler(t *testing.T) {
 		So(status, ShouldResemble, http.StatusBadRequest)
 	})
 
+	Convey("Should return appropriate error for invalid filter options", t, func() {
+		recorder := httptest.NewRecorder()
+		uri := "s3://bucket/target.csv"
+
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+
+		filterRequest := createFilterRequest(uri, uri, nil)
+		filterRequest.Limit = -1
+		service.Handle(recorder, createRequest(filterRequest))
+
+		splitterResponse, status := extractResponseBody(recorder)
+		So(0, ShouldEqual, mockAWSCli.getTotalInvocations())
+		So(0, ShouldEqual, mockCSVProcessor.invocations)
+		So(0, ShouldEqual, len(mockProducer.sentMessages))
+		So(splitterResponse.Message, ShouldNotBeEmpty)
+		So(status, ShouldResemble, http.StatusBadRequest)
+	})
+
+	Convey("Should return appropriate error if the csvProcessor returns an error.", t, func() {
+		recorder := httptest.NewRecorder()
+		uri := "s3://bucket/target.csv"
+		processorErrMsg := "Conflicting values found for duplicate dimensions"
+
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+		mockCSVProcessor.err = errors.New(processorErrMsg)
+
+		service.Handle(recorder, createRequest(createFilterRequest(uri, uri, nil)))
+		splitterResponse, status := extractResponseBody(recorder)
+
+		So(1, ShouldEqual, mockCSVProcessor.invocations)
+		So(0, ShouldEqual, mockAWSCli.countOfSaveInvocations("s3://filter-bucket/target.csv"))
+		So(0, ShouldEqual, len(mockProducer.sentMessages))
+		So(splitterResponse, ShouldResemble, FilterResponse{processorErrMsg})
+		So(status, ShouldResemble, http.StatusBadRequest)
+	})
+
+	Convey("Should filter a file larger than the range size in byte ranges when parallelism is configured.", t, func() {
+		recorder := httptest.NewRecorder()
+		uri := "s3://bucket/target.csv"
+
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+		mockAWSCli.fileBytes = []byte("header\nrow\n")
+		service.filterParallelism, service.filterRangeSize = 4, 5
+
+		service.Handle(recorder, createRequest(createFilterRequest(uri, uri, nil)))
+		splitterResponse, status := extractResponseBody(recorder)
+
+		So(splitterResponse, ShouldResemble, filterResponseSuccess)
+		So(status, ShouldResemble, http.StatusOK)
+		So(1, ShouldEqual, mockCSVProcessor.rangeInvocations)
+		So(0, ShouldEqual, mockCSVProcessor.invocations)
+		So(1, ShouldEqual, len(mockProducer.sentMessages))
+	})
+
+	Convey("Should read the version of the input file found when the request started.", t, func() {
+		recorder := httptest.NewRecorder()
+		inputFile := "s3://bucket/test.csv"
+
+		service, mockAWSCli, _, mockProducer := setMocks()
+		mockAWSCli.versionID = "v1"
+
+		service.Handle(recorder, createRequest(createFilterRequest(inputFile, "s3://bucket/test.out", nil)))
+		splitterResponse, _ := extractResponseBody(recorder)
+
+		So(splitterResponse, ShouldResemble, filterResponseSuccess)
+		So(1, ShouldEqual, mockAWSCli.getInvocationsByURI(inputFile+"?versionId=v1"))
+		So(1, ShouldEqual, len(mockProducer.sentMessages))
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, `"source":{"url":"s3://bucket/test.csv","versionId":"v1","eTag":"etag"}`)
+	})
+
+	Convey("Should include the checksum, size and row count of the filtered file in the transform request.", t, func() {
+		recorder := httptest.NewRecorder()
+		filterFile := "s3://filter-bucket/test.out"
+
+		service, mockAWSCli, _, mockProducer := setMocks()
+
+		service.Handle(recorder, createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)))
+
+		So(1, ShouldEqual, len(mockProducer.sentMessages))
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, `"checksum":{"sha256":"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855","size":0,"rowCount":2}`)
+		So(mockAWSCli.metadata[filterFile][rowCountMetadataKey], ShouldEqual, "2")
+	})
+
+	Convey("Should include the filter that was applied and the format of the filtered file in the transform request.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, _, _, mockProducer := setMocks()
+		filterRequest := createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", map[string][]string{"dim": {"foo"}})
+		filterRequest.Limit = 5
+
+		service.Handle(recorder, createRequest(filterRequest))
+
+		So(1, ShouldEqual, len(mockProducer.sentMessages))
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, `"version":2`)
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, `"filter":{"dimensions":{"dim":["foo"]},"limit":5}`)
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, `"format":{"type":"csv","layout":"v3"}`)
+	})
+
+	Convey("Should send the transform request in a schema versioned envelope if configured.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, _, _, mockProducer := setMocks()
+		service.messageEnvelope = true
+
+		service.Handle(recorder, createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)))
+
+		So(1, ShouldEqual, len(mockProducer.sentMessages))
+		So(mockProducer.sentMessages[0], ShouldStartWith, `{"schema":"transform-request","version":2,"payload":{"version":2,`)
+	})
+
+	Convey("Should propagate the request id and trace context from the http headers to the transform request.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, _, _, mockProducer := setMocks()
+		filterRequest := createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)
+		filterRequest.RequestID = ""
+		request := createRequest(filterRequest)
+		request.Header.Set(event.REQUEST_ID_HEADER, "headerRequestId")
+		request.Header.Set(event.TRACEPARENT_HEADER, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+		service.Handle(recorder, request)
+
+		So(recorder.Header().Get(event.REQUEST_ID_HEADER), ShouldEqual, "headerRequestId")
+		So(recorder.Header().Get(event.TRACEPARENT_HEADER), ShouldEqual, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		So(1, ShouldEqual, len(mockProducer.sentMessages))
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, `"requestId":"headerRequestId"`)
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, `"trace":{"traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-`)
+		So(mockProducer.sentMessages[0], ShouldNotContainSubstring, `00f067aa0ba902b7`)
+	})
+
+	Convey("Should start a trace for a request without one.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, _, _, mockProducer := setMocks()
+
+		service.Handle(recorder, createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)))
+
+		So(recorder.Header().Get(event.REQUEST_ID_HEADER), ShouldEqual, "requestId")
+		So(recorder.Header().Get(event.TRACEPARENT_HEADER), ShouldStartWith, "00-")
+		So(1, ShouldEqual, len(mockProducer.sentMessages))
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, `"trace":{"traceparent":"00-`)
+	})
+
+	Convey("Should record spans for the request, with the span sending the transform request as its parent.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, _, _, mockProducer := setMocks()
+		exporter := &recordingExporter{}
+		tracing.SetExporter(exporter)
+		defer tracing.SetExporter(nil)
+		request := createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil))
+		request.Header.Set(event.TRACEPARENT_HEADER, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+		service.Handle(recorder, request)
+		tracing.Flush()
+
+		spans := exporter.byName()
+		So(spans["POST /filter"].ParentID, ShouldEqual, "00f067aa0ba902b7")
+		So(spans["HandleRequest"].ParentID, ShouldEqual, spans["POST /filter"].SpanID)
+		So(spans["HandleRequest"].Attributes[tracing.S3_BUCKET], ShouldEqual, "bucket")
+		So(spans[topicName+" publish"].ParentID, ShouldEqual, spans["HandleRequest"].SpanID)
+		So(spans[topicName+" publish"].TraceID, ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+		So(1, ShouldEqual, len(mockProducer.sentMessages))
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, `"traceparent":"`+spans[topicName+" publish"].TraceParent()+`"`)
+	})
+
+	Convey("Should reject an input file that does not exist before filtering.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+		mockAWSCli.headErr = &ons_aws.Error{Kind: ons_aws.ErrNotFound, Operation: "HeadFile", Attempts: 1, Err: errors.New("NotFound")}
+
+		service.Handle(recorder, createRequest(createFilterRequest("s3://bucket/missing.csv", "s3://bucket/test.out", nil)))
+		splitterResponse, status := extractResponseBody(recorder)
+
+		So(splitterResponse, ShouldResemble, FilterResponse{"Input file 's3://bucket/missing.csv' does not exist."})
+		So(status, ShouldResemble, http.StatusBadRequest)
+		So(0, ShouldEqual, mockCSVProcessor.invocations)
+		So(0, ShouldEqual, len(mockProducer.sentMessages))
+	})
+
+	Convey("Should reject an input file larger than the maximum size before filtering.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, mockAWSCli, mockCSVProcessor, _ := setMocks()
+		mockAWSCli.fileBytes = []byte("header\nrow\n")
+		service.inputMaxSize = 5
+
+		service.Handle(recorder, createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)))
+		splitterResponse, _ := extractResponseBody(recorder)
+
+		So(splitterResponse, ShouldResemble, FilterResponse{"Input file is 11 bytes, larger than the maximum of 5 bytes."})
+		So(0, ShouldEqual, mockCSVProcessor.invocations)
+	})
+
+	Convey("Should reject an input file with an unsupported content type before filtering.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, mockAWSCli, mockCSVProcessor, _ := setMocks()
+		mockAWSCli.contentType = "application/zip"
+
+		service.Handle(recorder, createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)))
+		splitterResponse, _ := extractResponseBody(recorder)
+
+		So(splitterResponse, ShouldResemble, FilterResponse{"Input file content type 'application/zip' is not supported."})
+		So(0, ShouldEqual, mockCSVProcessor.invocations)
+	})
+
+	Convey("Should accept an input file with a charset in its content type.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, mockAWSCli, mockCSVProcessor, _ := setMocks()
+		mockAWSCli.contentType = "text/csv; charset=utf-8"
+
+		service.Handle(recorder, createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)))
+		splitterResponse, _ := extractResponseBody(recorder)
+
+		So(splitterResponse, ShouldResemble, filterResponseSuccess)
+		So(1, ShouldEqual, mockCSVProcessor.invocations)
+	})
+
+	Convey("Should not request a transform if the filtered file cannot be uploaded.", t, func() {
+		recorder := httptest.NewRecorder()
+		uri := "s3://bucket/target.csv"
+		saveErrMsg := "SaveFile s3://filter-bucket/target.csv failed (access denied) after 1 attempt(s): AccessDenied"
+
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+		mockAWSCli.saveErr = errors.New(saveErrMsg)
+
+		service.Handle(recorder, createRequest(createFilterRequest(uri, uri, nil)))
+		splitterResponse, status := extractResponseBody(recorder)
+
+		So(1, ShouldEqual, mockCSVProcessor.invocations)
+		So(0, ShouldEqual, mockAWSCli.countOfSaveInvocations("s3://filter-bucket/target.csv"))
+		So(0, ShouldEqual, len(mockProducer.sentMessages))
+		So(splitterResponse, ShouldResemble, FilterResponse{saveErrMsg})
+		So(status, ShouldResemble, http.StatusBadRequest)
+	})
+
+	Convey("Should retry a transform request that could not be sent.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, _, _, mockProducer := setMocks()
+		mockProducer.sendMessageError = errors.New("kafka: client has run out of available brokers")
+
+		service.Handle(recorder, createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)))
+		splitterResponse, status := extractResponseBody(recorder)
+
+		So(splitterResponse, ShouldResemble, filterResponseSuccess)
+		So(status, ShouldResemble, http.StatusOK)
+		So(1, ShouldEqual, len(mockProducer.sentMessages))
+
+		mockProducer.sendMessageError = nil
+		time.Sleep(time.Millisecond)
+		pending, err := service.outbox.Reconcile()
+
+		So(err, ShouldBeNil)
+		So(pending, ShouldEqual, 0)
+		So(2, ShouldEqual, len(mockProducer.sentMessages))
+		So(mockProducer.sentMessages[1], ShouldEqual, mockProducer.sentMessages[0])
+	})
+
+	Convey("Should stop filtering that does not finish within the filter timeout.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+		service.filterTimeout = 10 * time.Millisecond
+		mockCSVProcessor.block = true
+
+		service.Handle(recorder, createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)))
+		splitterResponse, status := extractResponseBody(recorder)
+
+		So(splitterResponse, ShouldResemble, FilterResponse{"Filter did not finish within 10ms."})
+		So(status, ShouldResemble, http.StatusBadRequest)
+		So(1, ShouldEqual, mockCSVProcessor.invocations)
+		So(0, ShouldEqual, mockAWSCli.countOfSaveInvocations("s3://filter-bucket/test.out"))
+		So(0, ShouldEqual, len(mockProducer.sentMessages))
+	})
+
+	Convey("Should stop a download that does not open the input within the download timeout.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+		service.downloadTimeout = 10 * time.Millisecond
+		mockAWSCli.blockOpen = true
+
+		service.Handle(recorder, createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)))
+		splitterResponse, status := extractResponseBody(recorder)
+
+		So(splitterResponse, ShouldResemble, FilterResponse{"Download did not finish within 10ms."})
+		So(status, ShouldResemble, http.StatusBadRequest)
+		So(0, ShouldEqual, mockCSVProcessor.invocations)
+		So(0, ShouldEqual, len(mockProducer.sentMessages))
+	})
+
+	Convey("Should read the input for as long as filtering takes once it is opened within the download timeout.", t, func() {
+		recorder := httptest.NewRecorder()
+
+		service, _, mockCSVProcessor, mockProducer := setMocks()
+		service.downloadTimeout = 10 * time.Millisecond
+		mockCSVProcessor.readDelay = 50 * time.Millisecond
+
+		service.Handle(recorder, createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)))
+		splitterResponse, status := extractResponseBody(recorder)
+
+		So(splitterResponse, ShouldResemble, filterResponseSuccess)
+		So(status, ShouldResemble, http.StatusOK)
+		So(1, ShouldEqual, len(mockProducer.sentMessages))
+	})
+
+	Convey("Should stop a request when the client disconnects.", t, func() {
+		recorder := httptest.NewRecorder()
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		request := createRequest(createFilterRequest("s3://bucket/test.csv", "s3://bucket/test.out", nil)).WithContext(ctx)
+
+		service.Handle(recorder, request)
+		splitterResponse, _ := extractResponseBody(recorder)
+
+		So(splitterResponse, ShouldResemble, FilterResponse{requestCancelledErr.Error()})
+		So(0, ShouldEqual, mockAWSCli.getTotalInvocations())
+		So(0, ShouldEqual, mockCSVProcessor.invocations)
+		So(0, ShouldEqual, len(mockProducer.sentMessages))
+	})
+
+	Convey("Should return appropriate error if the upload options are not allowed.", t, func() {
+		recorder := httptest.NewRecorder()
+		uri := "s3://bucket/target.csv"
+		uploadErrMsg := "Storage class 'GLACIER' is not allowed."
+
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+		mockAWSCli.uploadErr = errors.New(uploadErrMsg)
+
+		filterRequest := createFilterRequest(uri, uri, nil)
+		filterRequest.Upload = &ons_aws.UploadOptions{StorageClass: "GLACIER"}
+		service.Handle(recorder, createRequest(filterRequest))
+		splitterResponse, status := extractResponseBody(recorder)
+
+		So(0, ShouldEqual, mockAWSCli.getTotalInvocations())
+		So(0, ShouldEqual, mockCSVProcessor.invocations)
+		So(0, ShouldEqual, len(mockProducer.sentMessages))
+		So(splitterResponse, ShouldResemble, FilterResponse{uploadErrMsg})
+		So(status, ShouldResemble, http.StatusBadRequest)
+	})
+
 	Convey("Should handle a panic.", t, func() {
 		recorder := httptest.NewRecorder()
-		mockAWSCli, mockCSVProcessor, mockProducer := setMocks(ioutil.ReadAll)
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
 
 		inputFile := "s3://bucket/test.csv"
 		outputFile := "s3://bucket/test.out"
@@ -262,7 +768,7 @@ func TestHandler(t *testing.T) {
 
 		mockCSVProcessor.shouldPanic = true
 
-		Handle(recorder, createRequest(filterRequest))
+		service.Handle(recorder, createRequest(filterRequest))
 
 		splitterResponse, status := extractResponseBody(recorder)
 
@@ -277,34 +783,152 @@ func TestHandler(t *testing.T) {
 
 }
 
+func TestResultCache(t *testing.T) {
+
+	Convey("Should filter on a cache miss and copy the cached result on a hit.", t, func() {
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+		service.resultCacheUrl = "cache-bucket/results"
+
+		inputFile := "s3://input-bucket/test.csv"
+		outputFile := "s3://transform-bucket/test.out"
+		filterFile := "s3://filter-bucket/test.out"
+		filterRequest := createFilterRequest(inputFile, outputFile, map[string][]string{"dim": {"foo"}})
+
+		recorder := httptest.NewRecorder()
+		service.Handle(recorder, createRequest(filterRequest))
+		response, _ := extractResponseBody(recorder)
+
+		So(response, ShouldResemble, filterResponseSuccess)
+		So(1, ShouldEqual, mockAWSCli.getInvocationsByURI(inputFile))
+		So(1, ShouldEqual, mockCSVProcessor.invocations)
+		So(2, ShouldEqual, mockAWSCli.countOfCopiesWithPrefix("s3://cache-bucket/results/"))
+
+		recorder = httptest.NewRecorder()
+		service.Handle(recorder, createRequest(filterRequest))
+		response, _ = extractResponseBody(recorder)
+
+		So(response, ShouldResemble, filterResponseSuccess)
+		So(1, ShouldEqual, mockAWSCli.getInvocationsByURI(inputFile))
+		So(1, ShouldEqual, mockCSVProcessor.invocations)
+		So(1, ShouldEqual, mockAWSCli.copiedFiles[filterFile])
+		So(2, ShouldEqual, len(mockProducer.sentMessages))
+		So(mockProducer.sentMessages[1], ShouldContainSubstring, filterFile)
+		So(mockProducer.sentMessages[1], ShouldContainSubstring, outputFile)
+		So(mockProducer.sentMessages[1], ShouldContainSubstring, `"checksum":{"sha256":"`)
+		So(mockAWSCli.metadata[filterFile][ons_aws.ChecksumMetadataKey], ShouldNotBeEmpty)
+	})
+
+	Convey("Should not cache a random sample.", t, func() {
+		service, mockAWSCli, mockCSVProcessor, _ := setMocks()
+		service.resultCacheUrl = "cache-bucket/results"
+
+		filterRequest := createFilterRequest("s3://input-bucket/test.csv", "s3://transform-bucket/test.out", nil)
+		filterRequest.Sample = &filter.Sample{Rate: 0.5}
+
+		service.Handle(httptest.NewRecorder(), createRequest(filterRequest))
+
+		So(1, ShouldEqual, mockCSVProcessor.invocations)
+		So(0, ShouldEqual, mockAWSCli.countOfCopiesWithPrefix("s3://cache-bucket/"))
+	})
+}
+
+func TestBatchHandler(t *testing.T) {
+
+	Convey("Should filter the input once and send a transform message for each output.", t, func() {
+		recorder := httptest.NewRecorder()
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+
+		inputFile := "s3://input-bucket/test.csv"
+		batchRequest := createBatchFilterRequest(inputFile, "s3://transform-bucket/a.out", "s3://transform-bucket/b.out")
+
+		service.HandleBatch(recorder, createRequest(batchRequest))
+
+		response, status := extractResponseBody(recorder)
+
+		So(response, ShouldResemble, filterResponseSuccess)
+		So(status, ShouldResemble, http.StatusOK)
+		So(1, ShouldEqual, mockAWSCli.getInvocationsByURI(inputFile))
+		So(1, ShouldEqual, mockCSVProcessor.batchInvocations)
+		So(2, ShouldEqual, mockCSVProcessor.batchOutputs)
+		So(1, ShouldEqual, mockAWSCli.countOfSaveInvocations("s3://filter-bucket/a.out"))
+		So(1, ShouldEqual, mockAWSCli.countOfSaveInvocations("s3://filter-bucket/b.out"))
+		So(2, ShouldEqual, len(mockProducer.sentMessages))
+		So(mockProducer.sentMessages[0], ShouldContainSubstring, "s3://transform-bucket/a.out")
+		So(mockProducer.sentMessages[1], ShouldContainSubstring, "s3://transform-bucket/b.out")
+	})
+
+	Convey("Should reject outputs that would overwrite each other's filtered file.", t, func() {
+		recorder := httptest.NewRecorder()
+		service, mockAWSCli, mockCSVProcessor, mockProducer := setMocks()
+
+		batchRequest := createBatchFilterRequest("s3://input-bucket/test.csv", "s3://transform-bucket/a/data.csv", "s3://transform-bucket/b/data.csv")
+
+		service.HandleBatch(recorder, createRequest(batchRequest))
+
+		response, status := extractResponseBody(recorder)
+
+		So(response, ShouldResemble, FilterResponse{duplicateFilterUrlErr.Error()})
+		So(status, ShouldResemble, http.StatusBadRequest)
+		So(0, ShouldEqual, mockAWSCli.getTotalInvocations())
+		So(0, ShouldEqual, mockCSVProcessor.batchInvocations)
+		So(0, ShouldEqual, len(mockProducer.sentMessages))
+	})
+}
+
 func TestGetFilterS3Url(t *testing.T) {
+	inputUrl, _ := ons_aws.NewS3URL("s3://input-bucket/folder/Open-Data-v3.csv")
 	outputUrl, _ := ons_aws.NewS3URL("s3://output-bucket/folder/filename.csv")
+	service := NewFilterService(config.Default(), nil, nil, nil)
 	Convey("Should return appropriate error if s3Url cannot be created.", t, func() {
-		setOutputS3Bucket("invalid s3 bucket")
-		_, err := getFilterS3Url(outputUrl)
+		service.outputS3Bucket = "invalid s3 bucket"
+		_, err := service.getFilterS3Url("requestId", inputUrl, outputUrl, nil)
 		So(err, ShouldNotBeNil)
 	})
 	Convey("Should return s3 url when bucket includes s3://", t, func() {
-		setOutputS3Bucket("s3://valid-bucket")
-		s3, err := getFilterS3Url(outputUrl)
+		service.outputS3Bucket = "s3://valid-bucket"
+		s3, err := service.getFilterS3Url("requestId", inputUrl, outputUrl, nil)
 		So(err, ShouldBeNil)
 		result := s3.String()
 		So(result, ShouldEqual, "s3://valid-bucket/filename.csv")
 	})
 	Convey("Should return s3 url when bucket does not include s3://", t, func() {
-		setOutputS3Bucket("valid-bucket/")
-		s3, err := getFilterS3Url(outputUrl)
+		service.outputS3Bucket = "valid-bucket/"
+		s3, err := service.getFilterS3Url("requestId", inputUrl, outputUrl, nil)
 		So(err, ShouldBeNil)
 		result := s3.String()
 		So(result, ShouldEqual, "s3://valid-bucket/filename.csv")
 	})
 	Convey("Should return s3 url when bucket includes path and trailing /", t, func() {
-		setOutputS3Bucket("valid-bucket/valid-folder/")
-		s3, err := getFilterS3Url(outputUrl)
+		service.outputS3Bucket = "valid-bucket/valid-folder/"
+		s3, err := service.getFilterS3Url("requestId", inputUrl, outputUrl, nil)
 		So(err, ShouldBeNil)
 		result := s3.String()
 		So(result, ShouldEqual, "s3://valid-bucket/valid-folder/filename.csv")
 	})
+	Convey("Should expand the output key template", t, func() {
+		service.outputS3Bucket = "valid-bucket"
+		service.outputKeyTemplate = "{dataset}/{requestId}/{filterHash}/{filename}"
+		dimensions := map[string][]string{"NACE": {"CI_0000072"}}
+		s3, err := service.getFilterS3Url("requestId", inputUrl, outputUrl, dimensions)
+		So(err, ShouldBeNil)
+		result := s3.String()
+		So(result, ShouldEqual, "s3://valid-bucket/Open-Data-v3/requestId/"+filter.DimensionsHash(dimensions)+"/filename.csv")
+	})
+	Convey("Should give outputs with the same filename different urls when the template includes the request id", t, func() {
+		service.outputS3Bucket = "valid-bucket"
+		service.outputKeyTemplate = "{date}/{requestId}/{filename}"
+		first, _ := service.getFilterS3Url("first", inputUrl, outputUrl, nil)
+		second, _ := service.getFilterS3Url("second", inputUrl, outputUrl, nil)
+		So(first.String(), ShouldNotEqual, second.String())
+		So(first.String(), ShouldEndWith, "/first/filename.csv")
+	})
+	Convey("Should not leave empty path segments for tokens without a value", t, func() {
+		service.outputS3Bucket = "valid-bucket"
+		service.outputKeyTemplate = "{requestId}/{filename}"
+		s3, err := service.getFilterS3Url("", inputUrl, outputUrl, nil)
+		So(err, ShouldBeNil)
+		So(s3.String(), ShouldEqual, "s3://valid-bucket/filename.csv")
+	})
 }
 
 func extractResponseBody(rec *httptest.ResponseRecorder) (FilterResponse, int) {
@@ -313,6 +937,24 @@ func extractResponseBody(rec *httptest.ResponseRecorder) (FilterResponse, int) {
 	return *actual, rec.Code
 }
 
+// recordingExporter keeps the spans exported to it.
+type recordingExporter struct {
+	spans []*tracing.Span
+}
+
+func (e *recordingExporter) Export(spans []*tracing.Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) byName() map[string]*tracing.Span {
+	result := make(map[string]*tracing.Span)
+	for _, span := range e.spans {
+		result[span.Name] = span
+	}
+	return result
+}
+
 func createRequest(body interface{}) *http.Request {
 	b, _ := json.Marshal(body)
 	request, _ := http.NewRequest("POST", "/filter", bytes.NewBuffer(b))
@@ -327,13 +969,33 @@ func createFilterRequest(input string, output string, dimensions map[string][]st
 	return req
 }
 
-func setMocks(reader requestBodyReader) (*MockAWSCli, *MockCSVProcessor, *MockProducer) {
+func createBatchFilterRequest(input string, outputs ...string) event.BatchFilterRequest {
+	inputUrl, err := ons_aws.NewS3URL(input)
+	if err != nil {
+		panic(err)
+	}
+	batchRequest := event.BatchFilterRequest{RequestID: "requestId", InputURL: inputUrl}
+	for _, output := range outputs {
+		outputUrl, err := ons_aws.NewS3URL(output)
+		if err != nil {
+			panic(err)
+		}
+		batchRequest.Outputs = append(batchRequest.Outputs, event.FilterOutput{OutputURL: outputUrl, Dimensions: map[string][]string{"dim": {"foo"}}})
+	}
+	return batchRequest
+}
+
+// setMocks returns a FilterService using mock dependencies, with the mocks so that tests can check how they were used.
+func setMocks() (*FilterService, *MockAWSCli, *MockCSVProcessor, *MockProducer) {
 	mockAWSCli := newMockAwsClient()
 	mockCSVProcessor := newMockCSVProcessor()
 	mockProducer := newMockProducer()
-	SetProducer(mockProducer)
-	setReader(reader)
-	setOutputS3Bucket(filterBucket)
-	setTransformTopic(topicName)
-	return mockAWSCli, mockCSVProcessor, mockProducer
+
+	cfg := config.Default()
+	cfg.OutputS3Bucket = filterBucket
+	cfg.KafkaTransformTopic = topicName
+	cfg.InputContentTypes = []string{"text/csv"}
+	cfg.OutboxRetryBackoff = time.Millisecond
+	transformOutbox := outbox.New(outbox.NewMemoryStore(), mockProducer, outbox.NewRetryPolicy(cfg))
+	return NewFilterService(cfg, mockAWSCli, mockCSVProcessor, transformOutbox), mockAWSCli, mockCSVProcessor, mockProducer
 }
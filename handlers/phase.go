@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var requestCancelledErr = errors.New("The request was cancelled.")
+
+// phase a stage of handling a request, downloading, filtering or uploading, that is stopped once its timeout has
+// passed or the request is cancelled.
+type phase struct {
+	context.Context
+	name     string
+	timeout  time.Duration
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	timedOut int32
+}
+
+// startPhase starts a phase of the request. A timeout of 0 or less means the phase is only stopped if the request is
+// cancelled.
+func startPhase(ctx context.Context, name string, timeout time.Duration) *phase {
+	p := &phase{name: name, timeout: timeout}
+	p.Context, p.cancel = context.WithCancel(ctx)
+	if timeout > 0 {
+		p.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&p.timedOut, 1)
+			p.cancel()
+		})
+	}
+	return p
+}
+
+// finish stops the timeout of the phase. Its context stays usable until the phase is cancelled, so a response opened
+// within the timeout can still be read.
+func (p *phase) finish() {
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+}
+
+// stopped returns an error saying why the phase was stopped, or err if it was not. It must be called before the
+// phase is cancelled.
+func (p *phase) stopped(err error) error {
+	if atomic.LoadInt32(&p.timedOut) == 1 {
+		return fmt.Errorf("%s did not finish within %s.", p.name, p.timeout)
+	}
+	if p.Err() != nil {
+		return requestCancelledErr
+	}
+	return err
+}
+
+// phaseReader a reader opened within a phase, which cancels the phase when it is closed.
+type phaseReader struct {
+	io.ReadCloser
+	phase *phase
+}
+
+func (r *phaseReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.phase.cancel()
+	return err
+}
+
+// openInput opens the input within a download phase of ctx. The download timeout bounds opening the input only, it
+// is then read within ctx until it is closed.
+func (s *FilterService) openInput(ctx context.Context, open func(ctx context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	downloading := startPhase(ctx, "Download", s.downloadTimeout)
+	reader, err := open(downloading)
+	downloading.finish()
+	if err == nil && downloading.Err() != nil {
+		reader.Close()
+		err = downloading.Err()
+	}
+	if err != nil {
+		err = downloading.stopped(err)
+		downloading.cancel()
+		return nil, err
+	}
+	return &phaseReader{ReadCloser: reader, phase: downloading}, nil
+}
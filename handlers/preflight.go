@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"strings"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// preflight reads the metadata of the input file and checks it can be filtered before any work is done. The input url
+// is pinned to the version found so that every read of the file, including retries and byte ranges, sees the same
+// version even if the file is replaced.
+func (s *FilterService) preflight(ctx context.Context, requestID string, inputUrl ons_aws.S3URL) (ons_aws.S3URL, *ons_aws.FileInfo, error) {
+	info, err := s.awsService.HeadFile(ctx, requestID, inputUrl)
+	if err != nil {
+		log.ErrorC(requestID, awsClientErr, log.Data{"details": err.Error(), "inputUrl": inputUrl.String()})
+		if ons_aws.IsNotFound(err) {
+			return inputUrl, nil, fmt.Errorf("Input file '%s' does not exist.", inputUrl.String())
+		}
+		return inputUrl, nil, err
+	}
+
+	if err := s.checkInput(info); err != nil {
+		log.ErrorC(requestID, err, log.Data{"inputUrl": inputUrl.String(), "size": info.Size, "contentType": info.ContentType, "contentEncoding": info.ContentEncoding})
+		return inputUrl, nil, err
+	}
+
+	if len(info.VersionID) > 0 {
+		inputUrl = inputUrl.WithVersionID(info.VersionID)
+	}
+	log.DebugC(requestID, "Pinned input file version", log.Data{"inputUrl": inputUrl.String(), "eTag": info.ETag, "size": info.Size})
+	return inputUrl, info, nil
+}
+
+// checkInput checks the size, content type and content encoding of the input file are acceptable.
+func (s *FilterService) checkInput(info *ons_aws.FileInfo) error {
+	if s.inputMaxSize > 0 && info.Size > s.inputMaxSize {
+		return fmt.Errorf("Input file is %d bytes, larger than the maximum of %d bytes.", info.Size, s.inputMaxSize)
+	}
+
+	if len(info.ContentType) > 0 {
+		contentType, _, err := mime.ParseMediaType(info.ContentType)
+		if err != nil || !containsFold(s.inputContentTypes, contentType) {
+			return fmt.Errorf("Input file content type '%s' is not supported.", info.ContentType)
+		}
+	}
+
+	if len(info.ContentEncoding) > 0 && !containsFold(s.inputContentEncodings, info.ContentEncoding) {
+		return fmt.Errorf("Input file content encoding '%s' is not supported.", info.ContentEncoding)
+	}
+	return nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"io"
+	"sync/atomic"
+
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// progressStep the percentage of the input file read between progress messages.
+const progressStep = 10
+
+// progress logs how much of an input file of known size has been read. It is shared by the readers of every byte
+// range of the file.
+type progress struct {
+	requestID string
+	size      int64
+	read      int64
+	logged    int64
+}
+
+func newProgress(requestID string, size int64) *progress {
+	return &progress{requestID: requestID, size: size}
+}
+
+// add records that n more bytes have been read, logging each time another progressStep percent has been read.
+func (p *progress) add(n int) {
+	if p.size <= 0 || n <= 0 {
+		return
+	}
+	read := atomic.AddInt64(&p.read, int64(n))
+	percent := read * 100 / p.size / progressStep * progressStep
+	if percent > 100 {
+		// Byte ranges overlap slightly where records are aligned, so more than the size may be read.
+		percent = 100
+	}
+	for {
+		logged := atomic.LoadInt64(&p.logged)
+		if percent <= logged {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&p.logged, logged, percent) {
+			log.DebugC(p.requestID, "Reading input file", log.Data{"percent": percent, "bytesRead": read, "size": p.size})
+			return
+		}
+	}
+}
+
+// reader wraps the reader so that the bytes read from it are recorded.
+func (p *progress) reader(r io.ReadCloser) io.ReadCloser {
+	return &progressReader{ReadCloser: r, progress: p}
+}
+
+type progressReader struct {
+	io.ReadCloser
+	progress *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.progress.add(n)
+	return n, err
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Requests tracks the HTTP requests in progress, so they can be stopped and waited for when the service stops.
+type Requests struct {
+	ctx        context.Context
+	inProgress sync.WaitGroup
+}
+
+// NewRequests create a Requests whose requests are cancelled once the context is done.
+func NewRequests(ctx context.Context) *Requests {
+	return &Requests{ctx: ctx}
+}
+
+// Handler wraps the handler so each request's context is cancelled when the service stops or the client disconnects.
+// The server does not cancel the request context when the client disconnects, so the connection is watched instead.
+func (r *Requests) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.inProgress.Add(1)
+		defer r.inProgress.Done()
+
+		ctx, cancel := context.WithCancel(req.Context())
+		defer cancel()
+
+		var closed <-chan bool
+		if notifier, ok := w.(http.CloseNotifier); ok {
+			closed = notifier.CloseNotify()
+		}
+		go func() {
+			select {
+			case <-r.ctx.Done():
+			case <-closed:
+			case <-ctx.Done():
+			}
+			cancel()
+		}()
+
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// Wait waits up to the timeout for the requests in progress to finish, returning false if they did not.
+func (r *Requests) Wait(timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		r.inProgress.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRequests(t *testing.T) {
+
+	Convey("Given requests tracked until the service stops", t, func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		requests := NewRequests(ctx)
+
+		started := make(chan struct{})
+		var requestErr error
+		handler := requests.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			close(started)
+			<-req.Context().Done()
+			requestErr = req.Context().Err()
+		}))
+
+		finished := make(chan struct{})
+		go func() {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/filter", nil))
+			close(finished)
+		}()
+		<-started
+
+		Convey("Then a request in progress is not waited for beyond the timeout", func() {
+			So(requests.Wait(10*time.Millisecond), ShouldBeFalse)
+		})
+
+		Convey("Then a request in progress is cancelled when the service stops, and is waited for", func() {
+			cancel()
+			So(requests.Wait(time.Second), ShouldBeTrue)
+			<-finished
+			So(requestErr == context.Canceled, ShouldBeTrue)
+		})
+	})
+
+	Convey("Given a tracked request whose client disconnects", t, func() {
+		requests := NewRequests(context.Background())
+		requestErr := make(chan error, 1)
+		server := httptest.NewServer(requests.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			<-req.Context().Done()
+			requestErr <- req.Context().Err()
+		})))
+		defer server.Close()
+
+		Convey("Then the request is cancelled", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			req, _ := http.NewRequest("POST", server.URL, nil)
+			http.DefaultClient.Do(req.WithContext(ctx))
+			So(<-requestErr == context.Canceled, ShouldBeTrue)
+			So(requests.Wait(time.Second), ShouldBeTrue)
+		})
+	})
+}
@@ -1,61 +1,142 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	"github.com/ONSdigital/dp-dd-csv-filter/filter"
 	"github.com/ONSdigital/dp-dd-csv-filter/handlers"
 	"github.com/ONSdigital/dp-dd-csv-filter/message"
+	"github.com/ONSdigital/dp-dd-csv-filter/message/event"
+	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
+	"github.com/ONSdigital/dp-dd-csv-filter/outbox"
+	"github.com/ONSdigital/dp-dd-csv-filter/tracing"
 	"github.com/ONSdigital/go-ns/log"
 	"github.com/Shopify/sarama"
 	"github.com/bsm/sarama-cluster"
 	"github.com/gorilla/pat"
 )
 
+// shutdownTimeout the longest time to wait for requests in progress to stop once the service is asked to stop.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	config.Load()
+	cfg, err := config.Load(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Error(err, nil)
+		os.Exit(1)
+	}
+	tracing.Configure(cfg)
 
-	// Trap SIGINT to trigger a graceful shutdown.
+	// Trap SIGINT and SIGTERM to trigger a graceful shutdown.
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	go func() {
-		<-signals
+	// Cancelled on shutdown, stopping every request in progress.
+	ctx, cancel := context.WithCancel(context.Background())
 
-		log.Debug("Graceful shutdown was successful.", nil)
-		os.Exit(0)
-	}()
+	kafkaConfig := message.NewKafkaConfig(cfg)
 
+	producerConfig := sarama.NewConfig()
+	producerConfig.Producer.Retry.Max = 5
+	producerConfig.Producer.RequiredAcks = sarama.WaitForAll
+	producerConfig.Producer.Return.Successes = true
+	producerConfig.Producer.Return.Errors = true
+	if err := kafkaConfig.Apply(producerConfig); err != nil {
+		log.Error(err, log.Data{"message": "Invalid Kafka configuration."})
+		os.Exit(1)
+	}
+
+	producer, err := sarama.NewSyncProducer(kafkaConfig.Brokers, producerConfig)
+	if err != nil {
+		log.Error(err, log.Data{"message": "Failed to create message producer."})
+		os.Exit(1)
+	}
+	store, err := outbox.NewStore(cfg.OutboxDir)
+	if err != nil {
+		log.Error(err, log.Data{"message": "Failed to open the outbox."})
+		os.Exit(1)
+	}
+	// Transform requests left in the outbox when the service last stopped are sent as soon as it starts.
+	transformOutbox := outbox.New(store, producer, outbox.NewRetryPolicy(cfg))
+	outboxStopped := make(chan struct{})
 	go func() {
-		router := pat.New()
-		router.Post("/filter", handlers.Handle)
-		if err := http.ListenAndServe(config.BindAddr, router); err != nil {
-			log.Error(err, nil)
-			os.Exit(1)
-		}
+		transformOutbox.Run(ctx.Done())
+		close(outboxStopped)
 	}()
 
-	kafkaConfig := sarama.NewConfig()
-	kafkaConfig.Producer.Retry.Max = 5
-	kafkaConfig.Producer.RequiredAcks = sarama.WaitForAll
-	kafkaConfig.Producer.Return.Successes = true
-	kafkaConfig.Producer.Return.Errors = true
+	service := handlers.NewFilterService(cfg, ons_aws.NewService(cfg), filter.NewCSVProcessor(), transformOutbox)
 
-	producer, err := sarama.NewSyncProducer([]string{config.KafkaAddr}, kafkaConfig)
+	router := pat.New()
+	router.Post("/filter/batch", service.HandleBatch)
+	router.Post("/filter", service.Handle)
+	requests := handlers.NewRequests(ctx)
+	listener, err := net.Listen("tcp", cfg.BindAddr)
 	if err != nil {
-		log.Error(err, log.Data{"message": "Failed to create message producer."})
+		log.Error(err, nil)
 		os.Exit(1)
 	}
-	handlers.SetProducer(producer)
+	go func() {
+		// Serve returns an error once the listener is closed on shutdown.
+		if err := http.Serve(listener, requests.Handler(router)); err != nil && ctx.Err() == nil {
+			log.Error(err, nil)
+			os.Exit(1)
+		}
+	}()
 
 	consumerConfig := cluster.NewConfig()
-	consumer, err := cluster.NewConsumer([]string{config.KafkaAddr}, config.KafkaConsumerGroup, []string{config.KafkaConsumerTopic}, consumerConfig)
+	if err := kafkaConfig.Apply(&consumerConfig.Config); err != nil {
+		log.Error(err, log.Data{"message": "Invalid Kafka configuration."})
+		os.Exit(1)
+	}
+	consumer, err := cluster.NewConsumer(kafkaConfig.Brokers, cfg.KafkaConsumerGroup, []string{cfg.KafkaConsumerTopic}, consumerConfig)
 	if err != nil {
 		log.Error(err, nil)
 		os.Exit(1)
 	}
-	message.ConsumerLoop(consumer, handlers.HandleRequest)
+	consumed := make(chan struct{})
+	go func() {
+		message.ConsumerLoop(ctx, consumer, event.NewSchemaRegistry(cfg.SchemaRegistryDir), service.HandleRequest, service.HandleBatchRequest)
+		// Closing the consumer commits the offsets of the messages processed.
+		if err := consumer.Close(); err != nil {
+			log.Error(err, log.Data{"message": "Failed to close the message consumer."})
+		}
+		close(consumed)
+	}()
+
+	<-signals
+	cancel()
+	listener.Close()
+	stopped := time.After(shutdownTimeout)
+	if !requests.Wait(shutdownTimeout) {
+		log.Debug("Requests in progress did not stop in time.", nil)
+	}
+	select {
+	case <-consumed:
+	case <-stopped:
+		log.Debug("The message in progress did not stop in time.", nil)
+	}
+	// Transform requests are sent as they are recorded, so the outbox has drained once it has stopped and the requests
+	// and message in progress have stopped. Any still unsent are kept in the outbox for the next run.
+	select {
+	case <-outboxStopped:
+	case <-stopped:
+		log.Debug("The outbox did not stop in time.", nil)
+	}
+	if err := producer.Close(); err != nil {
+		log.Error(err, log.Data{"message": "Failed to close the message producer."})
+	}
 
+	tracing.Flush()
+	log.Debug("Graceful shutdown was successful.", nil)
 }
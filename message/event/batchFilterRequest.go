@@ -0,0 +1,53 @@
+package event
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
+)
+
+var noOutputsErr = errors.New("A BatchFilterRequest must contain at least one output.")
+
+// BatchFilterRequest requests many filtered outputs from a single pass over one input file.
+type BatchFilterRequest struct {
+	RequestID string                 `json:"requestId"`
+	InputURL  ons_aws.S3URL          `json:"inputUrl"`
+	VersionID string                 `json:"versionId,omitempty"`
+	Outputs   []FilterOutput         `json:"outputs"`
+	Upload    *ons_aws.UploadOptions `json:"upload,omitempty"`
+	Trace     *TraceContext          `json:"trace,omitempty"`
+}
+
+// FilterOutput the dimensions to filter by and the location to send the result of one output of a BatchFilterRequest.
+type FilterOutput struct {
+	OutputURL  ons_aws.S3URL       `json:"outputUrl"`
+	Dimensions map[string][]string `json:"dimensions"`
+}
+
+// Validate checks the batch has at least one output and that no two outputs would overwrite each other.
+func (b *BatchFilterRequest) Validate() error {
+	if len(b.Outputs) < 1 {
+		return noOutputsErr
+	}
+	seen := make(map[string]bool)
+	for _, output := range b.Outputs {
+		if output.OutputURL.URL == nil {
+			return errors.New("Every output of a BatchFilterRequest must have an outputUrl.")
+		}
+		if seen[output.OutputURL.String()] {
+			return fmt.Errorf("Duplicate outputUrl in BatchFilterRequest: %s", output.OutputURL.String())
+		}
+		seen[output.OutputURL.String()] = true
+	}
+	return nil
+}
+
+// Input returns the input url, pinned to the requested version of the file if there is one.
+func (b *BatchFilterRequest) Input() (ons_aws.S3URL, error) {
+	return pinInput(b.InputURL, b.VersionID)
+}
+
+func (b *BatchFilterRequest) String() string {
+	return fmt.Sprintf(`BatchFilterRequest{RequestID: "%v", InputURL:"%s", Outputs: %d}`, b.RequestID, b.InputURL.String(), len(b.Outputs))
+}
@@ -0,0 +1,64 @@
+package event
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// The subjects of the messages the service consumes and produces.
+const (
+	FILTER_REQUEST_SUBJECT       = "filter-request"
+	BATCH_FILTER_REQUEST_SUBJECT = "batch-filter-request"
+	TRANSFORM_REQUEST_SUBJECT    = "transform-request"
+)
+
+// Envelope a message payload with the subject and version of the schema it was written with.
+type Envelope struct {
+	Schema  string          `json:"schema"`
+	Version int             `json:"version"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Encode writes v as an Envelope, after checking it is valid against the version of the subject's schema.
+func Encode(registry SchemaRegistry, subject string, version int, v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := validate(registry, subject, version, payload); err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{Schema: subject, Version: version, Payload: payload})
+}
+
+// Decode reads an Envelope, checking its payload is valid against its schema. A message that is not an Envelope, from
+// a producer that has not yet moved to envelopes, is read as the legacySubject, at the version given by its own
+// version field or otherwise version 1.
+func Decode(registry SchemaRegistry, data []byte, legacySubject string) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	if len(envelope.Schema) == 0 {
+		version := envelope.Version
+		if version == 0 {
+			version = 1
+		}
+		envelope = Envelope{Schema: legacySubject, Version: version, Payload: data}
+	}
+	if err := validate(registry, envelope.Schema, envelope.Version, envelope.Payload); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+func validate(registry SchemaRegistry, subject string, version int, payload []byte) error {
+	schema, err := registry.Schema(subject, version)
+	if err != nil {
+		return err
+	}
+	if err := schema.Validate(payload); err != nil {
+		return fmt.Errorf("Invalid version %d '%s' message: %s.", version, subject, err.Error())
+	}
+	return nil
+}
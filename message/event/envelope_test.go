@@ -0,0 +1,83 @@
+package event
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestEnvelope(t *testing.T) {
+
+	Convey("Given a transform request encoded in an envelope", t, func() {
+		input, _ := ons_aws.NewS3URL(inputUrl)
+		output, _ := ons_aws.NewS3URL(outputUrl)
+		message := NewTransformRequest(input, output, "requestId")
+
+		encoded, err := Encode(builtinRegistry, TRANSFORM_REQUEST_SUBJECT, message.Version, message)
+		So(err, ShouldBeNil)
+
+		Convey("Then it is decoded with its subject and version", func() {
+			envelope, err := Decode(builtinRegistry, encoded, FILTER_REQUEST_SUBJECT)
+			So(err, ShouldBeNil)
+			So(envelope.Schema, ShouldEqual, TRANSFORM_REQUEST_SUBJECT)
+			So(envelope.Version, ShouldEqual, TRANSFORM_REQUEST_VERSION)
+
+			var decoded TransformRequest
+			So(json.Unmarshal(envelope.Payload, &decoded), ShouldBeNil)
+			So(decoded.RequestID, ShouldEqual, "requestId")
+			So(decoded.InputURL.String(), ShouldEqual, inputUrl)
+		})
+	})
+
+	Convey("Given a filter request without an envelope", t, func() {
+		filterRequest, _ := NewFilterRequest("requestId", inputUrl, outputUrl, map[string][]string{"NACE": {"CI_0000072"}})
+		legacy, _ := json.Marshal(filterRequest)
+
+		Convey("Then it is decoded as version 1 of the legacy subject", func() {
+			envelope, err := Decode(builtinRegistry, legacy, FILTER_REQUEST_SUBJECT)
+			So(err, ShouldBeNil)
+			So(envelope.Schema, ShouldEqual, FILTER_REQUEST_SUBJECT)
+			So(envelope.Version, ShouldEqual, 1)
+			So(string(envelope.Payload), ShouldEqual, string(legacy))
+		})
+	})
+
+	Convey("Given messages that do not match their schema", t, func() {
+
+		Convey("Then they are rejected", func() {
+			_, err := Decode(builtinRegistry, []byte(`{"schema": "filter-request", "version": 1, "payload": {"inputUrl": "s3://bucket/file.csv"}}`), FILTER_REQUEST_SUBJECT)
+			So(err, ShouldNotBeNil)
+			_, err = Decode(builtinRegistry, []byte(`{"inputUrl": "s3://bucket/file.csv", "outputUrl": "s3://bucket/out.csv", "limit": "ten"}`), FILTER_REQUEST_SUBJECT)
+			So(err, ShouldNotBeNil)
+			_, err = Decode(builtinRegistry, []byte(`{"schema": "filter-request", "version": 9, "payload": {}}`), FILTER_REQUEST_SUBJECT)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFileRegistry(t *testing.T) {
+
+	Convey("Given a directory of schemas", t, func() {
+		dir, _ := ioutil.TempDir("", "schemas")
+		defer os.RemoveAll(dir)
+		os.MkdirAll(filepath.Join(dir, FILTER_REQUEST_SUBJECT), 0755)
+		ioutil.WriteFile(filepath.Join(dir, FILTER_REQUEST_SUBJECT, "v2.json"), []byte(`{"type": "object", "required": ["priority"]}`), 0644)
+		registry := NewFileRegistry(dir)
+
+		Convey("Then messages are validated against the schema in the file", func() {
+			_, err := Decode(registry, []byte(`{"schema": "filter-request", "version": 2, "payload": {"priority": 1}}`), FILTER_REQUEST_SUBJECT)
+			So(err, ShouldBeNil)
+			_, err = Decode(registry, []byte(`{"schema": "filter-request", "version": 2, "payload": {}}`), FILTER_REQUEST_SUBJECT)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Then a missing schema is an error", func() {
+			_, err := registry.Schema(FILTER_REQUEST_SUBJECT, 1)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -3,15 +3,24 @@ package event
 import (
 	"fmt"
 
+	"github.com/ONSdigital/dp-dd-csv-filter/filter"
 	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
 	"github.com/ONSdigital/go-ns/log"
 )
 
 type FilterRequest struct {
-	RequestID  string              `json:"requestId"`
-	InputURL   ons_aws.S3URL           `json:"inputUrl"`
-	OutputURL  ons_aws.S3URL           `json:"outputUrl"`
-	Dimensions map[string][]string `json:"dimensions"`
+	RequestID  string                 `json:"requestId"`
+	InputURL   ons_aws.S3URL          `json:"inputUrl"`
+	VersionID  string                 `json:"versionId,omitempty"`
+	OutputURL  ons_aws.S3URL          `json:"outputUrl"`
+	Dimensions map[string][]string    `json:"dimensions"`
+	Limit      int                    `json:"limit,omitempty"`
+	Offset     int                    `json:"offset,omitempty"`
+	Sample     *filter.Sample         `json:"sample,omitempty"`
+	Sort       []filter.SortKey       `json:"sort,omitempty"`
+	Duplicates string                 `json:"duplicates,omitempty"`
+	Upload     *ons_aws.UploadOptions `json:"upload,omitempty"`
+	Trace      *TraceContext          `json:"trace,omitempty"`
 }
 
 var NilRequest = FilterRequest{}
@@ -30,6 +39,16 @@ func NewFilterRequest(requestId string, inputUrl string, outputUrl string, dimen
 	return FilterRequest{RequestID: requestId, InputURL: input, OutputURL: output, Dimensions: dimensions}, nil
 }
 
+// FilterOptions returns the options to pass to the filter.CSVProcessor for this request.
+func (f *FilterRequest) FilterOptions() filter.Options {
+	return filter.Options{Limit: f.Limit, Offset: f.Offset, Sample: f.Sample, Sort: f.Sort, Duplicates: f.Duplicates}
+}
+
+// Input returns the input url, pinned to the requested version of the file if there is one.
+func (f *FilterRequest) Input() (ons_aws.S3URL, error) {
+	return pinInput(f.InputURL, f.VersionID)
+}
+
 func (f *FilterRequest) String() string {
 	return fmt.Sprintf(`FilterRequest{RequestID: "%v", InputURL:"%s", OutputURL: "%s", Dimensions: %v}`, f.RequestID, f.InputURL.String(), f.OutputURL.String(), f.Dimensions)
 }
@@ -77,3 +77,22 @@ func TestString(t *testing.T) {
 		})
 	})
 }
+
+func TestFilterRequestInput(t *testing.T) {
+
+	Convey("Given a filterRequest with a versionId", t, func() {
+		var filterRequest, _ = NewFilterRequest("requestId", inputUrl, outputUrl, map[string][]string{})
+		filterRequest.VersionID = "v1"
+
+		Convey("Then the input is pinned to the version", func() {
+			input, err := filterRequest.Input()
+			So(err, ShouldBeNil)
+			So(input.GetVersionID(), ShouldEqual, "v1")
+		})
+		Convey("Then a different version in the inputUrl is rejected", func() {
+			filterRequest.InputURL = filterRequest.InputURL.WithVersionID("v2")
+			_, err := filterRequest.Input()
+			So(err, ShouldEqual, versionMismatchErr)
+		})
+	})
+}
@@ -0,0 +1,75 @@
+package event
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SchemaRegistry provides the schema of each version of each message.
+type SchemaRegistry interface {
+	// Schema returns the schema of the version of the subject.
+	Schema(subject string, version int) (*Schema, error)
+}
+
+// NewSchemaRegistry returns the schemas built into the service, or a FileRegistry reading the directory if one is
+// given.
+func NewSchemaRegistry(dir string) SchemaRegistry {
+	if len(dir) > 0 {
+		return NewFileRegistry(dir)
+	}
+	return builtinRegistry
+}
+
+// MapRegistry a SchemaRegistry holding schemas in memory, keyed by subject then version.
+type MapRegistry map[string]map[int]*Schema
+
+func (r MapRegistry) Schema(subject string, version int) (*Schema, error) {
+	schema, ok := r[subject][version]
+	if !ok {
+		return nil, fmt.Errorf("No schema for version %d of '%s'.", version, subject)
+	}
+	return schema, nil
+}
+
+// FileRegistry a SchemaRegistry reading schemas from files named <dir>/<subject>/v<version>.json, a stand-in for a
+// schema registry service when running locally. Each schema is read once.
+type FileRegistry struct {
+	dir     string
+	mutex   sync.Mutex
+	schemas MapRegistry
+}
+
+// NewFileRegistry create a FileRegistry reading schemas from the directory.
+func NewFileRegistry(dir string) *FileRegistry {
+	return &FileRegistry{dir: dir, schemas: make(MapRegistry)}
+}
+
+func (r *FileRegistry) Schema(subject string, version int) (*Schema, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if schema, err := r.schemas.Schema(subject, version); err == nil {
+		return schema, nil
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(r.dir, subject, fmt.Sprintf("v%d.json", version)))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("No schema for version %d of '%s'.", version, subject)
+	}
+	if err != nil {
+		return nil, err
+	}
+	schema, err := ParseSchema(b)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid schema for version %d of '%s': %s", version, subject, err.Error())
+	}
+
+	if r.schemas[subject] == nil {
+		r.schemas[subject] = make(map[int]*Schema)
+	}
+	r.schemas[subject][version] = schema
+	return schema, nil
+}
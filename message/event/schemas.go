@@ -0,0 +1,136 @@
+package event
+
+// The schemas built into the service. A new version of a message may only add optional properties to the previous
+// version, so that it can be read by consumers of the previous version.
+
+const uploadSchema = `{
+	"type": ["object", "null"],
+	"properties": {
+		"serverSideEncryption": {"type": "string"},
+		"storageClass": {"type": "string"},
+		"acl": {"type": "string"},
+		"tags": {"type": ["object", "null"], "additionalProperties": {"type": "string"}}
+	}
+}`
+
+const dimensionsSchema = `{
+	"type": ["object", "null"],
+	"additionalProperties": {"type": ["array", "null"], "items": {"type": "string"}}
+}`
+
+const traceSchema = `{
+	"type": ["object", "null"],
+	"required": ["traceparent"],
+	"properties": {"traceparent": {"type": "string"}, "tracestate": {"type": "string"}}
+}`
+
+const filterRequestV1 = `{
+	"title": "FilterRequest",
+	"type": "object",
+	"required": ["inputUrl", "outputUrl"],
+	"properties": {
+		"requestId": {"type": "string"},
+		"inputUrl": {"type": "string"},
+		"versionId": {"type": "string"},
+		"outputUrl": {"type": "string"},
+		"dimensions": ` + dimensionsSchema + `,
+		"limit": {"type": "integer"},
+		"offset": {"type": "integer"},
+		"sample": {
+			"type": ["object", "null"],
+			"required": ["rate"],
+			"properties": {"rate": {"type": "number"}, "seed": {"type": ["integer", "null"]}}
+		},
+		"sort": {
+			"type": ["array", "null"],
+			"items": {
+				"type": "object",
+				"required": ["dimension"],
+				"properties": {"dimension": {"type": "string"}, "descending": {"type": "boolean"}}
+			}
+		},
+		"duplicates": {"type": "string", "enum": ["", "first", "last", "fail"]},
+		"upload": ` + uploadSchema + `,
+		"trace": ` + traceSchema + `
+	}
+}`
+
+const batchFilterRequestV1 = `{
+	"title": "BatchFilterRequest",
+	"type": "object",
+	"required": ["inputUrl", "outputs"],
+	"properties": {
+		"requestId": {"type": "string"},
+		"inputUrl": {"type": "string"},
+		"versionId": {"type": "string"},
+		"outputs": {
+			"type": "array",
+			"items": {
+				"type": "object",
+				"required": ["outputUrl"],
+				"properties": {"outputUrl": {"type": "string"}, "dimensions": ` + dimensionsSchema + `}
+			}
+		},
+		"upload": ` + uploadSchema + `,
+		"trace": ` + traceSchema + `
+	}
+}`
+
+const transformRequestV1 = `{
+	"title": "TransformRequest",
+	"type": "object",
+	"required": ["inputUrl", "outputUrl", "requestId"],
+	"properties": {
+		"inputUrl": {"type": "string"},
+		"outputUrl": {"type": "string"},
+		"requestId": {"type": "string"},
+		"report": {"type": ["object", "null"]}
+	}
+}`
+
+const transformRequestV2 = `{
+	"title": "TransformRequest",
+	"type": "object",
+	"required": ["version", "inputUrl", "outputUrl", "requestId"],
+	"properties": {
+		"version": {"type": "integer", "enum": [2]},
+		"inputUrl": {"type": "string"},
+		"outputUrl": {"type": "string"},
+		"requestId": {"type": "string"},
+		"report": {"type": ["object", "null"]},
+		"source": {
+			"type": ["object", "null"],
+			"required": ["url"],
+			"properties": {"url": {"type": "string"}, "versionId": {"type": "string"}, "eTag": {"type": "string"}}
+		},
+		"checksum": {
+			"type": ["object", "null"],
+			"required": ["sha256", "size", "rowCount"],
+			"properties": {"sha256": {"type": "string"}, "size": {"type": "integer"}, "rowCount": {"type": "integer"}}
+		},
+		"filter": {
+			"type": ["object", "null"],
+			"properties": {"dimensions": ` + dimensionsSchema + `}
+		},
+		"format": {
+			"type": ["object", "null"],
+			"required": ["type", "layout"],
+			"properties": {"type": {"type": "string"}, "layout": {"type": "string"}}
+		},
+		"trace": ` + traceSchema + `
+	}
+}`
+
+var builtinRegistry = MapRegistry{
+	FILTER_REQUEST_SUBJECT:       {1: mustParseSchema(filterRequestV1)},
+	BATCH_FILTER_REQUEST_SUBJECT: {1: mustParseSchema(batchFilterRequestV1)},
+	TRANSFORM_REQUEST_SUBJECT:    {1: mustParseSchema(transformRequestV1), 2: mustParseSchema(transformRequestV2)},
+}
+
+func mustParseSchema(s string) *Schema {
+	schema, err := ParseSchema([]byte(s))
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
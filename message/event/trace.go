@@ -0,0 +1,63 @@
+package event
+
+import (
+	"github.com/ONSdigital/dp-dd-csv-filter/tracing"
+)
+
+// The HTTP headers carrying the request ID and the W3C trace context.
+const (
+	REQUEST_ID_HEADER  = "X-Request-Id"
+	TRACEPARENT_HEADER = "traceparent"
+	TRACESTATE_HEADER  = "tracestate"
+)
+
+// TraceContext the W3C trace context (https://www.w3.org/TR/trace-context/) of a request, carried with it so that the
+// request can be followed from the splitter, through the filter, to the transformer.
+type TraceContext struct {
+	TraceParent string `json:"traceparent"`
+	TraceState  string `json:"tracestate,omitempty"`
+}
+
+// NewTraceContext starts a new trace.
+func NewTraceContext() *TraceContext {
+	return &TraceContext{TraceParent: tracing.FormatTraceParent(tracing.NewTraceID(), tracing.NewSpanID(), "01")}
+}
+
+// ParseTraceContext returns the trace context given by the traceparent and tracestate, or nil if the traceparent is
+// not valid.
+func ParseTraceContext(traceParent string, traceState string) *TraceContext {
+	if _, _, _, ok := tracing.ParseTraceParent(traceParent); !ok {
+		return nil
+	}
+	return &TraceContext{TraceParent: traceParent, TraceState: traceState}
+}
+
+// TraceID returns the ID shared by every part of the trace, or "" if there is no valid trace.
+func (t *TraceContext) TraceID() string {
+	if t == nil {
+		return ""
+	}
+	traceID, _, _, _ := tracing.ParseTraceParent(t.TraceParent)
+	return traceID
+}
+
+// WithParent returns the trace context to send on from this service: the same trace, with the span as the parent.
+func (t *TraceContext) WithParent(span *tracing.Span) *TraceContext {
+	child := &TraceContext{TraceParent: span.TraceParent()}
+	if t != nil {
+		child.TraceState = t.TraceState
+	}
+	return child
+}
+
+// Correlate returns the request ID and trace context to use for a request, starting a new trace if it has none, and
+// using the trace ID as the request ID if it has none.
+func Correlate(requestID string, trace *TraceContext) (string, *TraceContext) {
+	if trace == nil || len(trace.TraceID()) == 0 {
+		trace = NewTraceContext()
+	}
+	if len(requestID) == 0 {
+		requestID = trace.TraceID()
+	}
+	return requestID, trace
+}
@@ -0,0 +1,57 @@
+package event
+
+import (
+	"testing"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/tracing"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceContext(t *testing.T) {
+
+	Convey("Given a valid traceparent", t, func() {
+		trace := ParseTraceContext(traceParent, "congo=t61rcWkgMzE")
+
+		Convey("Then the trace id is read from it", func() {
+			So(trace, ShouldNotBeNil)
+			So(trace.TraceID(), ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+		})
+
+		Convey("Then the trace sent on from a span has the same trace id and state, with the span as the parent", func() {
+			span := tracing.StartRequest("requestId", "test", tracing.KIND_INTERNAL, trace.TraceParent)
+			defer span.End()
+			child := trace.WithParent(span)
+			So(child.TraceID(), ShouldEqual, trace.TraceID())
+			So(child.TraceState, ShouldEqual, "congo=t61rcWkgMzE")
+			So(child.TraceParent, ShouldEqual, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.SpanID+"-01")
+		})
+	})
+
+	Convey("Invalid traceparents should be ignored", t, func() {
+		So(ParseTraceContext("", ""), ShouldBeNil)
+		So(ParseTraceContext("00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""), ShouldBeNil)
+		So(ParseTraceContext("00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", ""), ShouldBeNil)
+		So(ParseTraceContext("ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ""), ShouldBeNil)
+	})
+
+	Convey("Given a request without a request id or trace", t, func() {
+		requestID, trace := Correlate("", nil)
+
+		Convey("Then a new trace is started and its id used as the request id", func() {
+			So(trace, ShouldNotBeNil)
+			So(len(trace.TraceID()), ShouldEqual, 32)
+			So(requestID, ShouldEqual, trace.TraceID())
+		})
+	})
+
+	Convey("Given a request with a request id and trace", t, func() {
+		requestID, trace := Correlate("requestId", ParseTraceContext(traceParent, ""))
+
+		Convey("Then both are kept", func() {
+			So(requestID, ShouldEqual, "requestId")
+			So(trace.TraceParent, ShouldEqual, traceParent)
+		})
+	})
+}
@@ -3,20 +3,85 @@ package event
 import (
 	"fmt"
 
+	"github.com/ONSdigital/dp-dd-csv-filter/filter"
 	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
 )
 
+// TRANSFORM_REQUEST_VERSION the version of the TransformRequest message. Fields are only added to the message, never
+// changed or removed, so consumers of an older version can ignore the fields they do not know. Messages without a
+// version are version 1.
+const TRANSFORM_REQUEST_VERSION = 2
+
+// FORMAT_CSV the format of filtered files.
+const FORMAT_CSV = "csv"
+
 type TransformRequest struct {
-	InputURL  ons_aws.S3URL `json:"inputUrl"`
-	OutputURL ons_aws.S3URL `json:"outputUrl"`
-	RequestID string    `json:"requestId"`
+	Version   int            `json:"version"`
+	InputURL  ons_aws.S3URL  `json:"inputUrl"`
+	OutputURL ons_aws.S3URL  `json:"outputUrl"`
+	RequestID string         `json:"requestId"`
+	Report    *filter.Report `json:"report,omitempty"`
+	Source    *SourceFile    `json:"source,omitempty"`
+	Checksum  *Checksum      `json:"checksum,omitempty"`
+	Filter    *Filter        `json:"filter,omitempty"`
+	Format    *Format        `json:"format,omitempty"`
+	Trace     *TraceContext  `json:"trace,omitempty"`
+}
+
+// SourceFile the version of the file that was filtered to produce the input of a TransformRequest.
+type SourceFile struct {
+	URL       ons_aws.S3URL `json:"url"`
+	VersionID string        `json:"versionId,omitempty"`
+	ETag      string        `json:"eTag,omitempty"`
+}
+
+// Checksum the SHA-256, size and number of data rows of the filtered file at the InputURL of a TransformRequest, so
+// the file can be validated before it is transformed.
+type Checksum struct {
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	RowCount int    `json:"rowCount"`
+}
+
+// Filter the dimensions and options that were applied to the source file.
+type Filter struct {
+	Dimensions map[string][]string `json:"dimensions"`
+	Limit      int                 `json:"limit,omitempty"`
+	Offset     int                 `json:"offset,omitempty"`
+	Sample     *filter.Sample      `json:"sample,omitempty"`
+	Sort       []filter.SortKey    `json:"sort,omitempty"`
+	Duplicates string              `json:"duplicates,omitempty"`
+}
+
+// NewFilter creates the Filter describing the dimensions and options.
+func NewFilter(dimensions map[string][]string, options filter.Options) *Filter {
+	return &Filter{
+		Dimensions: dimensions,
+		Limit:      options.Limit,
+		Offset:     options.Offset,
+		Sample:     options.Sample,
+		Sort:       options.Sort,
+		Duplicates: options.Duplicates,
+	}
+}
+
+// Format the format and layout of the filtered file at the InputURL of a TransformRequest.
+type Format struct {
+	Type   string `json:"type"`
+	Layout string `json:"layout"`
 }
 
 // NewTransformRequest creates a new TranformRequest object.
 func NewTransformRequest(inputUrl ons_aws.S3URL, outputUrl ons_aws.S3URL, requestId string) TransformRequest {
-	return TransformRequest{InputURL: inputUrl, OutputURL: outputUrl, RequestID: requestId}
+	return TransformRequest{
+		Version:   TRANSFORM_REQUEST_VERSION,
+		InputURL:  inputUrl,
+		OutputURL: outputUrl,
+		RequestID: requestId,
+		Format:    &Format{Type: FORMAT_CSV, Layout: filter.LAYOUT_VERSION},
+	}
 }
 
 func (f *TransformRequest) String() string {
-	return fmt.Sprintf(`TransformRequest{RequestID: "%v", InputURL:"%s", OutputURL: "%s"}`, f.RequestID, f.InputURL.String(), f.OutputURL.String())
+	return fmt.Sprintf(`TransformRequest{Version: %d, RequestID: "%v", InputURL:"%s", OutputURL: "%s"}`, f.Version, f.RequestID, f.InputURL.String(), f.OutputURL.String())
 }
@@ -0,0 +1,40 @@
+package event
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/filter"
+	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTransformRequest(t *testing.T) {
+
+	Convey("Given a new transform request with the filter that was applied", t, func() {
+		input, _ := ons_aws.NewS3URL(inputUrl)
+		output, _ := ons_aws.NewS3URL(outputUrl)
+		message := NewTransformRequest(input, output, "requestId")
+		message.Filter = NewFilter(map[string][]string{"NACE": {"CI_0000072"}}, filter.Options{Limit: 10, TempDir: "/var/tmp"})
+
+		Convey("Then the version, format and filter are included in the json", func() {
+			messageJSON, err := json.Marshal(message)
+			So(err, ShouldBeNil)
+			So(string(messageJSON), ShouldContainSubstring, `"version":2`)
+			So(string(messageJSON), ShouldContainSubstring, `"filter":{"dimensions":{"NACE":["CI_0000072"]},"limit":10}`)
+			So(string(messageJSON), ShouldContainSubstring, `"format":{"type":"csv","layout":"v3"}`)
+		})
+	})
+
+	Convey("Given a version 1 transform request", t, func() {
+		messageJSON := `{"inputUrl":"` + inputUrl + `","outputUrl":"` + outputUrl + `","requestId":"requestId"}`
+
+		Convey("Then it can still be read", func() {
+			var message TransformRequest
+			So(json.Unmarshal([]byte(messageJSON), &message), ShouldBeNil)
+			So(message.Version, ShouldEqual, 0)
+			So(message.RequestID, ShouldEqual, "requestId")
+			So(message.Filter, ShouldBeNil)
+		})
+	})
+}
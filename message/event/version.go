@@ -0,0 +1,20 @@
+package event
+
+import (
+	"errors"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/ons_aws"
+)
+
+var versionMismatchErr = errors.New("The versionId of the request does not match the versionId of the inputUrl.")
+
+// pinInput returns the input url pinned to versionID. The version may also be given as a query parameter of the url.
+func pinInput(input ons_aws.S3URL, versionID string) (ons_aws.S3URL, error) {
+	if len(versionID) == 0 || input.URL == nil {
+		return input, nil
+	}
+	if urlVersionID := input.GetVersionID(); len(urlVersionID) > 0 && urlVersionID != versionID {
+		return ons_aws.NilS3URL, versionMismatchErr
+	}
+	return input.WithVersionID(versionID), nil
+}
@@ -0,0 +1,115 @@
+package message
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	"github.com/Shopify/sarama"
+)
+
+// The SASL mechanisms a KafkaConfig may name.
+const (
+	// SASL_PLAIN a user and password, sent in the clear unless TLS is used.
+	SASL_PLAIN = "PLAIN"
+	// SASL_SCRAM_SHA_256 and SASL_SCRAM_SHA_512 a user and password, proven to the broker without being sent.
+	SASL_SCRAM_SHA_256 = "SCRAM-SHA-256"
+	SASL_SCRAM_SHA_512 = "SCRAM-SHA-512"
+)
+
+// KafkaConfig how connections are made to the Kafka brokers, shared by the producer and the consumer.
+type KafkaConfig struct {
+	Brokers               []string
+	TLS                   bool
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSInsecureSkipVerify bool
+	SASLMechanism         string
+	SASLUser              string
+	SASLPassword          string
+}
+
+// NewKafkaConfig create a KafkaConfig from the configuration.
+func NewKafkaConfig(cfg *config.Config) KafkaConfig {
+	return KafkaConfig{
+		Brokers:               cfg.KafkaBrokers,
+		TLS:                   cfg.KafkaTLS,
+		TLSCAFile:             cfg.KafkaTLSCAFile,
+		TLSCertFile:           cfg.KafkaTLSCertFile,
+		TLSKeyFile:            cfg.KafkaTLSKeyFile,
+		TLSInsecureSkipVerify: cfg.KafkaTLSInsecureSkipVerify,
+		SASLMechanism:         cfg.KafkaSASLMechanism,
+		SASLUser:              cfg.KafkaSASLUser,
+		SASLPassword:          cfg.KafkaSASLPassword,
+	}
+}
+
+// Apply sets the TLS and SASL settings of the sarama configuration, of either the producer or the consumer.
+func (c KafkaConfig) Apply(saramaConfig *sarama.Config) error {
+	if len(c.Brokers) == 0 {
+		return errors.New("No Kafka brokers are configured.")
+	}
+
+	if c.TLS {
+		tlsConfig, err := c.tlsConfig()
+		if err != nil {
+			return err
+		}
+		saramaConfig.Net.TLS.Enable = true
+		saramaConfig.Net.TLS.Config = tlsConfig
+	}
+
+	mechanism := strings.ToUpper(c.SASLMechanism)
+	switch mechanism {
+	case "":
+		return nil
+	case SASL_PLAIN:
+	case SASL_SCRAM_SHA_256, SASL_SCRAM_SHA_512:
+		saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = scramClientGenerator(mechanism)
+	default:
+		return fmt.Errorf("Unknown SASL mechanism '%s'.", c.SASLMechanism)
+	}
+	if len(c.SASLUser) == 0 || len(c.SASLPassword) == 0 {
+		return fmt.Errorf("A user and password are required for SASL/%s.", mechanism)
+	}
+	saramaConfig.Net.SASL.Enable = true
+	saramaConfig.Net.SASL.Handshake = true
+	saramaConfig.Net.SASL.Mechanism = sarama.SASLMechanism(mechanism)
+	saramaConfig.Net.SASL.User = c.SASLUser
+	saramaConfig.Net.SASL.Password = c.SASLPassword
+	return nil
+}
+
+// tlsConfig the TLS configuration trusting the configured certificate authorities and presenting the client
+// certificate, if any.
+func (c KafkaConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.TLSInsecureSkipVerify}
+
+	if len(c.TLSCAFile) > 0 {
+		pem, err := ioutil.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in '%s'.", c.TLSCAFile)
+		}
+	}
+
+	if len(c.TLSCertFile) > 0 || len(c.TLSKeyFile) > 0 {
+		if len(c.TLSCertFile) == 0 || len(c.TLSKeyFile) == 0 {
+			return nil, errors.New("A client certificate and its key must both be given.")
+		}
+		certificate, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
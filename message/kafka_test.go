@@ -0,0 +1,123 @@
+package message_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/message"
+	"github.com/Shopify/sarama"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeCertificate writes a self signed certificate and its key to PEM files in the directory.
+func writeCertificate(dir string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafka"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestKafkaConfig(t *testing.T) {
+
+	Convey("Given a Kafka configuration with TLS and a client certificate", t, func() {
+		dir, _ := ioutil.TempDir("", "kafka")
+		defer os.RemoveAll(dir)
+		certFile, keyFile := writeCertificate(dir)
+		kafkaConfig := message.KafkaConfig{Brokers: []string{"b-1:9094", "b-2:9094"}, TLS: true, TLSCAFile: certFile, TLSCertFile: certFile, TLSKeyFile: keyFile}
+
+		Convey("Then it is applied to the sarama configuration", func() {
+			saramaConfig := sarama.NewConfig()
+			So(kafkaConfig.Apply(saramaConfig), ShouldBeNil)
+			So(saramaConfig.Net.TLS.Enable, ShouldBeTrue)
+			So(len(saramaConfig.Net.TLS.Config.Certificates), ShouldEqual, 1)
+			So(saramaConfig.Net.TLS.Config.RootCAs, ShouldNotBeNil)
+			So(saramaConfig.Net.SASL.Enable, ShouldBeFalse)
+			So(saramaConfig.Validate(), ShouldBeNil)
+		})
+
+		Convey("Then a certificate without its key is rejected", func() {
+			kafkaConfig.TLSKeyFile = ""
+			err := kafkaConfig.Apply(sarama.NewConfig())
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "A client certificate and its key must both be given.")
+		})
+
+		Convey("Then a CA file without certificates is rejected", func() {
+			kafkaConfig.TLSCAFile = keyFile
+			err := kafkaConfig.Apply(sarama.NewConfig())
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "No certificates found in '"+keyFile+"'.")
+		})
+	})
+
+	Convey("Given a Kafka configuration with SASL/PLAIN", t, func() {
+		kafkaConfig := message.KafkaConfig{Brokers: []string{"localhost:9092"}, SASLMechanism: "plain", SASLUser: "user", SASLPassword: "password"}
+
+		Convey("Then it is applied to the sarama configuration", func() {
+			saramaConfig := sarama.NewConfig()
+			So(kafkaConfig.Apply(saramaConfig), ShouldBeNil)
+			So(saramaConfig.Net.SASL.Enable, ShouldBeTrue)
+			So(saramaConfig.Net.SASL.User, ShouldEqual, "user")
+			So(saramaConfig.Net.SASL.Password, ShouldEqual, "password")
+			So(saramaConfig.Net.TLS.Enable, ShouldBeFalse)
+		})
+
+		Convey("Then a missing password is rejected", func() {
+			kafkaConfig.SASLPassword = ""
+			So(kafkaConfig.Apply(sarama.NewConfig()), ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a Kafka configuration with SASL/SCRAM", t, func() {
+		kafkaConfig := message.KafkaConfig{Brokers: []string{"localhost:9092"}, TLS: true, SASLMechanism: "scram-sha-512", SASLUser: "user", SASLPassword: "password"}
+
+		Convey("Then it is applied to the sarama configuration", func() {
+			saramaConfig := sarama.NewConfig()
+			So(kafkaConfig.Apply(saramaConfig), ShouldBeNil)
+			So(saramaConfig.Net.SASL.Enable, ShouldBeTrue)
+			So(saramaConfig.Net.SASL.Mechanism, ShouldEqual, sarama.SASLTypeSCRAMSHA512)
+			So(saramaConfig.Net.SASL.SCRAMClientGeneratorFunc, ShouldNotBeNil)
+			So(saramaConfig.Net.SASL.User, ShouldEqual, "user")
+			So(saramaConfig.Validate(), ShouldBeNil)
+		})
+
+		Convey("Then a missing user is rejected", func() {
+			kafkaConfig.SASLUser = ""
+			err := kafkaConfig.Apply(sarama.NewConfig())
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "A user and password are required for SASL/SCRAM-SHA-512.")
+		})
+	})
+
+	Convey("An unknown SASL mechanism should be rejected", t, func() {
+		err := message.KafkaConfig{Brokers: []string{"localhost:9092"}, SASLMechanism: "GSSAPI"}.Apply(sarama.NewConfig())
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "Unknown SASL mechanism 'GSSAPI'.")
+	})
+
+	Convey("A configuration without brokers should be rejected", t, func() {
+		So(message.KafkaConfig{}.Apply(sarama.NewConfig()), ShouldNotBeNil)
+	})
+}
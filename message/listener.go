@@ -1,34 +1,127 @@
 package message
 
 import (
+	"context"
 	"encoding/json"
 
 	"fmt"
 
 	"github.com/ONSdigital/dp-dd-csv-filter/handlers"
 	"github.com/ONSdigital/dp-dd-csv-filter/message/event"
+	"github.com/ONSdigital/dp-dd-csv-filter/tracing"
 	"github.com/ONSdigital/go-ns/log"
 	"github.com/Shopify/sarama"
 )
 
-func ConsumerLoop(listener Listener, filterer handlers.FilterFunc) {
-	for message := range listener.Messages() {
-		log.Debug("Message received from Kafka: "+string(message.Value), nil)
-		processMessage(message, filterer)
+// ConsumerLoop processes each message from the listener, checking it against its schema in the registry, until the
+// listener is closed or ctx is done. The message being processed is cancelled when ctx is done.
+func ConsumerLoop(ctx context.Context, listener Listener, registry event.SchemaRegistry, filterer handlers.FilterFunc, batchFilterer handlers.BatchFilterFunc) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message, ok := <-listener.Messages():
+			if !ok {
+				return
+			}
+			log.DebugC(messageRequestID(message.Value), "Message received from Kafka: "+string(message.Value), nil)
+			processMessage(ctx, message, registry, filterer, batchFilterer)
+		}
 	}
 }
 
-func processMessage(message *sarama.ConsumerMessage, filterer handlers.FilterFunc) error {
+func processMessage(ctx context.Context, message *sarama.ConsumerMessage, registry event.SchemaRegistry, filterer handlers.FilterFunc, batchFilterer handlers.BatchFilterFunc) error {
+
+	envelope, err := event.Decode(registry, message.Value, legacySubject(message.Value))
+	if err != nil {
+		log.ErrorC(messageRequestID(message.Value), err, nil)
+		return err
+	}
+
+	switch envelope.Schema {
+	case event.FILTER_REQUEST_SUBJECT:
+		return processFilterMessage(ctx, message, envelope.Payload, filterer)
+	case event.BATCH_FILTER_REQUEST_SUBJECT:
+		return processBatchMessage(ctx, message, envelope.Payload, batchFilterer)
+	}
+
+	err = fmt.Errorf("Unexpected '%s' message.", envelope.Schema)
+	log.ErrorC(messageRequestID(message.Value), err, nil)
+	return err
+}
+
+// startMessageSpan starts the span of a consumed message, within which the message is processed.
+func startMessageSpan(message *sarama.ConsumerMessage, requestID string, trace *event.TraceContext) *tracing.Span {
+	span := tracing.StartRequest(requestID, message.Topic+" process", tracing.KIND_CONSUMER, trace.TraceParent)
+	span.SetAttribute("messaging.destination", message.Topic)
+	span.SetAttribute("messaging.kafka.partition", int(message.Partition))
+	span.SetAttribute("messaging.kafka.offset", message.Offset)
+	span.SetAttribute(tracing.BYTES, len(message.Value))
+	return span
+}
+
+// messageRequestID returns the request ID of a message, with or without an envelope, so that it can be logged before
+// the message has been read.
+func messageRequestID(value []byte) string {
+	var message struct {
+		RequestID string `json:"requestId"`
+		Payload   struct {
+			RequestID string `json:"requestId"`
+		} `json:"payload"`
+	}
+	json.Unmarshal(value, &message)
+	if len(message.RequestID) > 0 {
+		return message.RequestID
+	}
+	return message.Payload.RequestID
+}
+
+// legacySubject returns the subject of a message sent without an envelope. A BatchFilterRequest is distinguished from
+// a FilterRequest by its list of outputs.
+func legacySubject(value []byte) string {
+	var outputs struct {
+		Outputs json.RawMessage `json:"outputs"`
+	}
+	if err := json.Unmarshal(value, &outputs); err == nil && outputs.Outputs != nil {
+		return event.BATCH_FILTER_REQUEST_SUBJECT
+	}
+	return event.FILTER_REQUEST_SUBJECT
+}
+
+func processFilterMessage(ctx context.Context, message *sarama.ConsumerMessage, payload []byte, filterer handlers.FilterFunc) error {
 
 	var filterRequest event.FilterRequest
-	if err := json.Unmarshal(message.Value, &filterRequest); err != nil {
+	if err := json.Unmarshal(payload, &filterRequest); err != nil {
+		log.Error(err, nil)
+		return err
+	}
+
+	filterRequest.RequestID, filterRequest.Trace = event.Correlate(filterRequest.RequestID, filterRequest.Trace)
+	traceData := log.Data{"traceId": filterRequest.Trace.TraceID()}
+	span := startMessageSpan(message, filterRequest.RequestID, filterRequest.Trace)
+	defer span.End()
+	log.DebugC(filterRequest.RequestID, fmt.Sprintf("About to process:%s", filterRequest.String()), traceData)
+	filterer(ctx, filterRequest)
+	log.DebugC(filterRequest.RequestID, fmt.Sprintf("Finished processing:%s", filterRequest.String()), traceData)
+
+	return nil
+}
+
+func processBatchMessage(ctx context.Context, message *sarama.ConsumerMessage, payload []byte, batchFilterer handlers.BatchFilterFunc) error {
+
+	var batchRequest event.BatchFilterRequest
+	if err := json.Unmarshal(payload, &batchRequest); err != nil {
 		log.Error(err, nil)
 		return err
 	}
 
-	log.Debug(fmt.Sprintf("About to process:%s", filterRequest.String()), nil)
-	filterer(filterRequest)
-	log.Debug(fmt.Sprintf("Finished processing:%s", filterRequest.String()), nil)
+	batchRequest.RequestID, batchRequest.Trace = event.Correlate(batchRequest.RequestID, batchRequest.Trace)
+	traceData := log.Data{"traceId": batchRequest.Trace.TraceID()}
+	span := startMessageSpan(message, batchRequest.RequestID, batchRequest.Trace)
+	defer span.End()
+	log.DebugC(batchRequest.RequestID, fmt.Sprintf("About to process:%s", batchRequest.String()), traceData)
+	batchFilterer(ctx, batchRequest)
+	log.DebugC(batchRequest.RequestID, fmt.Sprintf("Finished processing:%s", batchRequest.String()), traceData)
 
 	return nil
 }
@@ -1,6 +1,7 @@
 package message_test
 
 import (
+	"context"
 	"encoding/json"
 	"testing"
 	"time"
@@ -13,13 +14,20 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+var schemaRegistry = event.NewSchemaRegistry("")
 var messagesProcessed = 0
+var batchMessagesProcessed = 0
 
-func mockFilterFunc(filterRequest event.FilterRequest) handlers.FilterResponse {
+func mockFilterFunc(ctx context.Context, filterRequest event.FilterRequest) handlers.FilterResponse {
 	messagesProcessed++
 	return handlers.FilterResponse{Message: "done"}
 }
 
+func mockBatchFilterFunc(ctx context.Context, batchRequest event.BatchFilterRequest) handlers.FilterResponse {
+	batchMessagesProcessed++
+	return handlers.FilterResponse{Message: "done"}
+}
+
 func TestProcessor(t *testing.T) {
 	event, _ := event.NewFilterRequest(
 		"requestId",
@@ -46,7 +54,8 @@ func TestProcessor(t *testing.T) {
 
 	Convey("Given a mock consumer and filterer", t, func() {
 		messagesProcessed = 0
-		go message.ConsumerLoop(mockListener, mockFilterFunc)
+		batchMessagesProcessed = 0
+		go message.ConsumerLoop(context.Background(), mockListener, schemaRegistry, mockFilterFunc, mockBatchFilterFunc)
 		loop := 0
 
 		// Give this at least 300 milli-seconds to run before asserting the message was processed
@@ -58,6 +67,68 @@ func TestProcessor(t *testing.T) {
 			loop++
 		}
 		So(messagesProcessed, ShouldEqual, 1)
+		So(batchMessagesProcessed, ShouldEqual, 0)
+		mockConsumer.Close()
+	})
+
+}
+
+func TestBatchProcessor(t *testing.T) {
+	messageJson := []byte(`{"requestId": "requestId", "inputUrl": "s3://bucket/file.csv", "outputs": [{"outputUrl": "s3://bucket/a.csv", "dimensions": {"NACE": ["CI_0000072"]}}]}`)
+	topicName := "filter-request"
+	mockConsumer := mocks.NewConsumer(t, nil)
+	mockConsumer.ExpectConsumePartition(topicName, 0, 0).YieldMessage(&sarama.ConsumerMessage{Value: messageJson})
+
+	mockListener := newMocklistener(mockConsumer, topicName)
+
+	Convey("Given a mock consumer and batch filterer", t, func() {
+		messagesProcessed = 0
+		batchMessagesProcessed = 0
+		go message.ConsumerLoop(context.Background(), mockListener, schemaRegistry, mockFilterFunc, mockBatchFilterFunc)
+		loop := 0
+
+		// Give this at least 300 milli-seconds to run before asserting the message was processed
+		for loop < 3 {
+			if batchMessagesProcessed >= 1 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+			loop++
+		}
+		So(batchMessagesProcessed, ShouldEqual, 1)
+		So(messagesProcessed, ShouldEqual, 0)
+		mockConsumer.Close()
+	})
+
+}
+
+func TestEnvelopedProcessor(t *testing.T) {
+	messageJson := []byte(`{"schema": "batch-filter-request", "version": 1, "payload": {"requestId": "requestId", "inputUrl": "s3://bucket/file.csv", "outputs": [{"outputUrl": "s3://bucket/a.csv", "dimensions": {"NACE": ["CI_0000072"]}}]}}`)
+	invalidJson := []byte(`{"schema": "filter-request", "version": 1, "payload": {"requestId": "requestId", "inputUrl": "s3://bucket/file.csv"}}`)
+	topicName := "filter-request"
+	mockConsumer := mocks.NewConsumer(t, nil)
+	partition := mockConsumer.ExpectConsumePartition(topicName, 0, 0)
+	partition.YieldMessage(&sarama.ConsumerMessage{Value: invalidJson})
+	partition.YieldMessage(&sarama.ConsumerMessage{Value: messageJson})
+
+	mockListener := newMocklistener(mockConsumer, topicName)
+
+	Convey("Given a mock consumer yielding an invalid message and an enveloped batch message", t, func() {
+		messagesProcessed = 0
+		batchMessagesProcessed = 0
+		go message.ConsumerLoop(context.Background(), mockListener, schemaRegistry, mockFilterFunc, mockBatchFilterFunc)
+		loop := 0
+
+		// Give this at least 300 milli-seconds to run before asserting the message was processed
+		for loop < 3 {
+			if batchMessagesProcessed >= 1 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+			loop++
+		}
+		So(batchMessagesProcessed, ShouldEqual, 1)
+		So(messagesProcessed, ShouldEqual, 0)
 		mockConsumer.Close()
 	})
 
@@ -0,0 +1,161 @@
+package message
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+)
+
+// scramClient the client side of a SASL/SCRAM exchange (RFC 5802), without channel binding. The user name and
+// password are used as given, they are not normalised with SASLprep.
+type scramClient struct {
+	hash  func() hash.Hash
+	nonce func() (string, error)
+
+	step            int
+	password        string
+	header          string
+	clientFirstBare string
+	clientNonce     string
+	serverSignature []byte
+}
+
+// scramClientGenerator the generator of SCRAM clients for the mechanism, SASL_SCRAM_SHA_256 or SASL_SCRAM_SHA_512.
+func scramClientGenerator(mechanism string) func() sarama.SCRAMClient {
+	h := sha256.New
+	if mechanism == SASL_SCRAM_SHA_512 {
+		h = sha512.New
+	}
+	return func() sarama.SCRAMClient {
+		return &scramClient{hash: h, nonce: randomNonce}
+	}
+}
+
+// randomNonce a random, printable nonce.
+func randomNonce() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// scramName escapes ',' and '=' in a user name.
+var scramName = strings.NewReplacer("=", "=3D", ",", "=2C")
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	nonce, err := c.nonce()
+	if err != nil {
+		return err
+	}
+	c.step = 0
+	c.password = password
+	c.clientNonce = nonce
+	c.header = "n,,"
+	if len(authzID) > 0 {
+		c.header = "n,a=" + scramName.Replace(authzID) + ","
+	}
+	c.clientFirstBare = "n=" + scramName.Replace(userName) + ",r=" + nonce
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return c.header + c.clientFirstBare, nil
+	case 2:
+		return c.clientFinal(challenge)
+	case 3:
+		return "", c.verifyServerFinal(challenge)
+	}
+	return "", errors.New("The SCRAM exchange is already over.")
+}
+
+func (c *scramClient) Done() bool {
+	return c.step >= 3
+}
+
+// clientFinal the client-final-message answering the server-first-message, proving the password is known.
+func (c *scramClient) clientFinal(serverFirst string) (string, error) {
+	attributes := scramAttributes(serverFirst)
+	nonce := attributes["r"]
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return "", errors.New("The SCRAM server nonce does not extend the client nonce.")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil || len(salt) == 0 {
+		return "", errors.New("The SCRAM server sent an invalid salt.")
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations < 1 {
+		return "", fmt.Errorf("The SCRAM server sent an invalid iteration count '%s'.", attributes["i"])
+	}
+
+	saltedPassword := c.hi([]byte(c.password), salt, iterations)
+	clientKey := c.hmac(saltedPassword, []byte("Client Key"))
+	storedKey := c.hash()
+	storedKey.Write(clientKey)
+
+	clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(c.header)) + ",r=" + nonce
+	authMessage := []byte(c.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+
+	proof := c.hmac(storedKey.Sum(nil), authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	c.serverSignature = c.hmac(c.hmac(saltedPassword, []byte("Server Key")), authMessage)
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServerFinal checks the server-final-message proves the server knows the password.
+func (c *scramClient) verifyServerFinal(serverFinal string) error {
+	attributes := scramAttributes(serverFinal)
+	if e, ok := attributes["e"]; ok {
+		return fmt.Errorf("The SCRAM server rejected the authentication: %s.", e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attributes["v"])
+	if err != nil || !hmac.Equal(signature, c.serverSignature) {
+		return errors.New("The SCRAM server signature is invalid.")
+	}
+	return nil
+}
+
+// hi the salted password, PBKDF2 with HMAC as the pseudorandom function, giving a single block.
+func (c *scramClient) hi(password []byte, salt []byte, iterations int) []byte {
+	u := c.hmac(password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	result := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = c.hmac(password, u)
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func (c *scramClient) hmac(key []byte, message []byte) []byte {
+	mac := hmac.New(c.hash, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// scramAttributes the attributes of a SCRAM message, by name.
+func scramAttributes(message string) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range strings.Split(message, ",") {
+		if len(attribute) > 1 && attribute[1] == '=' {
+			attributes[attribute[:1]] = attribute[2:]
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,156 @@
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// The SCRAM-SHA-256 exchange given in RFC 7677.
+const (
+	rfcClientNonce = "rOprNGfwEbeRWgbNEkqO"
+	rfcClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfcServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfcClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfcServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func newRFCClient() *scramClient {
+	return &scramClient{hash: sha256.New, nonce: func() (string, error) { return rfcClientNonce, nil }}
+}
+
+// serveSCRAM accepts a connection, answers the SASL handshake and then replies to each SCRAM token in turn,
+// sending the tokens received on the channel.
+func serveSCRAM(listener net.Listener, replies []string, received chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	read := func() []byte {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header))
+		io.ReadFull(conn, payload)
+		return payload
+	}
+	write := func(payload []byte) {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(payload)))
+		conn.Write(append(header, payload...))
+	}
+
+	// handshake response: correlation id, no error and the enabled mechanism
+	handshake := read()
+	received <- string(handshake[len(handshake)-len(SASL_SCRAM_SHA_256):])
+	write([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 13, 'S', 'C', 'R', 'A', 'M', '-', 'S', 'H', 'A', '-', '2', '5', '6'})
+
+	for _, reply := range replies {
+		token := read()
+		if token == nil {
+			return
+		}
+		received <- string(token)
+		write([]byte(reply))
+	}
+	read()
+}
+
+func TestSCRAMClient(t *testing.T) {
+
+	Convey("Given a SCRAM-SHA-256 client", t, func() {
+		client := newRFCClient()
+		So(client.Begin("user", "pencil", ""), ShouldBeNil)
+
+		Convey("Then it completes the exchange of RFC 7677", func() {
+			clientFirst, err := client.Step("")
+			So(err, ShouldBeNil)
+			So(clientFirst, ShouldEqual, rfcClientFirst)
+
+			clientFinal, err := client.Step(rfcServerFirst)
+			So(err, ShouldBeNil)
+			So(clientFinal, ShouldEqual, rfcClientFinal)
+			So(client.Done(), ShouldBeFalse)
+
+			_, err = client.Step(rfcServerFinal)
+			So(err, ShouldBeNil)
+			So(client.Done(), ShouldBeTrue)
+		})
+
+		Convey("Then a server that does not know the password is rejected", func() {
+			client.Step("")
+			client.Step(rfcServerFirst)
+			_, err := client.Step("v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "The SCRAM server signature is invalid.")
+		})
+
+		Convey("Then an error sent by the server is returned", func() {
+			client.Step("")
+			client.Step(rfcServerFirst)
+			_, err := client.Step("e=invalid-proof")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "The SCRAM server rejected the authentication: invalid-proof.")
+		})
+
+		Convey("Then a server nonce that does not extend the client nonce is rejected", func() {
+			client.Step("")
+			_, err := client.Step("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a user name containing ',' and '='", t, func() {
+		client := newRFCClient()
+		client.Begin("a,b=c", "pencil", "")
+
+		Convey("Then they are escaped", func() {
+			clientFirst, _ := client.Step("")
+			So(clientFirst, ShouldEqual, "n,,n=a=2Cb=3Dc,r="+rfcClientNonce)
+		})
+	})
+
+	Convey("Given a Kafka broker authenticating with SCRAM-SHA-256", t, func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		saramaConfig := sarama.NewConfig()
+		kafkaConfig := KafkaConfig{Brokers: []string{listener.Addr().String()}, SASLMechanism: SASL_SCRAM_SHA_256, SASLUser: "user", SASLPassword: "pencil"}
+		So(kafkaConfig.Apply(saramaConfig), ShouldBeNil)
+		saramaConfig.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return newRFCClient() }
+		broker := sarama.NewBroker(listener.Addr().String())
+		defer broker.Close()
+
+		Convey("Then the client connects once the exchange is complete", func() {
+			received := make(chan string, 3)
+			go serveSCRAM(listener, []string{rfcServerFirst, rfcServerFinal}, received)
+
+			So(broker.Open(saramaConfig), ShouldBeNil)
+			connected, err := broker.Connected()
+			So(err, ShouldBeNil)
+			So(connected, ShouldBeTrue)
+			So(<-received, ShouldEqual, SASL_SCRAM_SHA_256)
+			So(<-received, ShouldEqual, rfcClientFirst)
+			So(<-received, ShouldEqual, rfcClientFinal)
+		})
+
+		Convey("Then the client does not connect if the server signature is invalid", func() {
+			received := make(chan string, 3)
+			go serveSCRAM(listener, []string{rfcServerFirst, "v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}, received)
+
+			So(broker.Open(saramaConfig), ShouldBeNil)
+			connected, err := broker.Connected()
+			So(err, ShouldNotBeNil)
+			So(connected, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,76 @@
+package ons_aws
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ChecksumMetadataKey the metadata of an uploaded file holding the hex encoded SHA-256 of its content.
+const ChecksumMetadataKey = "sha256"
+
+// UploadResult the checksum and size of an uploaded file, which have been verified against the uploaded object.
+type UploadResult struct {
+	SHA256    string
+	Size      int64
+	ETag      string
+	VersionID string
+}
+
+// checksumReader computes the SHA-256, MD5 and size of everything read through it.
+type checksumReader struct {
+	reader io.Reader
+	sha256 hash.Hash
+	md5    hash.Hash
+	size   int64
+}
+
+func newChecksumReader(reader io.Reader) *checksumReader {
+	return &checksumReader{reader: reader, sha256: sha256.New(), md5: md5.New()}
+}
+
+func (r *checksumReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.sha256.Write(b[:n])
+	r.md5.Write(b[:n])
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *checksumReader) sums() (string, string) {
+	return hex.EncodeToString(r.sha256.Sum(nil)), hex.EncodeToString(r.md5.Sum(nil))
+}
+
+// verifyUpload checks the uploaded object has the size and content that was read. The SHA-256 is compared with the
+// metadata if it was set, and the MD5 with the ETag if the ETag is an MD5, which is not the case for multipart uploads
+// or objects S3 encrypted with KMS, whether requested or by the bucket default.
+func verifyUpload(info *FileInfo, sha256Sum string, md5Sum string, size int64) error {
+	if info.Size != size {
+		return fmt.Errorf("size is %d bytes, expected %d bytes", info.Size, size)
+	}
+	if stored := MetadataValue(info.Metadata, ChecksumMetadataKey); len(stored) > 0 && stored != sha256Sum {
+		return fmt.Errorf("SHA-256 is %s, expected %s", stored, sha256Sum)
+	}
+	etag := strings.Trim(info.ETag, `"`)
+	if !strings.HasPrefix(info.ServerSideEncryption, s3.ServerSideEncryptionAwsKms) && len(etag) > 0 && !strings.Contains(etag, "-") && etag != md5Sum {
+		return fmt.Errorf("ETag is %s, expected %s", etag, md5Sum)
+	}
+	return nil
+}
+
+// MetadataValue returns the value of the metadata key, ignoring case as S3 returns metadata keys with their case
+// changed.
+func MetadataValue(metadata map[string]string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,40 @@
+package ons_aws
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVerifyUpload(t *testing.T) {
+
+	Convey("Given the checksum of a file read through a checksumReader", t, func() {
+		reader := newChecksumReader(strings.NewReader("header\nrow\n"))
+		ioutil.ReadAll(reader)
+		sha256Sum, md5Sum := reader.sums()
+
+		So(reader.size, ShouldEqual, 11)
+
+		Convey("Then an upload with the same size, SHA-256 and MD5 ETag is verified", func() {
+			info := &FileInfo{Size: 11, ETag: `"` + md5Sum + `"`, Metadata: map[string]string{"Sha256": sha256Sum}}
+			So(verifyUpload(info, sha256Sum, md5Sum, reader.size), ShouldBeNil)
+		})
+		Convey("Then an upload of a different size is rejected", func() {
+			info := &FileInfo{Size: 10}
+			So(verifyUpload(info, sha256Sum, md5Sum, reader.size), ShouldNotBeNil)
+		})
+		Convey("Then an upload with a different SHA-256 is rejected", func() {
+			info := &FileInfo{Size: 11, Metadata: map[string]string{"Sha256": "other"}}
+			So(verifyUpload(info, sha256Sum, md5Sum, reader.size), ShouldNotBeNil)
+		})
+		Convey("Then the ETag is only compared when it is an MD5", func() {
+			So(verifyUpload(&FileInfo{Size: 11, ETag: `"other"`}, sha256Sum, md5Sum, reader.size), ShouldNotBeNil)
+			So(verifyUpload(&FileInfo{Size: 11, ETag: `"other-2"`}, sha256Sum, md5Sum, reader.size), ShouldBeNil)
+			So(verifyUpload(&FileInfo{Size: 11, ETag: `"other"`, ServerSideEncryption: s3.ServerSideEncryptionAwsKms}, sha256Sum, md5Sum, reader.size), ShouldBeNil)
+			So(verifyUpload(&FileInfo{Size: 11, ETag: `"other"`, ServerSideEncryption: s3.ServerSideEncryptionAes256}, sha256Sum, md5Sum, reader.size), ShouldNotBeNil)
+		})
+	})
+}
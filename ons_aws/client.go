@@ -1,33 +1,151 @@
 package ons_aws
 
 import (
-	"io"
+	"context"
+	"fmt"
 	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	"github.com/ONSdigital/dp-dd-csv-filter/tracing"
 	"github.com/ONSdigital/go-ns/log"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
-	"fmt"
 )
 
-// AWSClient interface defining the AWS client.
+// AWSClient interface defining the AWS client. Every request made to AWS is aborted once its context is done,
+// including reading the body of a file, in which case an Error of kind ErrCanceled is returned.
 type AWSService interface {
 	// GetFile get the requested file from AWS. The caller is responsible for closing the reader.
-	GetCSV(requestID string, s3url S3URL) (io.ReadCloser, error)
-	SaveFile(requestID string, reader io.Reader, s3url S3URL) error
+	GetCSV(ctx context.Context, requestID string, s3url S3URL) (io.ReadCloser, error)
+	// GetRange get the bytes of the requested file from start up to, but not including, end. The caller is responsible for closing the reader.
+	GetRange(ctx context.Context, requestID string, s3url S3URL, start int64, end int64) (io.ReadCloser, error)
+	// SaveFile upload the file to AWS, applying any allowed overrides to the configured UploadOptions. The uploaded
+	// file is verified against the checksum and size of the content that was read.
+	SaveFile(ctx context.Context, requestID string, reader io.Reader, s3url S3URL, overrides *UploadOptions) (*UploadResult, error)
+	// ValidateUploadOptions check the overrides are allowed before any work is done.
+	ValidateUploadOptions(overrides *UploadOptions) error
+	// HeadFile get the metadata of the requested file without downloading it.
+	HeadFile(ctx context.Context, requestID string, s3url S3URL) (*FileInfo, error)
+	// CopyFile copy a file from one location to another within AWS, applying the upload options to the copy.
+	CopyFile(ctx context.Context, requestID string, source S3URL, destination S3URL, overrides *UploadOptions) error
+}
+
+// FileInfo the metadata of a file in AWS.
+type FileInfo struct {
+	ETag                 string
+	VersionID            string
+	Size                 int64
+	ContentType          string
+	ContentEncoding      string
+	LastModified         time.Time
+	Metadata             map[string]string
+	ServerSideEncryption string
+}
+
+// Client AWS client implementation. A single session is shared by every operation, so connections are reused between
+// requests. Each request is sent to the region of its bucket, using one S3 client per region.
+type Service struct {
+	uploadPolicy  UploadPolicy
+	retryPolicy   RetryPolicy
+	sessionConfig SessionConfig
+	regions       *regionResolver
+
+	once    sync.Once
+	session *session.Session
+	err     error
+
+	mutex   sync.Mutex
+	clients map[string]*s3.S3
+}
+
+// NewService create a Service from the configuration.
+func NewService(cfg *config.Config) *Service {
+	return NewServiceWithConfig(NewSessionConfig(cfg), NewUploadPolicy(cfg), NewRetryPolicy(cfg))
+}
+
+// NewServiceWithConfig create a Service using the given session configuration and policies, e.g. to use a local S3
+// endpoint.
+func NewServiceWithConfig(sessionConfig SessionConfig, uploadPolicy UploadPolicy, retryPolicy RetryPolicy) *Service {
+	return &Service{
+		uploadPolicy:  uploadPolicy,
+		retryPolicy:   retryPolicy,
+		sessionConfig: sessionConfig,
+		regions:       newRegionResolver(sessionConfig.Region, sessionConfig.BucketRegions),
+		clients:       make(map[string]*s3.S3),
+	}
+}
+
+// client returns the S3 client for the region of the bucket, creating the shared session on first use. Requests made
+// with the client are aborted once the context is done.
+func (cli *Service) client(ctx context.Context, requestID string, bucket string) (*s3.S3, error) {
+	cli.once.Do(func() {
+		cli.session, cli.err = newSession(cli.sessionConfig)
+		if cli.err == nil {
+			log.DebugC(requestID, "Created AWS session", log.Data{"region": cli.sessionConfig.Region, "endpoint": cli.sessionConfig.Endpoint, "credentials": cli.sessionConfig.CredentialSource})
+		}
+	})
+	if cli.err != nil {
+		log.ErrorC(requestID, cli.err, nil)
+		return nil, cli.err
+	}
+	if strings.HasPrefix(bucket, "arn:") {
+		// The SDK addresses buckets by name only, it cannot yet route requests to an access point.
+		err := fmt.Errorf("S3 access point '%s' is not supported.", bucket)
+		log.ErrorC(requestID, err, nil)
+		return nil, err
+	}
+
+	region := cli.regions.resolve(ctx, requestID, bucket, cli.regionClient(cli.sessionConfig.Region))
+	return withContext(ctx, cli.regionClient(region)), nil
+}
+
+// withContext returns a copy of the client that sends each request with the context, as this version of the SDK
+// has no context aware operations. The context is kept by the SDK when a request is retried.
+func withContext(ctx context.Context, client *s3.S3) *s3.S3 {
+	c := *client.Client
+	c.Handlers = c.Handlers.Copy()
+	c.Handlers.Send.PushFront(func(r *request.Request) {
+		r.HTTPRequest = r.HTTPRequest.WithContext(ctx)
+	})
+	return &s3.S3{Client: &c}
 }
 
-// Client AWS client implementation.
-type Service struct{}
+func (cli *Service) regionClient(region string) *s3.S3 {
+	cli.mutex.Lock()
+	defer cli.mutex.Unlock()
 
-// NewClient create new AWSClient.
-func NewService() AWSService {
-	return &Service{}
+	client, ok := cli.clients[region]
+	if !ok {
+		client = s3.New(cli.session, &aws.Config{Region: aws.String(region)})
+		cli.clients[region] = client
+	}
+	return client
+}
+
+func (cli *Service) ValidateUploadOptions(overrides *UploadOptions) error {
+	return cli.uploadPolicy.Validate(overrides)
+}
+
+func (cli *Service) SaveFile(ctx context.Context, requestID string, reader io.Reader, s3url S3URL, overrides *UploadOptions) (*UploadResult, error) {
+	span := startS3Span(requestID, "S3 PutObject", s3url)
+	defer span.End()
+
+	result, err := cli.saveFile(ctx, requestID, reader, s3url, overrides)
+	span.SetError(err)
+	if result != nil {
+		span.SetAttribute(tracing.BYTES, result.Size)
+	}
+	return result, err
 }
 
-func (cli *Service) SaveFile(requestID string, reader io.Reader, s3url S3URL) error {
+func (cli *Service) saveFile(ctx context.Context, requestID string, reader io.Reader, s3url S3URL, overrides *UploadOptions) (*UploadResult, error) {
 
 	startTime := time.Now()
 	defer func() {
@@ -35,53 +153,152 @@ func (cli *Service) SaveFile(requestID string, reader io.Reader, s3url S3URL) er
 		log.DebugC(requestID, fmt.Sprintf("SaveFile, duration_ns: %d", endTime.Sub(startTime).Nanoseconds()), log.Data{})
 	}()
 
-	uploader := s3manager.NewUploader(session.New(&aws.Config{Region: aws.String(config.AWSRegion)}))
+	options, err := cli.uploadPolicy.Resolve(s3url.GetBucketName(), overrides)
+	if err != nil {
+		log.ErrorC(requestID, err, log.Data{"overrides": overrides})
+		return nil, err
+	}
+
+	s3Service, err := cli.client(ctx, requestID, s3url.GetBucketName())
+	if err != nil {
+		return nil, err
+	}
+	uploader := s3manager.NewUploaderWithClient(s3Service)
+
+	// The upload can only be retried, and its checksum stored in its metadata, if the file can be read again from
+	// the start. Otherwise the checksum is computed as the file is uploaded.
+	retryPolicy := cli.retryPolicy
+	seeker, seekable := reader.(io.Seeker)
+	checksum := newChecksumReader(reader)
+	body := io.Reader(checksum)
+	if seekable {
+		if _, err := io.Copy(ioutil.Discard, checksum); err != nil {
+			log.ErrorC(requestID, err, log.Data{"message": "Failed to compute checksum"})
+			return nil, err
+		}
+		sha256Sum, _ := checksum.sums()
+		metadata := map[string]string{ChecksumMetadataKey: sha256Sum}
+		for key, value := range options.Metadata {
+			metadata[key] = value
+		}
+		options.Metadata = metadata
+		body = reader
+	} else {
+		retryPolicy.MaxAttempts = 1
+	}
 
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Body:   reader,
+	input := &s3manager.UploadInput{
+		Body:   body,
 		Bucket: aws.String(s3url.GetBucketName()),
 		Key:    aws.String(s3url.GetFilePath()),
+	}
+	options.apply(input)
+
+	var result *s3manager.UploadOutput
+	err = retryPolicy.do(ctx, requestID, "SaveFile", s3url, func() error {
+		if seekable {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		result, err = uploader.Upload(input)
+		return err
 	})
 
 	if err != nil {
-		log.Error(err, log.Data{"message": "Failed to upload"})
-		return err
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to upload"})
+		return nil, err
+	}
+
+	uploaded := s3url
+	if result.VersionID != nil {
+		uploaded = s3url.WithVersionID(aws.StringValue(result.VersionID))
+	}
+	info, err := cli.HeadFile(ctx, requestID, uploaded)
+	if err != nil {
+		log.ErrorC(requestID, err, log.Data{"message": "Failed to verify upload"})
+		return nil, err
+	}
+	sha256Sum, md5Sum := checksum.sums()
+	if err := verifyUpload(info, sha256Sum, md5Sum, checksum.size); err != nil {
+		err = fmt.Errorf("Uploaded file '%s' does not match the file that was read: %s.", s3url.String(), err.Error())
+		log.ErrorC(requestID, err, nil)
+		return nil, err
 	}
 
 	log.Debug("Upload successful", log.Data{
 		"uploadLocation": result.Location,
+		"sha256":         sha256Sum,
+		"size":           checksum.size,
 	})
 
-	return nil
+	return &UploadResult{SHA256: sha256Sum, Size: checksum.size, ETag: info.ETag, VersionID: info.VersionID}, nil
 }
 
 // GetFile get the requested file from AWS. The caller is responsible for closing the reader.
-func (cli *Service) GetCSV(requestID string, s3url S3URL) (io.ReadCloser, error) {
+func (cli *Service) GetCSV(ctx context.Context, requestID string, s3url S3URL) (io.ReadCloser, error) {
 	startTime := time.Now()
 	defer func() {
 		endTime := time.Now()
 		log.DebugC(requestID, fmt.Sprintf("GetCSV, duration_ns: %d", endTime.Sub(startTime).Nanoseconds()), log.Data{})
 	}()
 
-	session, err := session.NewSession(&aws.Config{
-		Region: aws.String(config.AWSRegion),
-	})
-
+	// The span ends once the file has been read and closed.
+	span := startS3Span(requestID, "S3 GetObject", s3url)
+	s3Service, err := cli.client(ctx, requestID, s3url.GetBucketName())
 	if err != nil {
-		log.ErrorC(requestID, err, nil)
+		span.SetError(err)
+		span.End()
 		return nil, err
 	}
 
-	s3Service := s3.New(session)
 	request := &s3.GetObjectInput{}
 	request.SetBucket(s3url.GetBucketName())
 	request.SetKey(s3url.GetFilePath())
+	if versionID := s3url.GetVersionID(); len(versionID) > 0 {
+		request.SetVersionId(versionID)
+	}
 
 	log.Debug("Requesting .csv file from AWS S3 bucket", log.Data{
 		"S3BucketName": request.Bucket,
 		"key":          request.Key,
 	})
-	result, err := s3Service.GetObject(request)
+	var result *s3.GetObjectOutput
+	err = cli.retryPolicy.do(ctx, requestID, "GetCSV", s3url, func() error {
+		result, err = s3Service.GetObject(request)
+		return err
+	})
+
+	if err != nil {
+		log.ErrorC(requestID, err, log.Data{"request": request})
+		span.SetError(err)
+		span.End()
+		return nil, err
+	}
+
+	return &spanReader{ReadCloser: result.Body, span: span}, nil
+}
+
+// GetRange get the bytes of the requested file from start up to, but not including, end. The caller is responsible for closing the reader.
+func (cli *Service) GetRange(ctx context.Context, requestID string, s3url S3URL, start int64, end int64) (io.ReadCloser, error) {
+	s3Service, err := cli.client(ctx, requestID, s3url.GetBucketName())
+	if err != nil {
+		return nil, err
+	}
+
+	request := &s3.GetObjectInput{}
+	request.SetBucket(s3url.GetBucketName())
+	request.SetKey(s3url.GetFilePath())
+	if versionID := s3url.GetVersionID(); len(versionID) > 0 {
+		request.SetVersionId(versionID)
+	}
+	request.SetRange(fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	var result *s3.GetObjectOutput
+	err = cli.retryPolicy.do(ctx, requestID, "GetRange", s3url, func() error {
+		result, err = s3Service.GetObject(request)
+		return err
+	})
 
 	if err != nil {
 		log.ErrorC(requestID, err, log.Data{"request": request})
@@ -90,3 +307,120 @@ func (cli *Service) GetCSV(requestID string, s3url S3URL) (io.ReadCloser, error)
 
 	return result.Body, nil
 }
+
+// HeadFile get the metadata of the requested file without downloading it.
+func (cli *Service) HeadFile(ctx context.Context, requestID string, s3url S3URL) (*FileInfo, error) {
+	s3Service, err := cli.client(ctx, requestID, s3url.GetBucketName())
+	if err != nil {
+		return nil, err
+	}
+
+	request := &s3.HeadObjectInput{}
+	request.SetBucket(s3url.GetBucketName())
+	request.SetKey(s3url.GetFilePath())
+	if versionID := s3url.GetVersionID(); len(versionID) > 0 {
+		request.SetVersionId(versionID)
+	}
+
+	var result *s3.HeadObjectOutput
+	err = cli.retryPolicy.do(ctx, requestID, "HeadFile", s3url, func() error {
+		result, err = s3Service.HeadObject(request)
+		return err
+	})
+	if err != nil {
+		log.ErrorC(requestID, err, log.Data{"request": request})
+		return nil, err
+	}
+
+	return &FileInfo{
+		ETag:                 aws.StringValue(result.ETag),
+		VersionID:            aws.StringValue(result.VersionId),
+		Size:                 aws.Int64Value(result.ContentLength),
+		ContentType:          aws.StringValue(result.ContentType),
+		ContentEncoding:      aws.StringValue(result.ContentEncoding),
+		LastModified:         aws.TimeValue(result.LastModified),
+		Metadata:             aws.StringValueMap(result.Metadata),
+		ServerSideEncryption: aws.StringValue(result.ServerSideEncryption),
+	}, nil
+}
+
+// CopyFile copy a file from one location to another within AWS, applying the upload options to the copy.
+func (cli *Service) CopyFile(ctx context.Context, requestID string, source S3URL, destination S3URL, overrides *UploadOptions) error {
+	startTime := time.Now()
+	defer func() {
+		endTime := time.Now()
+		log.DebugC(requestID, fmt.Sprintf("CopyFile, duration_ns: %d", endTime.Sub(startTime).Nanoseconds()), log.Data{})
+	}()
+
+	options, err := cli.uploadPolicy.Resolve(destination.GetBucketName(), overrides)
+	if err != nil {
+		log.ErrorC(requestID, err, log.Data{"overrides": overrides})
+		return err
+	}
+
+	s3Service, err := cli.client(ctx, requestID, destination.GetBucketName())
+	if err != nil {
+		return err
+	}
+
+	copySource := url.URL{Path: source.GetBucketName() + "/" + source.GetFilePath()}
+	if versionID := source.GetVersionID(); len(versionID) > 0 {
+		copySource.RawQuery = url.Values{versionIDParam: {versionID}}.Encode()
+	}
+	request := &s3.CopyObjectInput{
+		Bucket:     aws.String(destination.GetBucketName()),
+		Key:        aws.String(destination.GetFilePath()),
+		CopySource: aws.String(copySource.EscapedPath() + querySuffix(copySource.RawQuery)),
+	}
+	options.applyCopy(request)
+
+	err = cli.retryPolicy.do(ctx, requestID, "CopyFile", destination, func() error {
+		_, err := s3Service.CopyObject(request)
+		return err
+	})
+	if err != nil {
+		log.DebugC(requestID, "Copy failed", log.Data{"source": source.String(), "destination": destination.String(), "error": err.Error()})
+		return err
+	}
+
+	log.DebugC(requestID, "Copy successful", log.Data{"source": source.String(), "destination": destination.String()})
+	return nil
+}
+
+func querySuffix(query string) string {
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query
+}
+
+// startS3Span starts the span of an S3 operation on the file.
+func startS3Span(requestID string, name string, s3url S3URL) *tracing.Span {
+	span := tracing.Start(requestID, name, tracing.KIND_CLIENT)
+	span.SetAttribute(tracing.S3_BUCKET, s3url.GetBucketName())
+	span.SetAttribute(tracing.S3_KEY, s3url.GetFilePath())
+	return span
+}
+
+// spanReader counts the bytes read from a file, ending its span when it is closed.
+type spanReader struct {
+	io.ReadCloser
+	span  *tracing.Span
+	bytes int64
+}
+
+func (r *spanReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		r.span.SetError(err)
+	}
+	return n, err
+}
+
+func (r *spanReader) Close() error {
+	err := r.ReadCloser.Close()
+	r.span.SetAttribute(tracing.BYTES, r.bytes)
+	r.span.End()
+	return err
+}
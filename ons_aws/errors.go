@@ -0,0 +1,121 @@
+package ons_aws
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// ErrorKind classifies a failed AWS operation.
+type ErrorKind int
+
+const (
+	// ErrUnknown an error that could not be classified. It is not retried.
+	ErrUnknown ErrorKind = iota
+	// ErrNotFound the bucket or file does not exist.
+	ErrNotFound
+	// ErrAccessDenied the credentials do not allow the operation.
+	ErrAccessDenied
+	// ErrThrottled the request was rejected because too many requests are being made. It is retried.
+	ErrThrottled
+	// ErrTransient the request failed because of a network or server error. It is retried.
+	ErrTransient
+	// ErrCanceled the operation was stopped because its context was cancelled or timed out. It is not retried.
+	ErrCanceled
+)
+
+var errorKindNames = map[ErrorKind]string{
+	ErrUnknown:      "unknown",
+	ErrNotFound:     "not found",
+	ErrAccessDenied: "access denied",
+	ErrThrottled:    "throttled",
+	ErrTransient:    "transient",
+	ErrCanceled:     "canceled",
+}
+
+func (k ErrorKind) String() string {
+	return errorKindNames[k]
+}
+
+// Error an AWS operation that failed, classified by kind.
+type Error struct {
+	Kind      ErrorKind
+	Operation string
+	URL       string
+	Attempts  int
+	Err       error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s failed (%s) after %d attempt(s): %s", e.Operation, e.URL, e.Kind, e.Attempts, e.Err.Error())
+}
+
+// Retryable returns true if the operation may succeed if it is tried again.
+func (e *Error) Retryable() bool {
+	return e.Kind == ErrThrottled || e.Kind == ErrTransient
+}
+
+// IsNotFound returns true if err is an Error caused by a missing bucket or file.
+func IsNotFound(err error) bool {
+	return kindOf(err) == ErrNotFound
+}
+
+// IsAccessDenied returns true if err is an Error caused by missing permissions.
+func IsAccessDenied(err error) bool {
+	return kindOf(err) == ErrAccessDenied
+}
+
+// IsCanceled returns true if err is an Error caused by the context of the operation being cancelled or timing out.
+func IsCanceled(err error) bool {
+	return kindOf(err) == ErrCanceled
+}
+
+func kindOf(err error) ErrorKind {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return ErrUnknown
+}
+
+var notFoundCodes = map[string]bool{"NoSuchKey": true, "NoSuchBucket": true, "NotFound": true, "NoSuchVersion": true}
+var accessDeniedCodes = map[string]bool{"AccessDenied": true, "Forbidden": true, "InvalidAccessKeyId": true, "SignatureDoesNotMatch": true}
+var throttledCodes = map[string]bool{"SlowDown": true, "Throttling": true, "ThrottlingException": true, "RequestLimitExceeded": true, "RequestThrottled": true}
+var transientCodes = map[string]bool{"RequestError": true, "RequestTimeout": true, "InternalError": true, "ServiceUnavailable": true}
+
+// classify determines the kind of an error returned by the AWS SDK.
+func classify(err error) ErrorKind {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch code := awsErr.Code(); {
+		case notFoundCodes[code]:
+			return ErrNotFound
+		case accessDeniedCodes[code]:
+			return ErrAccessDenied
+		case throttledCodes[code]:
+			return ErrThrottled
+		case transientCodes[code]:
+			return ErrTransient
+		}
+		if failure, ok := err.(awserr.RequestFailure); ok {
+			switch status := failure.StatusCode(); {
+			case status == http.StatusNotFound:
+				return ErrNotFound
+			case status == http.StatusForbidden:
+				return ErrAccessDenied
+			case status == http.StatusTooManyRequests:
+				return ErrThrottled
+			case status >= http.StatusInternalServerError:
+				return ErrTransient
+			}
+		}
+		if awsErr.OrigErr() != nil {
+			return classify(awsErr.OrigErr())
+		}
+		return ErrUnknown
+	}
+	if _, ok := err.(net.Error); ok {
+		return ErrTransient
+	}
+	return ErrUnknown
+}
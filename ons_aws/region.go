@@ -0,0 +1,107 @@
+package ons_aws
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/go-ns/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// bucketRegionHeader the header S3 sets on every response to a request for a bucket, including redirects and denials.
+const bucketRegionHeader = "X-Amz-Bucket-Region"
+
+// fallbackTTL how long the default region is used for a bucket whose region could not be discovered, before
+// discovery is tried again.
+const fallbackTTL = time.Minute
+
+// regionResolver discovers the region of each bucket, caching the result so it is only discovered once. A failed
+// discovery is cached for fallbackTTL, so each request to the bucket does not repeat it.
+type regionResolver struct {
+	mutex         sync.Mutex
+	defaultRegion string
+	regions       map[string]string
+	fallbacks     map[string]time.Time
+	now           func() time.Time
+}
+
+func newRegionResolver(defaultRegion string, regions map[string]string) *regionResolver {
+	r := &regionResolver{defaultRegion: defaultRegion, regions: make(map[string]string), fallbacks: make(map[string]time.Time), now: time.Now}
+	for bucket, region := range regions {
+		r.regions[bucket] = region
+	}
+	return r
+}
+
+// resolve returns the region of the bucket, asking S3 using the client of the default region if it is not yet known.
+// The default region is returned if the region cannot be discovered, and is cached until fallbackTTL has passed. It is
+// not cached if the context is done first.
+func (r *regionResolver) resolve(ctx context.Context, requestID string, bucket string, client *s3.S3) string {
+	r.mutex.Lock()
+	region, ok := r.regions[bucket]
+	expires, fallback := r.fallbacks[bucket]
+	r.mutex.Unlock()
+	if ok {
+		return region
+	}
+	if fallback && r.now().Before(expires) {
+		return r.defaultRegion
+	}
+
+	region = discoverRegion(ctx, client, bucket)
+	if len(region) == 0 {
+		if ctx.Err() != nil {
+			return r.defaultRegion
+		}
+		log.DebugC(requestID, "Unable to discover bucket region, using the default region", log.Data{"bucket": bucket, "region": r.defaultRegion, "retryAfter": fallbackTTL.String()})
+		r.mutex.Lock()
+		r.fallbacks[bucket] = r.now().Add(fallbackTTL)
+		r.mutex.Unlock()
+		return r.defaultRegion
+	}
+
+	log.DebugC(requestID, "Discovered bucket region", log.Data{"bucket": bucket, "region": region})
+	r.mutex.Lock()
+	r.regions[bucket] = region
+	delete(r.fallbacks, bucket)
+	r.mutex.Unlock()
+	return region
+}
+
+// discoverRegion reads the region from the headers of a HeadBucket response, which S3 returns even when the bucket is
+// in another region or access is denied, falling back to GetBucketLocation. Both requests are aborted once the
+// context is done.
+func discoverRegion(ctx context.Context, client *s3.S3, bucket string) string {
+	client = withContext(ctx, client)
+	request, _ := client.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	request.Send()
+	if request.HTTPResponse != nil {
+		if region := request.HTTPResponse.Header.Get(bucketRegionHeader); len(region) > 0 {
+			return region
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ""
+	}
+
+	location, err := client.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return ""
+	}
+	return normaliseLocation(aws.StringValue(location.LocationConstraint))
+}
+
+// normaliseLocation converts a bucket location constraint to a region. Buckets in us-east-1 have no constraint and
+// the oldest buckets in eu-west-1 have the constraint "EU".
+func normaliseLocation(location string) string {
+	switch location {
+	case "":
+		return "us-east-1"
+	case s3.BucketLocationConstraintEu:
+		return "eu-west-1"
+	}
+	return location
+}
@@ -0,0 +1,67 @@
+package ons_aws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNormaliseLocation(t *testing.T) {
+
+	Convey("Given bucket location constraints", t, func() {
+
+		Convey("Then they are converted to regions", func() {
+			So(normaliseLocation(""), ShouldEqual, "us-east-1")
+			So(normaliseLocation("EU"), ShouldEqual, "eu-west-1")
+			So(normaliseLocation("eu-west-2"), ShouldEqual, "eu-west-2")
+		})
+	})
+}
+
+func TestRegionResolver(t *testing.T) {
+
+	Convey("Given a region resolver with a configured bucket region", t, func() {
+		resolver := newRegionResolver("eu-west-1", map[string]string{"us-bucket": "us-west-2"})
+
+		Convey("Then the configured region is used without asking S3", func() {
+			So(resolver.resolve(context.Background(), "requestId", "us-bucket", nil), ShouldEqual, "us-west-2")
+		})
+	})
+	Convey("Given a region resolver for a bucket whose region cannot be discovered", t, func() {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer server.Close()
+
+		client := s3.New(session.New(&aws.Config{
+			Region:           aws.String("eu-west-1"),
+			Endpoint:         aws.String(server.URL),
+			S3ForcePathStyle: aws.Bool(true),
+			Credentials:      credentials.NewStaticCredentials("access-key", "secret-key", ""),
+		}))
+		now := time.Now()
+		resolver := newRegionResolver("eu-west-1", nil)
+		resolver.now = func() time.Time { return now }
+
+		Convey("Then the default region is used without asking S3 again until the fallback expires", func() {
+			So(resolver.resolve(context.Background(), "requestId", "bucket", client), ShouldEqual, "eu-west-1")
+			So(requests, ShouldEqual, 2)
+			So(resolver.resolve(context.Background(), "requestId", "bucket", client), ShouldEqual, "eu-west-1")
+			So(requests, ShouldEqual, 2)
+
+			now = now.Add(fallbackTTL)
+			So(resolver.resolve(context.Background(), "requestId", "bucket", client), ShouldEqual, "eu-west-1")
+			So(requests, ShouldEqual, 4)
+		})
+	})
+}
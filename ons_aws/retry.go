@@ -0,0 +1,70 @@
+package ons_aws
+
+import (
+	"context"
+	"time"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// sleep waits between attempts, returning early if the context is done. Replaced in tests.
+var sleep = func(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// RetryPolicy the number of attempts made for an AWS operation and the exponential backoff between them.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// NewRetryPolicy create a RetryPolicy from the configuration.
+func NewRetryPolicy(cfg *config.Config) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    cfg.S3MaxAttempts,
+		InitialBackoff: cfg.S3RetryBackoff,
+		MaxBackoff:     cfg.S3RetryMaxBackoff,
+	}
+}
+
+// do runs the operation until it succeeds, fails with an error that is not retryable, runs out of attempts or its
+// context is done. Any error returned is an *Error.
+func (p RetryPolicy) do(ctx context.Context, requestID string, operation string, s3url S3URL, fn func() error) error {
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			return &Error{Kind: ErrCanceled, Operation: operation, URL: s3url.String(), Attempts: attempt - 1, Err: ctx.Err()}
+		}
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			// The request was aborted by the context, whatever error the SDK reports for it.
+			return &Error{Kind: ErrCanceled, Operation: operation, URL: s3url.String(), Attempts: attempt, Err: ctx.Err()}
+		}
+
+		awsErr, ok := err.(*Error)
+		if !ok {
+			awsErr = &Error{Kind: classify(err), Operation: operation, URL: s3url.String(), Err: err}
+		}
+		awsErr.Attempts = attempt
+
+		if !awsErr.Retryable() || attempt >= p.MaxAttempts {
+			return awsErr
+		}
+
+		log.DebugC(requestID, "Retrying AWS operation", log.Data{"operation": operation, "url": s3url.String(), "attempt": attempt, "backoff": backoff.String(), "error": err.Error()})
+		sleep(ctx, backoff)
+		if backoff *= 2; p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
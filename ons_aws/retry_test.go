@@ -0,0 +1,98 @@
+package ons_aws
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClassify(t *testing.T) {
+
+	Convey("Given errors returned by the AWS SDK", t, func() {
+
+		Convey("Then they are classified by their code", func() {
+			So(classify(awserr.New("NoSuchKey", "missing", nil)), ShouldEqual, ErrNotFound)
+			So(classify(awserr.New("AccessDenied", "denied", nil)), ShouldEqual, ErrAccessDenied)
+			So(classify(awserr.New("SlowDown", "slow down", nil)), ShouldEqual, ErrThrottled)
+			So(classify(awserr.New("RequestError", "send request failed", nil)), ShouldEqual, ErrTransient)
+		})
+		Convey("Then codes that are not recognised are classified by their status", func() {
+			So(classify(awserr.NewRequestFailure(awserr.New("NotModified", "", nil), 404, "id")), ShouldEqual, ErrNotFound)
+			So(classify(awserr.NewRequestFailure(awserr.New("Unknown", "", nil), 503, "id")), ShouldEqual, ErrTransient)
+			So(classify(awserr.NewRequestFailure(awserr.New("BadDigest", "", nil), 400, "id")), ShouldEqual, ErrUnknown)
+		})
+		Convey("Then other errors are not retryable", func() {
+			So(classify(errors.New("Unexpected.")), ShouldEqual, ErrUnknown)
+		})
+	})
+}
+
+func TestRetryPolicy(t *testing.T) {
+	s3url, _ := NewS3URL("s3://bucket/file.csv")
+
+	Convey("Given a retry policy of three attempts", t, func() {
+		var backoffs []time.Duration
+		defaultSleep := sleep
+		sleep = func(ctx context.Context, d time.Duration) { backoffs = append(backoffs, d) }
+		defer func() { sleep = defaultSleep }()
+
+		policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 150 * time.Millisecond}
+		attempts := 0
+
+		Convey("Then a transient failure is retried until it succeeds", func() {
+			err := policy.do(context.Background(), "requestId", "GetCSV", s3url, func() error {
+				if attempts++; attempts < 3 {
+					return awserr.New("RequestError", "connection reset", nil)
+				}
+				return nil
+			})
+			So(err, ShouldBeNil)
+			So(attempts, ShouldEqual, 3)
+			So(backoffs, ShouldResemble, []time.Duration{100 * time.Millisecond, 150 * time.Millisecond})
+		})
+		Convey("Then a throttled failure is returned once the attempts are used up", func() {
+			err := policy.do(context.Background(), "requestId", "GetCSV", s3url, func() error {
+				attempts++
+				return awserr.New("SlowDown", "slow down", nil)
+			})
+			So(attempts, ShouldEqual, 3)
+			So(err.(*Error).Kind, ShouldEqual, ErrThrottled)
+			So(err.(*Error).Attempts, ShouldEqual, 3)
+		})
+		Convey("Then a failure that is not retryable is returned immediately", func() {
+			err := policy.do(context.Background(), "requestId", "GetCSV", s3url, func() error {
+				attempts++
+				return awserr.New("NoSuchKey", "missing", nil)
+			})
+			So(attempts, ShouldEqual, 1)
+			So(IsNotFound(err), ShouldBeTrue)
+			So(backoffs, ShouldBeEmpty)
+		})
+		Convey("Then a failure is not retried once the context is done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			err := policy.do(ctx, "requestId", "GetCSV", s3url, func() error {
+				attempts++
+				cancel()
+				return awserr.New("RequestError", "send request failed", errors.New("context canceled"))
+			})
+			So(attempts, ShouldEqual, 1)
+			So(IsCanceled(err), ShouldBeTrue)
+			So(err.(*Error).Err == context.Canceled, ShouldBeTrue)
+			So(backoffs, ShouldBeEmpty)
+		})
+		Convey("Then an operation is not attempted if the context is already done", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := policy.do(ctx, "requestId", "GetCSV", s3url, func() error {
+				attempts++
+				return nil
+			})
+			So(attempts, ShouldEqual, 0)
+			So(IsCanceled(err), ShouldBeTrue)
+		})
+	})
+}
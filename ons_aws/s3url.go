@@ -1,17 +1,50 @@
 package ons_aws
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/url"
+	"regexp"
 	"strings"
 )
 
+// versionIDParam the query parameter giving the version of the file.
+const versionIDParam = "versionId"
+
+// accessPointObject separates the access point from the key in an access point ARN.
+const accessPointObject = "/object/"
+
+// s3Host matches the S3 endpoints of every region, e.g. s3.amazonaws.com, s3.eu-west-1.amazonaws.com and the older
+// s3-eu-west-1.amazonaws.com.
+const s3Host = `s3(?:[.-](?:dualstack\.)?[a-z0-9-]+)?\.amazonaws\.com(?:\.cn)?`
+
+var pathStyleHost = regexp.MustCompile(`^` + s3Host + `$`)
+var virtualHostedHost = regexp.MustCompile(`^(.+)\.` + s3Host + `$`)
+
+// bucketName matches a DNS compatible bucket name: 3 to 63 lowercase letters, digits, dots and hyphens, beginning and
+// ending with a letter or digit.
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+var accessPointARN = regexp.MustCompile(`^arn:aws[a-z-]*:s3:[a-z0-9-]+:[0-9]+:accesspoint/[^/]+$`)
+
+// S3URL the location of a file in S3. URL holds the normalised form of the location, either
+// s3://bucket/key or arn:aws:s3:region:account:accesspoint/name/object/key, optionally followed by ?versionId=...
+// Keys are held as they are named in S3, without url encoding.
 type S3URL struct {
 	URL *url.URL
 }
 
 var NilS3URL = S3URL{nil}
 
+// NewS3URL parses an S3 location given in any of the forms:
+//
+//	s3://bucket/key
+//	https://bucket.s3.region.amazonaws.com/key (virtual-hosted style)
+//	https://s3.region.amazonaws.com/bucket/key (path style)
+//	arn:aws:s3:region:account:accesspoint/name/object/key
+//
+// Any form may be followed by ?versionId=... The key of an s3:// location is taken as written, the key of an https
+// location is url decoded.
 func NewS3URL(s string) (S3URL, error) {
 	s3, err := parseUrl(s)
 	if err != nil {
@@ -21,7 +54,12 @@ func NewS3URL(s string) (S3URL, error) {
 }
 
 func (s *S3URL) UnmarshalJSON(b []byte) (err error) {
-	url, err := parseUrl(strings.Trim(string(b), "\"'"))
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		// Accept the unquoted and single quoted forms that were previously accepted.
+		str = strings.Trim(string(b), "\"'")
+	}
+	url, err := parseUrl(str)
 	if err != nil {
 		return err
 	}
@@ -33,30 +71,133 @@ func (s S3URL) MarshalJSON() ([]byte, error) {
 	if s.URL == nil {
 		return []byte("null"), nil
 	}
-	return []byte("\"" + s.URL.String() + "\""), nil
+	return json.Marshal(s.String())
 }
 
 func parseUrl(s string) (*url.URL, error) {
-	var u *url.URL
+	location, versionID := splitVersionID(s)
+
+	var bucket, key string
 	var err error
-	if u, err = url.Parse(s); err != nil {
-		return nil, err
+	switch {
+	case strings.HasPrefix(location, "s3://"):
+		bucket, key = splitFirst(strings.TrimPrefix(location, "s3://"), "/")
+	case strings.HasPrefix(location, "arn:"):
+		bucket, key = splitFirst(location, accessPointObject)
+		if !accessPointARN.MatchString(bucket) {
+			return nil, fmt.Errorf("URL '%s' is not an S3 access point ARN", s)
+		}
+	case strings.HasPrefix(location, "https://"), strings.HasPrefix(location, "http://"):
+		if bucket, key, err = parseHTTPUrl(location); err != nil {
+			return nil, fmt.Errorf("URL '%s' is not an S3 URL: %s", s, err.Error())
+		}
+	default:
+		return nil, fmt.Errorf("URL '%s' does not contain a Bucket", s)
 	}
-	if (len(u.Host)) < 1 {
+
+	if len(bucket) < 1 {
 		return nil, fmt.Errorf("URL '%s' does not contain a Bucket", s)
 	}
-	if (len(strings.TrimLeft(u.Path, "/"))) < 1 {
+	if !strings.HasPrefix(bucket, "arn:") && !bucketName.MatchString(bucket) {
+		return nil, fmt.Errorf("URL '%s' does not contain a valid Bucket name", s)
+	}
+	if len(key) < 1 {
 		return nil, fmt.Errorf("URL '%s' does not contain a FilePath", s)
 	}
-	return u, nil
+	return newUrl(bucket, key, versionID), nil
+}
+
+// parseHTTPUrl returns the bucket and key of a virtual-hosted or path style S3 url.
+func parseHTTPUrl(location string) (string, string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if pathStyleHost.MatchString(host) {
+		bucket, key := splitFirst(path, "/")
+		return bucket, key, nil
+	}
+	if match := virtualHostedHost.FindStringSubmatch(host); match != nil {
+		return match[1], path, nil
+	}
+	return "", "", fmt.Errorf("unknown host '%s'", u.Host)
+}
+
+// splitVersionID separates a trailing ?versionId=... from the location.
+func splitVersionID(s string) (string, string) {
+	i := strings.LastIndex(s, "?")
+	if i < 0 {
+		return s, ""
+	}
+	query, err := url.ParseQuery(s[i+1:])
+	if err != nil || len(query.Get(versionIDParam)) == 0 {
+		return s, ""
+	}
+	return s[:i], query.Get(versionIDParam)
+}
+
+func splitFirst(s string, separator string) (string, string) {
+	if i := strings.Index(s, separator); i >= 0 {
+		return s[:i], s[i+len(separator):]
+	}
+	return s, ""
+}
+
+// newUrl returns the normalised url of the file. The key is held in Opaque so it is not url encoded.
+func newUrl(bucket string, key string, versionID string) *url.URL {
+	u := &url.URL{}
+	if strings.HasPrefix(bucket, "arn:") {
+		u.Scheme = "arn"
+		u.Opaque = strings.TrimPrefix(bucket, "arn:") + accessPointObject + key
+	} else {
+		u.Scheme = "s3"
+		u.Opaque = "//" + bucket + "/" + key
+	}
+	if len(versionID) > 0 {
+		u.RawQuery = url.Values{versionIDParam: {versionID}}.Encode()
+	}
+	return u
 }
 
+func (s *S3URL) parts() (string, string) {
+	if s.URL.Scheme == "arn" {
+		return splitFirst("arn:"+s.URL.Opaque, accessPointObject)
+	}
+	return splitFirst(strings.TrimPrefix(s.URL.Opaque, "//"), "/")
+}
+
+// GetBucketName returns the bucket, or the ARN of the access point.
 func (s *S3URL) GetBucketName() string {
-	return s.URL.Host
+	bucket, _ := s.parts()
+	return bucket
 }
 
+// GetFilePath returns the key of the file.
 func (s *S3URL) GetFilePath() string {
-	return strings.TrimPrefix(s.URL.Path, "/")
+	_, key := s.parts()
+	return key
+}
+
+// GetVersionID returns the version of the file given by the versionId query parameter, or "" for the latest version.
+func (s *S3URL) GetVersionID() string {
+	return s.URL.Query().Get(versionIDParam)
+}
+
+// WithVersionID returns a copy of the url pinned to the given version of the file.
+func (s *S3URL) WithVersionID(versionID string) S3URL {
+	return S3URL{newUrl(s.GetBucketName(), s.GetFilePath(), versionID)}
+}
+
+// IsAccessPoint returns true if the bucket is an access point ARN.
+func (s *S3URL) IsAccessPoint() bool {
+	return s.URL.Scheme == "arn"
 }
 
 func (s *S3URL) String() string {
@@ -113,3 +113,112 @@ func TestInvalidPath(t *testing.T) {
 
 	})
 }
+
+func TestVersionID(t *testing.T) {
+
+	Convey("Given a url with a versionId query parameter", t, func() {
+
+		s3url, err := NewS3URL("s3://bucket/folder/file.csv?versionId=v1")
+
+		Convey("Then the version is returned without changing the file path", func() {
+			So(err, ShouldBeNil)
+			So(s3url.GetVersionID(), ShouldEqual, "v1")
+			So(s3url.GetFilePath(), ShouldEqual, "folder/file.csv")
+		})
+		Convey("and a copy can be pinned to another version", func() {
+			pinned := s3url.WithVersionID("v2")
+			So(pinned.GetVersionID(), ShouldEqual, "v2")
+			So(s3url.GetVersionID(), ShouldEqual, "v1")
+		})
+	})
+}
+
+func TestParseForms(t *testing.T) {
+
+	Convey("Given the same file written in each supported form", t, func() {
+		forms := []string{
+			"s3://bucket/folder/file.csv",
+			"https://bucket.s3.amazonaws.com/folder/file.csv",
+			"https://bucket.s3.eu-west-1.amazonaws.com/folder/file.csv",
+			"https://bucket.s3-eu-west-1.amazonaws.com/folder/file.csv",
+			"https://s3.eu-west-1.amazonaws.com/bucket/folder/file.csv",
+			"https://s3-eu-west-1.amazonaws.com/bucket/folder/file.csv",
+		}
+
+		Convey("Then each is normalised to the s3 form", func() {
+			for _, form := range forms {
+				s3url, err := NewS3URL(form)
+				So(err, ShouldBeNil)
+				So(s3url.GetBucketName(), ShouldEqual, "bucket")
+				So(s3url.GetFilePath(), ShouldEqual, "folder/file.csv")
+				So(s3url.String(), ShouldEqual, "s3://bucket/folder/file.csv")
+			}
+		})
+	})
+
+	Convey("Given an https url with an encoded key and a version", t, func() {
+		s3url, err := NewS3URL("https://bucket.s3.amazonaws.com/folder/my%20file%2B1.csv?versionId=v1")
+
+		Convey("Then the key is decoded and the version kept", func() {
+			So(err, ShouldBeNil)
+			So(s3url.GetFilePath(), ShouldEqual, "folder/my file+1.csv")
+			So(s3url.GetVersionID(), ShouldEqual, "v1")
+			So(s3url.String(), ShouldEqual, "s3://bucket/folder/my file+1.csv?versionId=v1")
+		})
+	})
+
+	Convey("Given an s3 url with characters that would be url encoded", t, func() {
+		s3url, err := NewS3URL("s3://bucket/folder/my file%2B1.csv")
+
+		Convey("Then the key is kept as written and survives a round trip", func() {
+			So(err, ShouldBeNil)
+			So(s3url.GetFilePath(), ShouldEqual, "folder/my file%2B1.csv")
+
+			marshaled, _ := json.Marshal(s3url)
+			var unmarshaled S3URL
+			So(json.Unmarshal(marshaled, &unmarshaled), ShouldBeNil)
+			So(unmarshaled, ShouldResemble, s3url)
+		})
+	})
+
+	Convey("Given an access point ARN", t, func() {
+		s3url, err := NewS3URL("arn:aws:s3:eu-west-1:123456789012:accesspoint/filters/object/folder/file.csv")
+
+		Convey("Then the access point is the bucket and the object is the file path", func() {
+			So(err, ShouldBeNil)
+			So(s3url.IsAccessPoint(), ShouldBeTrue)
+			So(s3url.GetBucketName(), ShouldEqual, "arn:aws:s3:eu-west-1:123456789012:accesspoint/filters")
+			So(s3url.GetFilePath(), ShouldEqual, "folder/file.csv")
+			So(s3url.String(), ShouldEqual, "arn:aws:s3:eu-west-1:123456789012:accesspoint/filters/object/folder/file.csv")
+		})
+	})
+
+	Convey("Given an https url with a port", t, func() {
+		s3url, err := NewS3URL("https://bucket.s3.eu-west-1.amazonaws.com:443/folder/file.csv")
+
+		Convey("Then the bucket is taken from the host without the port", func() {
+			So(err, ShouldBeNil)
+			So(s3url.String(), ShouldEqual, "s3://bucket/folder/file.csv")
+		})
+	})
+
+	Convey("Given urls that are not S3 locations", t, func() {
+		Convey("Then they are rejected", func() {
+			for _, invalid := range []string{
+				"https://example.com/bucket/file.csv",
+				"https://bucket.s3.amazonaws.com/",
+				"arn:aws:s3:eu-west-1:123456789012:bucket/object/file.csv",
+				"ftp://bucket/file.csv",
+				"s3://invalid s3 bucket/file.csv",
+				"s3://Bucket/file.csv",
+				"s3://bu/file.csv",
+				"s3://bucket_name/file.csv",
+				"s3://-bucket/file.csv",
+				"https://s3.eu-west-1.amazonaws.com/bucket_name/file.csv",
+			} {
+				_, err := NewS3URL(invalid)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
@@ -0,0 +1,98 @@
+package ons_aws
+
+import (
+	"fmt"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// The sources of AWS credentials a SessionConfig may use.
+const (
+	// CREDENTIALS_DEFAULT the default chain of the SDK: environment, shared credentials file, then the EC2 role.
+	CREDENTIALS_DEFAULT = "default"
+	// CREDENTIALS_ENV the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables only.
+	CREDENTIALS_ENV = "env"
+	// CREDENTIALS_PROFILE a profile of the shared credentials and config files, which may itself assume a role.
+	CREDENTIALS_PROFILE = "profile"
+	// CREDENTIALS_ASSUME_ROLE a role assumed with the credentials of the default chain.
+	CREDENTIALS_ASSUME_ROLE = "assume-role"
+)
+
+// SessionConfig how the AWS session shared by every operation of a Service is created.
+type SessionConfig struct {
+	Region           string
+	Endpoint         string
+	ForcePathStyle   bool
+	CredentialSource string
+	Profile          string
+	RoleARN          string
+	RoleSessionName  string
+	BucketRegions    map[string]string
+}
+
+// NewSessionConfig create a SessionConfig from the configuration.
+func NewSessionConfig(cfg *config.Config) SessionConfig {
+	return SessionConfig{
+		Region:           cfg.AWSRegion,
+		Endpoint:         cfg.S3Endpoint,
+		ForcePathStyle:   cfg.S3ForcePathStyle,
+		CredentialSource: cfg.AWSCredentialSource,
+		Profile:          cfg.AWSProfile,
+		RoleARN:          cfg.AWSRoleARN,
+		RoleSessionName:  cfg.AWSRoleSessionName,
+		BucketRegions:    cfg.S3BucketRegions,
+	}
+}
+
+// awsConfig the configuration of the session. The SDK does not retry, retries are made by the RetryPolicy so that
+// every operation is classified and backed off in the same way.
+func (c SessionConfig) awsConfig() *aws.Config {
+	awsConfig := &aws.Config{
+		Region:           aws.String(c.Region),
+		MaxRetries:       aws.Int(0),
+		S3ForcePathStyle: aws.Bool(c.ForcePathStyle),
+	}
+	if len(c.Endpoint) > 0 {
+		awsConfig.Endpoint = aws.String(c.Endpoint)
+	}
+	return awsConfig
+}
+
+// newSession create a session using the configured source of credentials.
+func newSession(c SessionConfig) (*session.Session, error) {
+	switch c.CredentialSource {
+	case "", CREDENTIALS_DEFAULT:
+		return session.NewSession(c.awsConfig())
+
+	case CREDENTIALS_ENV:
+		return session.NewSession(c.awsConfig().WithCredentials(credentials.NewEnvCredentials()))
+
+	case CREDENTIALS_PROFILE:
+		return session.NewSessionWithOptions(session.Options{
+			Config:            *c.awsConfig(),
+			Profile:           c.Profile,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+
+	case CREDENTIALS_ASSUME_ROLE:
+		if len(c.RoleARN) == 0 {
+			return nil, fmt.Errorf("A role ARN is required for the '%s' credential source.", CREDENTIALS_ASSUME_ROLE)
+		}
+		// The role is assumed through STS itself, not through a custom S3 endpoint.
+		base, err := session.NewSession(&aws.Config{Region: aws.String(c.Region)})
+		if err != nil {
+			return nil, err
+		}
+		roleCredentials := stscreds.NewCredentials(base, c.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if len(c.RoleSessionName) > 0 {
+				p.RoleSessionName = c.RoleSessionName
+			}
+		})
+		return base.Copy(c.awsConfig().WithCredentials(roleCredentials)), nil
+	}
+	return nil, fmt.Errorf("Unknown AWS credential source '%s'.", c.CredentialSource)
+}
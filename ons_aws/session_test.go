@@ -0,0 +1,121 @@
+package ons_aws
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNewSession(t *testing.T) {
+
+	Convey("Given a session config", t, func() {
+
+		Convey("Then an unknown credential source is rejected", func() {
+			_, err := newSession(SessionConfig{Region: "eu-west-1", CredentialSource: "unknown"})
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Then assuming a role requires a role ARN", func() {
+			_, err := newSession(SessionConfig{Region: "eu-west-1", CredentialSource: CREDENTIALS_ASSUME_ROLE})
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Then a custom endpoint and path style addressing are used", func() {
+			session, err := newSession(SessionConfig{Region: "eu-west-1", Endpoint: "http://localhost:9000", ForcePathStyle: true})
+			So(err, ShouldBeNil)
+			So(*session.Config.Endpoint, ShouldEqual, "http://localhost:9000")
+			So(*session.Config.S3ForcePathStyle, ShouldBeTrue)
+		})
+	})
+}
+
+func TestServiceWithCustomEndpoint(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "access-key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+
+	Convey("Given a service pointing at a local S3 compatible endpoint", t, func() {
+		var paths []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths = append(paths, r.Method+" "+r.URL.Path)
+			w.Header().Set("ETag", `"etag"`)
+			w.Header().Set(bucketRegionHeader, "eu-west-2")
+			w.Write([]byte("header\nrow\n"))
+		}))
+		defer server.Close()
+
+		cfg := config.Default()
+		cfg.S3Endpoint = server.URL
+		cfg.S3ForcePathStyle = true
+		cfg.AWSCredentialSource = CREDENTIALS_ENV
+		service := NewService(cfg)
+		s3url, _ := NewS3URL("s3://bucket/folder/file.csv")
+
+		Convey("Then files are requested from the endpoint using path style addressing, after discovering the bucket region once", func() {
+			reader, err := service.GetCSV(context.Background(), "requestId", s3url)
+			So(err, ShouldBeNil)
+			body, _ := ioutil.ReadAll(reader)
+			reader.Close()
+			So(string(body), ShouldEqual, "header\nrow\n")
+
+			info, err := service.HeadFile(context.Background(), "requestId", s3url)
+			So(err, ShouldBeNil)
+			So(info.ETag, ShouldEqual, `"etag"`)
+
+			So(paths, ShouldResemble, []string{"HEAD /bucket", "GET /bucket/folder/file.csv", "HEAD /bucket/folder/file.csv"})
+			So(service.clients, ShouldContainKey, "eu-west-2")
+		})
+	})
+
+	Convey("Given a service pointing at an endpoint that does not respond", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(bucketRegionHeader, "eu-west-2")
+			if r.Method == "GET" {
+				<-r.Context().Done()
+			}
+		}))
+		defer server.Close()
+
+		cfg := config.Default()
+		cfg.S3Endpoint = server.URL
+		cfg.S3ForcePathStyle = true
+		cfg.AWSCredentialSource = CREDENTIALS_ENV
+		service := NewService(cfg)
+		s3url, _ := NewS3URL("s3://bucket/file.csv")
+
+		Convey("Then a request is aborted once its context times out, and is not retried", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			_, err := service.GetCSV(ctx, "requestId", s3url)
+			So(IsCanceled(err), ShouldBeTrue)
+			So(err.(*Error).Attempts, ShouldEqual, 1)
+			So(err.(*Error).Err == context.DeadlineExceeded, ShouldBeTrue)
+		})
+	})
+	Convey("Given a service pointing at an endpoint that does not respond while discovering the bucket region", t, func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+
+		cfg := config.Default()
+		cfg.S3Endpoint = server.URL
+		cfg.S3ForcePathStyle = true
+		cfg.AWSCredentialSource = CREDENTIALS_ENV
+		service := NewService(cfg)
+		s3url, _ := NewS3URL("s3://bucket/file.csv")
+
+		Convey("Then discovery is aborted once the context times out, and the default region is not cached", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			_, err := service.GetCSV(ctx, "requestId", s3url)
+			So(IsCanceled(err), ShouldBeTrue)
+			So(service.regions.regions, ShouldNotContainKey, "bucket")
+			So(service.regions.fallbacks, ShouldNotContainKey, "bucket")
+		})
+	})
+}
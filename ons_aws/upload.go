@@ -0,0 +1,171 @@
+package ons_aws
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// UploadOptions the encryption, storage class, ACL, tags and metadata applied to an uploaded file. Metadata is set
+// by the service, never by a request.
+type UploadOptions struct {
+	ServerSideEncryption string            `json:"serverSideEncryption,omitempty"`
+	SSEKMSKeyID          string            `json:"-"`
+	StorageClass         string            `json:"storageClass,omitempty"`
+	ACL                  string            `json:"acl,omitempty"`
+	Tags                 map[string]string `json:"tags,omitempty"`
+	Metadata             map[string]string `json:"-"`
+}
+
+// UploadPolicy the default UploadOptions for every upload, and the overrides a request is allowed to make.
+type UploadPolicy struct {
+	Defaults                    UploadOptions
+	KMSKeyIDs                   map[string]string
+	AllowedServerSideEncryption []string
+	AllowedStorageClasses       []string
+	AllowedACLs                 []string
+	AllowedTagKeys              []string
+}
+
+// NewUploadPolicy create an UploadPolicy from the configuration.
+func NewUploadPolicy(cfg *config.Config) UploadPolicy {
+	return UploadPolicy{
+		Defaults: UploadOptions{
+			ServerSideEncryption: cfg.S3ServerSideEncryption,
+			SSEKMSKeyID:          cfg.S3SSEKMSKeyID,
+			StorageClass:         cfg.S3StorageClass,
+			ACL:                  cfg.S3ACL,
+			Tags:                 cfg.S3Tags,
+		},
+		KMSKeyIDs:                   cfg.S3SSEKMSKeyIDs,
+		AllowedServerSideEncryption: cfg.S3AllowedServerSideEncryption,
+		AllowedStorageClasses:       cfg.S3AllowedStorageClasses,
+		AllowedACLs:                 cfg.S3AllowedACLs,
+		AllowedTagKeys:              cfg.S3AllowedTagKeys,
+	}
+}
+
+// Validate checks every override is in the allowlist.
+func (p UploadPolicy) Validate(overrides *UploadOptions) error {
+	if overrides == nil {
+		return nil
+	}
+	if len(overrides.ServerSideEncryption) > 0 && !contains(p.AllowedServerSideEncryption, overrides.ServerSideEncryption) {
+		return fmt.Errorf("Server side encryption '%s' is not allowed.", overrides.ServerSideEncryption)
+	}
+	if len(overrides.StorageClass) > 0 && !contains(p.AllowedStorageClasses, overrides.StorageClass) {
+		return fmt.Errorf("Storage class '%s' is not allowed.", overrides.StorageClass)
+	}
+	if len(overrides.ACL) > 0 && !contains(p.AllowedACLs, overrides.ACL) {
+		return fmt.Errorf("ACL '%s' is not allowed.", overrides.ACL)
+	}
+	for key := range overrides.Tags {
+		if !contains(p.AllowedTagKeys, key) {
+			return fmt.Errorf("Tag '%s' is not allowed.", key)
+		}
+	}
+	return nil
+}
+
+// Resolve returns the options for an upload to the bucket, with any allowed overrides applied over the defaults.
+func (p UploadPolicy) Resolve(bucket string, overrides *UploadOptions) (UploadOptions, error) {
+	if err := p.Validate(overrides); err != nil {
+		return UploadOptions{}, err
+	}
+
+	options := p.Defaults
+	options.Tags = make(map[string]string)
+	for key, value := range p.Defaults.Tags {
+		options.Tags[key] = value
+	}
+	if keyID, ok := p.KMSKeyIDs[bucket]; ok {
+		options.SSEKMSKeyID = keyID
+	}
+
+	if overrides != nil {
+		if len(overrides.ServerSideEncryption) > 0 {
+			options.ServerSideEncryption = overrides.ServerSideEncryption
+		}
+		if len(overrides.StorageClass) > 0 {
+			options.StorageClass = overrides.StorageClass
+		}
+		if len(overrides.ACL) > 0 {
+			options.ACL = overrides.ACL
+		}
+		for key, value := range overrides.Tags {
+			options.Tags[key] = value
+		}
+		options.Metadata = overrides.Metadata
+	}
+
+	if options.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		options.SSEKMSKeyID = ""
+	}
+	return options, nil
+}
+
+// apply sets the options on the upload input.
+func (o UploadOptions) apply(input *s3manager.UploadInput) {
+	if len(o.ServerSideEncryption) > 0 {
+		input.ServerSideEncryption = aws.String(o.ServerSideEncryption)
+	}
+	if len(o.SSEKMSKeyID) > 0 {
+		input.SSEKMSKeyId = aws.String(o.SSEKMSKeyID)
+	}
+	if len(o.StorageClass) > 0 {
+		input.StorageClass = aws.String(o.StorageClass)
+	}
+	if len(o.ACL) > 0 {
+		input.ACL = aws.String(o.ACL)
+	}
+	if len(o.Tags) > 0 {
+		input.Tagging = aws.String(encodeTags(o.Tags))
+	}
+	if len(o.Metadata) > 0 {
+		input.Metadata = aws.StringMap(o.Metadata)
+	}
+}
+
+// applyCopy sets the options on the copy request, replacing any tags of the source file, and its metadata if any is set.
+func (o UploadOptions) applyCopy(input *s3.CopyObjectInput) {
+	if len(o.ServerSideEncryption) > 0 {
+		input.ServerSideEncryption = aws.String(o.ServerSideEncryption)
+	}
+	if len(o.SSEKMSKeyID) > 0 {
+		input.SSEKMSKeyId = aws.String(o.SSEKMSKeyID)
+	}
+	if len(o.StorageClass) > 0 {
+		input.StorageClass = aws.String(o.StorageClass)
+	}
+	if len(o.ACL) > 0 {
+		input.ACL = aws.String(o.ACL)
+	}
+	input.TaggingDirective = aws.String(s3.TaggingDirectiveReplace)
+	input.Tagging = aws.String(encodeTags(o.Tags))
+	if len(o.Metadata) > 0 {
+		input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+		input.Metadata = aws.StringMap(o.Metadata)
+	}
+}
+
+// encodeTags encodes the tags as the url query string expected by the x-amz-tagging header.
+func encodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
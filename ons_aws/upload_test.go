@@ -0,0 +1,74 @@
+package ons_aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func newTestUploadPolicy() UploadPolicy {
+	return UploadPolicy{
+		Defaults: UploadOptions{
+			ServerSideEncryption: "aws:kms",
+			SSEKMSKeyID:          "default-key",
+			StorageClass:         "STANDARD",
+			Tags:                 map[string]string{"service": "csv-filter"},
+		},
+		KMSKeyIDs:             map[string]string{"secure-bucket": "secure-key"},
+		AllowedStorageClasses: []string{"STANDARD_IA"},
+		AllowedTagKeys:        []string{"dataset"},
+	}
+}
+
+func TestUploadPolicyResolve(t *testing.T) {
+
+	Convey("Given an upload policy with defaults", t, func() {
+		policy := newTestUploadPolicy()
+
+		Convey("Then the defaults are used when there are no overrides", func() {
+			options, err := policy.Resolve("bucket", nil)
+			So(err, ShouldBeNil)
+			So(options.ServerSideEncryption, ShouldEqual, "aws:kms")
+			So(options.SSEKMSKeyID, ShouldEqual, "default-key")
+			So(options.StorageClass, ShouldEqual, "STANDARD")
+		})
+		Convey("Then the KMS key of the bucket is used when it has one", func() {
+			options, err := policy.Resolve("secure-bucket", nil)
+			So(err, ShouldBeNil)
+			So(options.SSEKMSKeyID, ShouldEqual, "secure-key")
+		})
+		Convey("Then allowed overrides are applied over the defaults", func() {
+			options, err := policy.Resolve("bucket", &UploadOptions{StorageClass: "STANDARD_IA", Tags: map[string]string{"dataset": "prodcom"}})
+			So(err, ShouldBeNil)
+			So(options.StorageClass, ShouldEqual, "STANDARD_IA")
+			So(options.Tags, ShouldResemble, map[string]string{"service": "csv-filter", "dataset": "prodcom"})
+			So(policy.Defaults.Tags, ShouldResemble, map[string]string{"service": "csv-filter"})
+		})
+		Convey("Then overrides outside the allowlist are rejected", func() {
+			_, err := policy.Resolve("bucket", &UploadOptions{StorageClass: "GLACIER"})
+			So(err, ShouldNotBeNil)
+			_, err = policy.Resolve("bucket", &UploadOptions{ACL: "public-read"})
+			So(err, ShouldNotBeNil)
+			_, err = policy.Resolve("bucket", &UploadOptions{Tags: map[string]string{"owner": "someone"}})
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestUploadOptionsApply(t *testing.T) {
+
+	Convey("Given resolved upload options applied to an upload input", t, func() {
+		options, _ := newTestUploadPolicy().Resolve("secure-bucket", nil)
+		input := &s3manager.UploadInput{}
+		options.apply(input)
+
+		Convey("Then the input has the encryption, storage class and tags set", func() {
+			So(*input.ServerSideEncryption, ShouldEqual, "aws:kms")
+			So(*input.SSEKMSKeyId, ShouldEqual, "secure-key")
+			So(*input.StorageClass, ShouldEqual, "STANDARD")
+			So(*input.Tagging, ShouldEqual, "service=csv-filter")
+			So(input.ACL, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,185 @@
+package outbox
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	"github.com/ONSdigital/go-ns/log"
+	"github.com/Shopify/sarama"
+)
+
+// RetryPolicy the backoff between attempts to send a message. It doubles after each failed attempt.
+type RetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// NewRetryPolicy create a RetryPolicy from the configuration.
+func NewRetryPolicy(cfg *config.Config) RetryPolicy {
+	return RetryPolicy{
+		InitialBackoff: cfg.OutboxRetryBackoff,
+		MaxBackoff:     cfg.OutboxRetryMaxBackoff,
+	}
+}
+
+// backoff the time to wait after the given number of failed attempts.
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempts; i++ {
+		if backoff *= 2; p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+// Outbox sends messages to Kafka once the files they refer to have been uploaded. Each message is recorded in the
+// store before it is sent and removed once Kafka has acknowledged it, so a message that fails to send, or that had
+// not been sent when the service stopped, is retried until it is sent. A message may be sent more than once, e.g. if
+// the service stops between sending it and removing it, but is not lost.
+type Outbox struct {
+	store    Store
+	producer sarama.SyncProducer
+	policy   RetryPolicy
+	started  time.Time
+	mutex    sync.Mutex
+	states   map[string]*state
+}
+
+// state the progress of sending an entry recorded by this outbox, or found in the store. An entry that has been sent
+// but could not be removed from the store is not sent again, only removed.
+type state struct {
+	sending  bool
+	sent     bool
+	attempts int
+	next     time.Time
+}
+
+// New create an Outbox recording messages in the store and sending them with the producer.
+func New(store Store, producer sarama.SyncProducer, policy RetryPolicy) *Outbox {
+	return &Outbox{store: store, producer: producer, policy: policy, started: time.Now(), states: make(map[string]*state)}
+}
+
+// Send records the message and then sends it to the topic. An error is returned only if the message could not be
+// recorded. A message that is recorded but fails to send is retried by Run.
+func (o *Outbox) Send(requestID string, topic string, message []byte) error {
+	entry := newEntry(requestID, topic, message)
+
+	o.mutex.Lock()
+	o.states[entry.ID] = &state{sending: true}
+	o.mutex.Unlock()
+
+	if err := o.store.Add(entry); err != nil {
+		o.mutex.Lock()
+		delete(o.states, entry.ID)
+		o.mutex.Unlock()
+		return err
+	}
+	o.deliver(entry)
+	return nil
+}
+
+// Run sends the recorded messages that are due until stop is closed, starting with any left by a previous run of the
+// service.
+func (o *Outbox) Run(stop <-chan struct{}) {
+	for {
+		if _, err := o.Reconcile(); err != nil {
+			log.Error(err, log.Data{"message": "Failed to list the messages in the outbox"})
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(o.policy.InitialBackoff):
+		}
+	}
+}
+
+// Reconcile sends every recorded message that is due: those that failed to send and are past their backoff, and
+// those left by a previous run of the service. Messages that were sent but could not be removed from the store are
+// removed. It returns the number of messages still in the outbox.
+func (o *Outbox) Reconcile() (int, error) {
+	entries, err := o.store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	pending, recovered := 0, 0
+	for _, entry := range entries {
+		o.mutex.Lock()
+		s, ok := o.states[entry.ID]
+		if !ok {
+			if !entry.Created.Before(o.started) {
+				// Recorded by Send since the store was listed, which is sending it.
+				o.mutex.Unlock()
+				continue
+			}
+			s = &state{}
+			o.states[entry.ID] = s
+			recovered++
+		}
+		if s.sending || now.Before(s.next) {
+			o.mutex.Unlock()
+			pending++
+			continue
+		}
+		s.sending = true
+		o.mutex.Unlock()
+
+		if !o.deliver(entry) {
+			pending++
+		}
+	}
+
+	if recovered > 0 {
+		log.Debug("Sent messages left in the outbox by a previous run", log.Data{"recovered": recovered, "pending": pending})
+	}
+	return pending, nil
+}
+
+// deliver sends an entry that has been marked as sending, unless it has already been sent, and then removes it from
+// the store. If either fails another attempt is scheduled. It returns whether the entry was sent and removed.
+func (o *Outbox) deliver(entry *Entry) bool {
+	o.mutex.Lock()
+	sent := o.states[entry.ID].sent
+	o.mutex.Unlock()
+
+	if !sent {
+		partition, offset, err := o.producer.SendMessage(&sarama.ProducerMessage{
+			Topic: entry.Topic,
+			Value: sarama.ByteEncoder(entry.Message),
+		})
+		if err != nil {
+			attempts, backoff := o.retry(entry, false)
+			log.ErrorC(entry.RequestID, err, log.Data{"details": "Failed to send message, it will be retried", "topic": entry.Topic, "outboxId": entry.ID, "attempts": attempts, "backoff": backoff.String()})
+			return false
+		}
+		log.DebugC(entry.RequestID, "Sent message", log.Data{"topic": entry.Topic, "partition": partition, "offset": offset, "outboxId": entry.ID})
+	}
+
+	if err := o.store.Remove(entry.ID); err != nil {
+		attempts, backoff := o.retry(entry, true)
+		log.ErrorC(entry.RequestID, err, log.Data{"details": "Failed to remove a sent message from the outbox, the remove will be retried", "outboxId": entry.ID, "attempts": attempts, "backoff": backoff.String()})
+		return false
+	}
+
+	o.mutex.Lock()
+	delete(o.states, entry.ID)
+	o.mutex.Unlock()
+	return true
+}
+
+// retry schedules another attempt to deliver the entry after a backoff, recording whether it has been sent. It returns
+// the number of failed attempts and the backoff.
+func (o *Outbox) retry(entry *Entry, sent bool) (int, time.Duration) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	s := o.states[entry.ID]
+	s.sending = false
+	s.sent = sent
+	s.attempts++
+	backoff := o.policy.backoff(s.attempts)
+	s.next = time.Now().Add(backoff)
+	return s.attempts, backoff
+}
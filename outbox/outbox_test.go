@@ -0,0 +1,193 @@
+package outbox
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// mockProducer records the messages sent, failing while err is set.
+type mockProducer struct {
+	mutex    sync.Mutex
+	attempts int
+	sent     []string
+	err      error
+}
+
+func (p *mockProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.attempts++
+	if p.err != nil {
+		return 0, 0, p.err
+	}
+	value, _ := msg.Value.Encode()
+	p.sent = append(p.sent, msg.Topic+":"+string(value))
+	return 0, int64(len(p.sent)), nil
+}
+
+func (p *mockProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	return errors.New("Should not be calling SendMessages!")
+}
+
+func (p *mockProducer) Close() error {
+	return nil
+}
+
+// failingStore a store that cannot record entries.
+type failingStore struct {
+	*MemoryStore
+}
+
+func (s failingStore) Add(entry *Entry) error {
+	return errors.New("disk full")
+}
+
+// flakyStore a store that fails to remove entries while removeErr is set.
+type flakyStore struct {
+	*MemoryStore
+	removeErr error
+}
+
+func (s *flakyStore) Remove(id string) error {
+	if s.removeErr != nil {
+		return s.removeErr
+	}
+	return s.MemoryStore.Remove(id)
+}
+
+var policy = RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond}
+
+func TestOutbox(t *testing.T) {
+
+	Convey("Given an outbox", t, func() {
+		store := NewMemoryStore()
+		producer := &mockProducer{}
+		outbox := New(store, producer, policy)
+
+		Convey("When a message is sent", func() {
+			err := outbox.Send("requestId", "topic", []byte("message"))
+
+			Convey("Then it is sent and removed from the store", func() {
+				So(err, ShouldBeNil)
+				So(producer.sent, ShouldResemble, []string{"topic:message"})
+				entries, _ := store.List()
+				So(len(entries), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When a message fails to send", func() {
+			producer.err = errors.New("kafka: client has run out of available brokers")
+			err := outbox.Send("requestId", "topic", []byte("message"))
+
+			Convey("Then it is kept in the store", func() {
+				So(err, ShouldBeNil)
+				entries, _ := store.List()
+				So(len(entries), ShouldEqual, 1)
+				So(entries[0].RequestID, ShouldEqual, "requestId")
+			})
+
+			Convey("Then it is not retried before its backoff", func() {
+				producer.err = nil
+				pending, err := outbox.Reconcile()
+				So(err, ShouldBeNil)
+				So(pending, ShouldEqual, 1)
+				So(len(producer.sent), ShouldEqual, 0)
+			})
+
+			Convey("Then it is retried after its backoff until it is sent", func() {
+				time.Sleep(policy.InitialBackoff)
+				pending, _ := outbox.Reconcile()
+				So(pending, ShouldEqual, 1)
+				So(producer.attempts, ShouldEqual, 2)
+
+				producer.err = nil
+				time.Sleep(2 * policy.InitialBackoff)
+				pending, _ = outbox.Reconcile()
+				So(pending, ShouldEqual, 0)
+				So(producer.sent, ShouldResemble, []string{"topic:message"})
+				entries, _ := store.List()
+				So(len(entries), ShouldEqual, 0)
+			})
+		})
+	})
+
+	Convey("Given messages left in the store by a previous run", t, func() {
+		dir, _ := ioutil.TempDir("", "outbox")
+		defer os.RemoveAll(dir)
+		store, _ := NewFileStore(dir)
+		store.Add(newEntry("first", "topic", []byte("1")))
+		store.Add(newEntry("second", "topic", []byte("2")))
+		producer := &mockProducer{}
+
+		Convey("When the outbox is started", func() {
+			outbox := New(store, producer, policy)
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				outbox.Run(stop)
+				close(done)
+			}()
+			time.Sleep(policy.InitialBackoff / 2)
+			close(stop)
+			<-done
+
+			Convey("Then they are sent in the order they were recorded", func() {
+				So(producer.sent, ShouldResemble, []string{"topic:1", "topic:2"})
+				entries, _ := store.List()
+				So(len(entries), ShouldEqual, 0)
+			})
+		})
+	})
+
+	Convey("Given a store that fails to remove a sent message", t, func() {
+		store := &flakyStore{MemoryStore: NewMemoryStore(), removeErr: errors.New("read-only file system")}
+		producer := &mockProducer{}
+		outbox := New(store, producer, policy)
+		err := outbox.Send("requestId", "topic", []byte("message"))
+
+		Convey("Then it is kept, and its removal is retried after its backoff without sending it again", func() {
+			So(err, ShouldBeNil)
+			entries, _ := store.List()
+			So(len(entries), ShouldEqual, 1)
+
+			store.removeErr = nil
+			time.Sleep(policy.InitialBackoff)
+			pending, _ := outbox.Reconcile()
+			So(pending, ShouldEqual, 0)
+			So(producer.sent, ShouldResemble, []string{"topic:message"})
+			entries, _ = store.List()
+			So(len(entries), ShouldEqual, 0)
+		})
+	})
+
+	Convey("Given a store that cannot record messages", t, func() {
+		producer := &mockProducer{}
+		outbox := New(failingStore{NewMemoryStore()}, producer, policy)
+
+		Convey("When a message is sent", func() {
+			err := outbox.Send("requestId", "topic", []byte("message"))
+
+			Convey("Then an error is returned and nothing is sent", func() {
+				So(err, ShouldNotBeNil)
+				So(producer.attempts, ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestRetryPolicy(t *testing.T) {
+
+	Convey("The backoff doubles after each attempt up to the maximum", t, func() {
+		So(policy.backoff(1), ShouldEqual, 10*time.Millisecond)
+		So(policy.backoff(2), ShouldEqual, 20*time.Millisecond)
+		So(policy.backoff(3), ShouldEqual, 40*time.Millisecond)
+		So(policy.backoff(10), ShouldEqual, 40*time.Millisecond)
+	})
+}
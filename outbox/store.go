@@ -0,0 +1,188 @@
+package outbox
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/go-ns/log"
+)
+
+const entryFileExt = ".json"
+
+// Entry a message that is waiting to be sent. It is recorded once the file it refers to has been uploaded, and
+// removed once the message has been sent.
+type Entry struct {
+	ID        string    `json:"id"`
+	RequestID string    `json:"requestId"`
+	Topic     string    `json:"topic"`
+	Message   []byte    `json:"message"`
+	Created   time.Time `json:"created"`
+}
+
+// newEntry create an Entry with a new ID. IDs begin with the time they were created, so sort in the order the
+// entries were made.
+func newEntry(requestID string, topic string, message []byte) *Entry {
+	random := make([]byte, 4)
+	rand.Read(random)
+	created := time.Now().UTC()
+	return &Entry{
+		ID:        fmt.Sprintf("%019d-%s", created.UnixNano(), hex.EncodeToString(random)),
+		RequestID: requestID,
+		Topic:     topic,
+		Message:   message,
+		Created:   created,
+	}
+}
+
+// Store keeps the entries of an outbox.
+type Store interface {
+	Add(entry *Entry) error
+	Remove(id string) error
+	List() ([]*Entry, error)
+}
+
+// NewStore returns a FileStore keeping entries in the directory, or a MemoryStore if the directory is empty.
+func NewStore(dir string) (Store, error) {
+	if len(dir) == 0 {
+		return NewMemoryStore(), nil
+	}
+	return NewFileStore(dir)
+}
+
+// FileStore keeps each entry in a file of its own, so that entries survive the service stopping.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore create a FileStore in the directory, creating the directory if it does not exist.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Add writes the entry to a temporary file that is renamed once it has been synced, so that an entry is either
+// recorded completely or not at all.
+func (s *FileStore) Add(entry *Entry) error {
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(entryJSON); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), s.path(entry.ID))
+}
+
+func (s *FileStore) Remove(id string) error {
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns every entry in the order they were added. Files that cannot be read are logged and skipped, so that
+// one damaged entry does not stop the others being sent.
+func (s *FileStore) List() ([]*Entry, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*Entry{}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || filepath.Ext(file.Name()) != entryFileExt {
+			continue
+		}
+		path := filepath.Join(s.dir, file.Name())
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Error(err, log.Data{"message": "Failed to read outbox entry", "path": path})
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(b, &entry); err != nil {
+			log.Error(err, log.Data{"message": "Failed to decode outbox entry", "path": path})
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, id+entryFileExt)
+}
+
+// MemoryStore keeps entries in memory, so they are lost if the service stops. For local use and tests.
+type MemoryStore struct {
+	mutex   sync.Mutex
+	entries map[string]*Entry
+}
+
+// NewMemoryStore create an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*Entry)}
+}
+
+func (s *MemoryStore) Add(entry *Entry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries[entry.ID] = entry
+	return nil
+}
+
+func (s *MemoryStore) Remove(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.entries, id)
+	return nil
+}
+
+func (s *MemoryStore) List() ([]*Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entries := make([]*Entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+func sortEntries(entries []*Entry) {
+	sort.Sort(byID(entries))
+}
+
+// byID sorts entries by ID, which is the order they were created.
+type byID []*Entry
+
+func (e byID) Len() int           { return len(e) }
+func (e byID) Less(i, j int) bool { return e[i].ID < e[j].ID }
+func (e byID) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
@@ -0,0 +1,56 @@
+package outbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileStore(t *testing.T) {
+
+	Convey("Given a file store", t, func() {
+		dir, _ := ioutil.TempDir("", "outbox")
+		defer os.RemoveAll(dir)
+		store, err := NewFileStore(filepath.Join(dir, "outbox"))
+		So(err, ShouldBeNil)
+
+		first := newEntry("first", "topic", []byte(`{"requestId":"first"}`))
+		second := newEntry("second", "topic", []byte(`{"requestId":"second"}`))
+		So(store.Add(second), ShouldBeNil)
+		So(store.Add(first), ShouldBeNil)
+
+		Convey("Then entries are listed in the order they were created", func() {
+			entries, err := store.List()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 2)
+			So(entries[0].ID, ShouldEqual, first.ID)
+			So(string(entries[0].Message), ShouldEqual, `{"requestId":"first"}`)
+			So(entries[1].RequestID, ShouldEqual, "second")
+		})
+
+		Convey("Then entries survive the store being reopened", func() {
+			reopened, _ := NewFileStore(filepath.Join(dir, "outbox"))
+			entries, _ := reopened.List()
+			So(len(entries), ShouldEqual, 2)
+		})
+
+		Convey("Then a removed entry is not listed", func() {
+			So(store.Remove(first.ID), ShouldBeNil)
+			So(store.Remove(first.ID), ShouldBeNil)
+			entries, _ := store.List()
+			So(len(entries), ShouldEqual, 1)
+			So(entries[0].ID, ShouldEqual, second.ID)
+		})
+
+		Convey("Then damaged and partly written entries are skipped", func() {
+			ioutil.WriteFile(filepath.Join(dir, "outbox", "damaged.json"), []byte("{"), 0600)
+			ioutil.WriteFile(filepath.Join(dir, "outbox", ".tmp-123"), []byte("{"), 0600)
+			entries, err := store.List()
+			So(err, ShouldBeNil)
+			So(len(entries), ShouldEqual, 2)
+		})
+	})
+}
@@ -0,0 +1,310 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ONSdigital/dp-dd-csv-filter/config"
+	"github.com/ONSdigital/go-ns/log"
+)
+
+// batchSize the number of ended spans that are exported together.
+const batchSize = 256
+
+// exportInterval the longest time an ended span waits before it is exported.
+const exportInterval = 5 * time.Second
+
+// Exporter sends ended spans to be stored.
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+var spans = &batcher{}
+
+// Configure exports spans using the exporter named in the configuration.
+func Configure(cfg *config.Config) {
+	SetExporter(NewExporter(cfg))
+}
+
+// NewExporter returns the exporter named in the configuration: "otlp" to send spans to the OTLP endpoint, "stdout"
+// to write them to stdout, or nil for "none", when spans are not exported.
+func NewExporter(cfg *config.Config) Exporter {
+	switch cfg.TracesExporter {
+	case "otlp":
+		return NewOTLPExporter(cfg.OTLPEndpoint, cfg.ServiceName)
+	case "stdout":
+		return NewStdoutExporter(os.Stdout)
+	case "none", "":
+		return nil
+	}
+	log.Error(fmt.Errorf("Unknown traces exporter '%s'.", cfg.TracesExporter), nil)
+	return nil
+}
+
+// SetExporter replaces the exporter, after exporting any spans queued for the previous one. A nil exporter stops
+// spans being exported.
+func SetExporter(exporter Exporter) {
+	spans.flush()
+	spans.mutex.Lock()
+	spans.exporter = exporter
+	spans.mutex.Unlock()
+}
+
+// Flush exports every ended span now, e.g. before the service stops.
+func Flush() {
+	spans.flush()
+}
+
+// batcher queues ended spans and exports them in batches.
+type batcher struct {
+	mutex    sync.Mutex
+	exporter Exporter
+	queue    []*Span
+	timer    *time.Timer
+}
+
+func (b *batcher) add(span *Span) {
+	b.mutex.Lock()
+	if b.exporter == nil {
+		b.mutex.Unlock()
+		return
+	}
+	b.queue = append(b.queue, span)
+	if len(b.queue) >= batchSize {
+		exporter, batch := b.exporter, b.take()
+		b.mutex.Unlock()
+		go export(exporter, batch)
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(exportInterval, b.flush)
+	}
+	b.mutex.Unlock()
+}
+
+func (b *batcher) flush() {
+	b.mutex.Lock()
+	exporter, batch := b.exporter, b.take()
+	b.mutex.Unlock()
+	export(exporter, batch)
+}
+
+// take empties the queue. The caller must hold the mutex.
+func (b *batcher) take() []*Span {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.queue
+	b.queue = nil
+	return batch
+}
+
+func export(exporter Exporter, batch []*Span) {
+	if exporter == nil || len(batch) == 0 {
+		return
+	}
+	if err := exporter.Export(batch); err != nil {
+		log.Error(err, log.Data{"spans": len(batch)})
+	}
+}
+
+// StdoutExporter writes each span as a line of json, for local use.
+type StdoutExporter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewStdoutExporter create a StdoutExporter writing to w.
+func NewStdoutExporter(w io.Writer) *StdoutExporter {
+	return &StdoutExporter{w: w}
+}
+
+type stdoutSpan struct {
+	Name         string                 `json:"name"`
+	Kind         string                 `json:"kind"`
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Start        time.Time              `json:"start"`
+	DurationNs   int64                  `json:"duration_ns"`
+	Attributes   map[string]interface{} `json:"attributes"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+var kindNames = map[int]string{KIND_INTERNAL: "internal", KIND_SERVER: "server", KIND_CLIENT: "client", KIND_PRODUCER: "producer", KIND_CONSUMER: "consumer"}
+
+func (e *StdoutExporter) Export(spans []*Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	encoder := json.NewEncoder(e.w)
+	for _, span := range spans {
+		s := stdoutSpan{
+			Name:         span.Name,
+			Kind:         kindNames[span.Kind],
+			TraceID:      span.TraceID,
+			SpanID:       span.SpanID,
+			ParentSpanID: span.ParentID,
+			Start:        span.StartTime,
+			DurationNs:   span.EndTime.Sub(span.StartTime).Nanoseconds(),
+			Attributes:   span.Attributes,
+		}
+		if span.Err != nil {
+			s.Error = span.Err.Error()
+		}
+		if err := encoder.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector using OTLP over http, encoded as json.
+type OTLPExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+}
+
+// NewOTLPExporter create an OTLPExporter sending to the collector at the endpoint, e.g. "http://localhost:4318".
+func NewOTLPExporter(endpoint string, serviceName string) *OTLPExporter {
+	return &OTLPExporter{
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func (e *OTLPExporter) Export(spans []*Span) error {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		otlpSpans[i] = otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+			Status:            otlpStatus{Code: 1},
+		}
+		if span.Err != nil {
+			otlpSpans[i].Status = otlpStatus{Code: 2, Message: span.Err.Error()}
+		}
+	}
+
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": e.serviceName})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: e.serviceName}, Spans: otlpSpans}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Sending spans to '%s' failed with status %d.", e.url, resp.StatusCode)
+	}
+	return nil
+}
+
+// otlpAttributes converts attributes to OTLP key values, in order of key.
+func otlpAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]otlpKeyValue, len(keys))
+	for i, key := range keys {
+		var value otlpAnyValue
+		switch v := attributes[key].(type) {
+		case string:
+			value.StringValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(v, 10)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		case bool:
+			value.BoolValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		result[i] = otlpKeyValue{Key: key, Value: value}
+	}
+	return result
+}
@@ -0,0 +1,82 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func endedSpan() *Span {
+	span := &Span{
+		Name:       "S3 GetObject",
+		Kind:       KIND_CLIENT,
+		TraceID:    "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:     "00f067aa0ba902b7",
+		StartTime:  time.Unix(1, 0),
+		EndTime:    time.Unix(2, 0),
+		Attributes: map[string]interface{}{REQUEST_ID: "requestId", S3_BUCKET: "bucket", BYTES: int64(10)},
+	}
+	return span
+}
+
+func TestExporters(t *testing.T) {
+
+	Convey("Given an OTLP exporter", t, func() {
+		var path, contentType string
+		var body []byte
+		status := http.StatusOK
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+			body, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+		exporter := NewOTLPExporter(server.URL+"/", "dp-dd-csv-filter")
+
+		Convey("Then spans are sent as json to the traces endpoint", func() {
+			span := endedSpan()
+			span.Err = errors.New("failed")
+			So(exporter.Export([]*Span{span}), ShouldBeNil)
+
+			So(path, ShouldEqual, "/v1/traces")
+			So(contentType, ShouldEqual, "application/json")
+			So(string(body), ShouldContainSubstring, `"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"dp-dd-csv-filter"}}]}`)
+			So(string(body), ShouldContainSubstring, `"traceId":"4bf92f3577b34da6a3ce929d0e0e4736","spanId":"00f067aa0ba902b7","name":"S3 GetObject","kind":3`)
+			So(string(body), ShouldContainSubstring, `"startTimeUnixNano":"1000000000","endTimeUnixNano":"2000000000"`)
+			So(string(body), ShouldContainSubstring, `{"key":"aws.s3.bucket","value":{"stringValue":"bucket"}},{"key":"bytes","value":{"intValue":"10"}}`)
+			So(string(body), ShouldContainSubstring, `"status":{"code":2,"message":"failed"}`)
+		})
+
+		Convey("Then a failure of the collector is returned", func() {
+			status = http.StatusServiceUnavailable
+			err := exporter.Export([]*Span{endedSpan()})
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldEqual, "Sending spans to '"+server.URL+"/v1/traces' failed with status 503.")
+		})
+	})
+
+	Convey("Given a stdout exporter", t, func() {
+		var out bytes.Buffer
+		exporter := NewStdoutExporter(&out)
+
+		Convey("Then each span is written as a line of json", func() {
+			So(exporter.Export([]*Span{endedSpan(), endedSpan()}), ShouldBeNil)
+
+			lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+			So(len(lines), ShouldEqual, 2)
+			var span map[string]interface{}
+			So(json.Unmarshal(lines[0], &span), ShouldBeNil)
+			So(span["name"], ShouldEqual, "S3 GetObject")
+			So(span["kind"], ShouldEqual, "client")
+			So(span["duration_ns"], ShouldEqual, 1e9)
+			So(span["attributes"].(map[string]interface{})[S3_BUCKET], ShouldEqual, "bucket")
+		})
+	})
+}
@@ -0,0 +1,183 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// The kinds of span, numbered as in OpenTelemetry.
+const (
+	KIND_INTERNAL = 1
+	KIND_SERVER   = 2
+	KIND_CLIENT   = 3
+	KIND_PRODUCER = 4
+	KIND_CONSUMER = 5
+)
+
+// The keys of the attributes recorded on spans.
+const (
+	REQUEST_ID   = "request.id"
+	S3_BUCKET    = "aws.s3.bucket"
+	S3_KEY       = "aws.s3.key"
+	BYTES        = "bytes"
+	ROWS_SCANNED = "rows.scanned"
+	ROWS_KEPT    = "rows.kept"
+)
+
+var traceParentPattern = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// Span a timed operation within a trace, in the form of an OpenTelemetry span.
+type Span struct {
+	Name       string
+	Kind       int
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]interface{}
+	Err        error
+
+	requestID string
+	previous  *Span
+	active    bool
+	mutex     sync.Mutex
+}
+
+// active the span of each request that new spans of the request are started within.
+var active = struct {
+	sync.Mutex
+	spans map[string]*Span
+}{spans: make(map[string]*Span)}
+
+// Start starts a span within the active span of the request, or as a new trace if the request has none.
+func Start(requestID string, name string, kind int) *Span {
+	active.Lock()
+	parent := active.spans[requestID]
+	active.Unlock()
+
+	span := newSpan(requestID, name, kind)
+	if parent != nil {
+		span.TraceID, span.ParentID = parent.TraceID, parent.SpanID
+	}
+	return span
+}
+
+// StartRequest starts a span for the handling of a request, which is active until it ends. If the request has no
+// active span the span continues the trace of the traceparent.
+func StartRequest(requestID string, name string, kind int, traceParent string) *Span {
+	active.Lock()
+	defer active.Unlock()
+
+	span := newSpan(requestID, name, kind)
+	if parent := active.spans[requestID]; parent != nil {
+		span.TraceID, span.ParentID = parent.TraceID, parent.SpanID
+	} else if traceID, parentID, _, ok := ParseTraceParent(traceParent); ok {
+		span.TraceID, span.ParentID = traceID, parentID
+	}
+	span.previous = active.spans[requestID]
+	span.active = true
+	active.spans[requestID] = span
+	return span
+}
+
+func newSpan(requestID string, name string, kind int) *Span {
+	return &Span{
+		Name:       name,
+		Kind:       kind,
+		TraceID:    NewTraceID(),
+		SpanID:     NewSpanID(),
+		StartTime:  time.Now(),
+		Attributes: map[string]interface{}{REQUEST_ID: requestID},
+		requestID:  requestID,
+	}
+}
+
+// SetAttribute records an attribute of the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Attributes[key] = value
+}
+
+// SetError records that the span failed. A nil error is ignored.
+func (s *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Err = err
+}
+
+// End ends the span and queues it for export. A span that has already ended is ignored.
+func (s *Span) End() {
+	s.mutex.Lock()
+	if !s.EndTime.IsZero() {
+		s.mutex.Unlock()
+		return
+	}
+	s.EndTime = time.Now()
+	s.mutex.Unlock()
+
+	if s.active {
+		active.Lock()
+		if active.spans[s.requestID] == s {
+			if s.previous != nil {
+				active.spans[s.requestID] = s.previous
+			} else {
+				delete(active.spans, s.requestID)
+			}
+		}
+		active.Unlock()
+	}
+	spans.add(s)
+}
+
+// TraceParent returns the W3C traceparent that makes this span the parent of work done elsewhere.
+func (s *Span) TraceParent() string {
+	return FormatTraceParent(s.TraceID, s.SpanID, "01")
+}
+
+// ParseTraceParent returns the trace ID, parent ID and flags of a W3C traceparent, and whether it is valid.
+func ParseTraceParent(traceParent string) (traceID string, parentID string, flags string, ok bool) {
+	match := traceParentPattern.FindStringSubmatch(traceParent)
+	if match == nil || match[1] == "ff" || isZero(match[2]) || isZero(match[3]) {
+		return "", "", "", false
+	}
+	return match[2], match[3], match[4], true
+}
+
+// FormatTraceParent returns the W3C traceparent of the trace ID, parent ID and flags.
+func FormatTraceParent(traceID string, parentID string, flags string) string {
+	return fmt.Sprintf("00-%s-%s-%s", traceID, parentID, flags)
+}
+
+// NewTraceID returns a random trace ID.
+func NewTraceID() string {
+	return randomHex(16)
+}
+
+// NewSpanID returns a random span ID.
+func NewSpanID() string {
+	return randomHex(8)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func isZero(s string) bool {
+	for _, c := range s {
+		if c != '0' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package tracing
+
+import (
+	"errors"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// recordingExporter keeps the spans exported to it.
+type recordingExporter struct {
+	spans []*Span
+}
+
+func (e *recordingExporter) Export(spans []*Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func TestSpans(t *testing.T) {
+
+	Convey("Given a request span continuing a trace", t, func() {
+		exporter := &recordingExporter{}
+		SetExporter(exporter)
+		request := StartRequest("requestId", "request", KIND_SERVER, traceParent)
+
+		Convey("Then it is part of the trace, with the caller as its parent", func() {
+			So(request.TraceID, ShouldEqual, "4bf92f3577b34da6a3ce929d0e0e4736")
+			So(request.ParentID, ShouldEqual, "00f067aa0ba902b7")
+			So(request.TraceParent(), ShouldEqual, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+request.SpanID+"-01")
+			So(request.Attributes[REQUEST_ID], ShouldEqual, "requestId")
+		})
+
+		Convey("Then spans started for the request are its children until it ends", func() {
+			inner := StartRequest("requestId", "inner", KIND_INTERNAL, "")
+			child := Start("requestId", "child", KIND_CLIENT)
+			child.SetAttribute(BYTES, 10)
+			child.SetError(errors.New("failed"))
+			child.End()
+			inner.End()
+			sibling := Start("requestId", "sibling", KIND_CLIENT)
+			sibling.End()
+			request.End()
+			after := Start("requestId", "after", KIND_CLIENT)
+
+			So(inner.ParentID, ShouldEqual, request.SpanID)
+			So(child.TraceID, ShouldEqual, request.TraceID)
+			So(child.ParentID, ShouldEqual, inner.SpanID)
+			So(sibling.ParentID, ShouldEqual, request.SpanID)
+			So(after.TraceID, ShouldNotEqual, request.TraceID)
+			So(after.ParentID, ShouldEqual, "")
+
+			Flush()
+			So(len(exporter.spans), ShouldEqual, 4)
+			So(exporter.spans[0].Attributes[BYTES], ShouldEqual, 10)
+			So(exporter.spans[0].Err.Error(), ShouldEqual, "failed")
+		})
+
+		Reset(func() {
+			request.End()
+			SetExporter(nil)
+		})
+	})
+
+	Convey("Given a request span without a valid traceparent", t, func() {
+		request := StartRequest("requestId", "request", KIND_SERVER, "not a traceparent")
+		defer request.End()
+
+		Convey("Then it starts a new trace", func() {
+			So(len(request.TraceID), ShouldEqual, 32)
+			So(request.ParentID, ShouldEqual, "")
+		})
+	})
+
+	Convey("Spans should not be exported without an exporter", t, func() {
+		span := Start("requestId", "span", KIND_INTERNAL)
+		span.End()
+		So(len(spans.queue), ShouldEqual, 0)
+	})
+
+	Convey("Invalid traceparents should be rejected", t, func() {
+		_, _, _, ok := ParseTraceParent(traceParent)
+		So(ok, ShouldBeTrue)
+		for _, invalid := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"} {
+			_, _, _, ok := ParseTraceParent(invalid)
+			So(ok, ShouldBeFalse)
+		}
+	})
+}